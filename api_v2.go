@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const apiV2Prefix = "/cm_manager/v2"
+
+// apiRoute describes one v2 endpoint. The same table is used to register the
+// gin routes and to generate the OpenAPI document, so the two cannot drift.
+type apiRoute struct {
+	Method   string
+	Path     string
+	Handler  gin.HandlerFunc
+	Tag      string
+	Summary  string
+	Query    []apiParam
+	Body     interface{}
+	Response interface{}
+	Status   int
+	Role     role
+}
+
+type apiParam struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+type apiMessage struct {
+	Msg     string        `json:"msg"`
+	Retries []retryRecord `json:"retries,omitempty"` //controller calls that needed more than one attempt
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// waitParam is accepted by the routes that lock the services they act on
+var waitParam = apiParam{Name: "wait", Description: "Queue behind the operation holding the service instead of answering 409"}
+
+var v2Routes = []apiRoute{
+	{Method: "GET", Path: "/up", Handler: upHandler, Tag: "Manager", Summary: "Check that the manager is up", Response: apiMessage{}},
+	{Method: "POST", Path: "/heartbeat", Handler: heatbeatHandler, Tag: "Manager", Summary: "Receive a heartbeat from a worker", Body: heartbeatBody{}},
+
+	{Method: "GET", Path: "/workers", Handler: getAllWorkersHandler, Tag: "Worker", Summary: "List all workers", Response: []Worker{}, Role: roleReader},
+	{Method: "POST", Path: "/workers", Handler: addWorkerHandler, Tag: "Worker", Summary: "Add a worker", Body: workerReq{}, Response: apiMessage{}, Role: roleAdmin},
+	{Method: "GET", Path: "/workers/:worker_id", Handler: getWorkerHandler, Tag: "Worker", Summary: "Get a worker", Response: Worker{}, Role: roleReader},
+	{Method: "DELETE", Path: "/workers/:worker_id", Handler: deleteWorkerHandler, Tag: "Worker", Summary: "Delete a worker, refusing, draining or forcing out its services", Query: []apiParam{{Name: "mode", Description: "refuse (default) answers 409 when the worker has services, drain migrates them away, force stops and removes them"}, waitParam}, Response: decommissionResp{}, Role: roleAdmin},
+	{Method: "GET", Path: "/workers/:worker_id/services", Handler: getWorkerServicesHandler, Tag: "Worker", Summary: "List the services on a worker", Response: []ServiceInWorker{}, Role: roleReader},
+	{Method: "GET", Path: "/workers/:worker_id/services/:service", Handler: getWorkerServiceHandler, Tag: "Worker", Summary: "Get the status of a service on a worker", Response: ServiceInWorker{}, Role: roleReader},
+	{Method: "DELETE", Path: "/workers/:worker_id/services/:service", Handler: removeServiceHandler, Tag: "Worker", Summary: "Remove a service's container from a worker", Query: []apiParam{waitParam}, Response: apiMessage{}, Role: roleOperator},
+	{Method: "POST", Path: "/workers/:worker_id/services/:service/actions/start", Handler: startServiceHandler, Tag: "Action", Summary: "Start a service's container on a worker", Body: StartOptions{}, Query: []apiParam{waitParam}, Response: apiMessage{}, Role: roleOperator},
+	{Method: "POST", Path: "/workers/:worker_id/services/:service/actions/run", Handler: runServiceHandler, Tag: "Action", Summary: "Run or restore a service on a worker", Body: RunOptions{}, Query: []apiParam{waitParam}, Response: apiMessage{}, Role: roleOperator},
+	{Method: "POST", Path: "/workers/:worker_id/services/:service/actions/checkpoint", Handler: checkpointServiceHandler, Tag: "Action", Summary: "Checkpoint a service on a worker", Body: CheckpointOptions{}, Query: []apiParam{waitParam}, Response: apiMessage{}, Role: roleOperator},
+	{Method: "POST", Path: "/workers/:worker_id/services/:service/actions/stop", Handler: stopServiceHandler, Tag: "Action", Summary: "Stop a service on a worker", Query: []apiParam{waitParam}, Response: apiMessage{}, Role: roleOperator},
+
+	{Method: "GET", Path: "/services", Handler: getAllServicesHandler, Tag: "Service", Summary: "List all services", Response: []Service{}, Role: roleReader},
+	{Method: "POST", Path: "/services", Handler: addServiceHandler, Tag: "Service", Summary: "Add a service, or an instance named service/instance", Body: serviceReq{}, Response: apiMessage{}, Role: roleAdmin},
+	{Method: "GET", Path: "/services/:name", Handler: getServiceHandler, Tag: "Service", Summary: "Get a service", Response: Service{}, Role: roleReader},
+	{Method: "DELETE", Path: "/services/:name", Handler: deleteServiceHandler, Tag: "Service", Summary: "Delete a service",
+		Query: []apiParam{{Name: "delChk", Description: "Also delete the service's checkpoint files when true"}, waitParam}, Status: http.StatusNoContent, Role: roleAdmin},
+	{Method: "GET", Path: "/services/:name/instances", Handler: getServiceInstancesHandler, Tag: "Service", Summary: "List the instances of a service", Response: []Service{}, Role: roleReader},
+	{Method: "POST", Path: "/services/:name/instances", Handler: addServiceInstanceHandler, Tag: "Service", Summary: "Add an instance to a service, addressed as service/instance (svc%2Fa in paths) afterwards", Body: instanceReq{}, Response: apiMessage{}, Role: roleAdmin},
+	{Method: "POST", Path: "/services/:name/actions/clone", Handler: cloneServiceHandler, Tag: "Action", Summary: "Clone a running service onto other workers from a leave_running checkpoint, registering each clone as a new service", Body: cloneReq{}, Query: []apiParam{waitParam}, Response: cloneResp{}, Role: roleAdmin},
+	{Method: "GET", Path: "/services/:name/config", Handler: getServiceConfigHandler, Tag: "Service", Summary: "Get the last used options of a service", Response: ServiceConfig{}, Role: roleReader},
+	{Method: "GET", Path: "/services/:name/standby", Handler: getStandbyHandler, Tag: "Service", Summary: "Get the warm standby setting of a service and the workers currently warm", Response: standbyStatus{}, Role: roleReader},
+	{Method: "PUT", Path: "/services/:name/standby", Handler: setStandbyHandler, Tag: "Service", Summary: "Keep standby containers of a service on chosen or scheduled workers", Body: StandbyConfig{}, Response: standbyStatus{}, Role: roleAdmin},
+	{Method: "GET", Path: "/services/:name/checkpoints", Handler: getServiceCheckpointsHandler, Tag: "Service", Summary: "List the checkpoint images of a service", Response: []string{}, Role: roleReader},
+	{Method: "GET", Path: "/services/:name/checkpoints/sizes", Handler: getServiceCheckpointSizesHandler, Tag: "Service", Summary: "List the checkpoint images of a service with their size on the shared storage", Response: []checkpointImage{}, Role: roleReader},
+
+	{Method: "GET", Path: "/locks", Handler: getLocksHandler, Tag: "Manager", Summary: "List the services locked by an operation and the requests waiting for them", Response: []ServiceLock{}, Role: roleReader},
+	{Method: "GET", Path: "/log/level", Handler: logLevelHandler, Tag: "Manager", Summary: "Get the current log level", Response: logLevelBody{}, Role: roleReader},
+	{Method: "PUT", Path: "/log/level", Handler: logLevelHandler, Tag: "Manager", Summary: "Change the log level at runtime", Body: logLevelBody{}, Response: logLevelBody{}, Role: roleAdmin},
+	{Method: "GET", Path: "/audit", Handler: getAuditHandler, Tag: "Manager", Summary: "Query the audit log of mutating requests",
+		Query: []apiParam{
+			{Name: "service", Description: "Only entries acting on this service"},
+			{Name: "worker", Description: "Only entries acting on this worker"},
+			{Name: "since", Description: "RFC3339 time of the oldest entry"},
+			{Name: "until", Description: "RFC3339 time of the newest entry"},
+			{Name: "limit", Description: "Maximum number of most recent entries, default 100"},
+		}, Response: []AuditEntry{}, Role: roleAdmin},
+
+	{Method: "GET", Path: "/webhooks", Handler: getWebhooksHandler, Tag: "Webhook", Summary: "List the webhook subscriptions, secrets redacted", Response: []WebhookSubscription{}, Role: roleAdmin},
+	{Method: "POST", Path: "/webhooks", Handler: addWebhookHandler, Tag: "Webhook", Summary: "Subscribe a URL to cluster events", Body: webhookReq{}, Response: WebhookSubscription{}, Status: http.StatusCreated, Role: roleAdmin},
+	{Method: "GET", Path: "/webhooks/:id", Handler: getWebhookHandler, Tag: "Webhook", Summary: "Get a webhook subscription", Response: WebhookSubscription{}, Role: roleAdmin},
+	{Method: "DELETE", Path: "/webhooks/:id", Handler: deleteWebhookHandler, Tag: "Webhook", Summary: "Delete a webhook subscription", Status: http.StatusNoContent, Role: roleAdmin},
+	{Method: "GET", Path: "/webhooks/:id/deliveries", Handler: getWebhookDeliveriesHandler, Tag: "Webhook", Summary: "List the most recent deliveries of a subscription",
+		Query: []apiParam{
+			{Name: "status", Description: "Only pending, delivered, failed or dropped deliveries"},
+			{Name: "limit", Description: "Maximum number of most recent deliveries, default 100"},
+		}, Response: []WebhookDelivery{}, Role: roleAdmin},
+	{Method: "POST", Path: "/webhooks/:id/actions/test", Handler: testWebhookHandler, Tag: "Webhook", Summary: "Send a ping event once, 502 when the receiver does not accept it", Response: WebhookDelivery{}, Role: roleAdmin},
+
+	{Method: "GET", Path: "/services/:name/migrations", Handler: getServiceMigrationsHandler, Tag: "Service", Summary: "List the migration history of a service",
+		Query: []apiParam{{Name: "limit", Description: "Maximum number of most recent migrations"}}, Response: []MigrationRecord{}, Role: roleReader},
+	{Method: "GET", Path: "/services/:name/migrations/stats", Handler: getMigrationStatsHandler, Tag: "Service", Summary: "Get migration statistics of a service", Response: migrationStatsResp{}, Role: roleReader},
+	{Method: "GET", Path: "/migrations", Handler: getServiceMigrationsHandler, Tag: "Migration", Summary: "List the migration history of all services",
+		Query: []apiParam{{Name: "limit", Description: "Maximum number of most recent migrations"}}, Response: []MigrationRecord{}, Role: roleReader},
+	{Method: "GET", Path: "/migrations/stats", Handler: getMigrationStatsHandler, Tag: "Migration", Summary: "Get migration statistics per worker pair",
+		Query: []apiParam{{Name: "service", Description: "Only migrations of this service"}}, Response: migrationStatsResp{}, Role: roleReader},
+	{Method: "POST", Path: "/migrations/batch", Handler: batchMigrationHandler, Tag: "Migration", Summary: "Migrate several services in one request, 207 when some items did not succeed",
+		Query: []apiParam{waitParam}, Body: batchMigrationReq{}, Response: batchMigrationResp{}, Role: roleOperator},
+	{Method: "POST", Path: "/rebalance/plan", Handler: rebalanceHandler(true), Tag: "Migration", Summary: "Compute the migrations that evacuate workers and even out the load, without running them",
+		Body: rebalanceReq{}, Response: rebalancePlan{}, Role: roleReader},
+	{Method: "POST", Path: "/rebalance", Handler: rebalanceHandler(false), Tag: "Migration", Summary: "Evacuate workers and even out the load, 207 when some steps failed and were rolled back",
+		Query: []apiParam{waitParam}, Body: rebalanceReq{}, Response: rebalancePlan{}, Role: roleOperator},
+	{Method: "POST", Path: "/migrations", Handler: createMigrationHandler, Tag: "Migration", Summary: "Migrate a service between workers, with dry_run=true only run the preflight checks and return them with 200",
+		Query: []apiParam{{Name: "dry_run", Description: "Only check whether the migration can run, returns a preflightResult"}, waitParam}, Body: migrationReq{}, Response: migrationResp{}, Status: http.StatusCreated, Role: roleOperator},
+}
+
+func registerV2Routes(router *gin.Engine) {
+	v2 := router.Group(apiV2Prefix)
+	for _, route := range v2Routes {
+		if route.Role != roleNone {
+			v2.Handle(route.Method, route.Path, requireRole(route.Role), route.Handler)
+		} else {
+			v2.Handle(route.Method, route.Path, route.Handler)
+		}
+	}
+	// Served outside of v2Routes since the document is generated from that table
+	v2.GET("/openapi", openapiHandler)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var auditPath = "cm_manager_audit.log"
+var auditMaxSize = 100 //megabytes
+var auditMaxBackups = 10
+var auditMaxAge = 90 //days
+
+var auditWriter *lumberjack.Logger
+var auditMu sync.Mutex
+
+var auditRedactKeys = map[string]bool{
+	"passphrase_file": true,
+	"passphrase":      true,
+	"token":           true,
+	"join_token":      true,
+	"password":        true,
+	"secret":          true,
+}
+
+// Heartbeats are too frequent to be audited or traced
+var heartbeatPaths = map[string]bool{
+	"/cm_manager/v1.0/heartbeat": true,
+	apiV2Prefix + "/heartbeat":   true,
+}
+
+type AuditEntry struct {
+	Time       time.Time   `json:"time"`
+	Caller     string      `json:"caller"`
+	Via        string      `json:"via"`
+	Listener   string      `json:"listener"`
+	RemoteAddr string      `json:"remote_addr"`
+	Method     string      `json:"method"`
+	Route      string      `json:"route"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query,omitempty"`
+	Service    string      `json:"service,omitempty"`
+	Workers    []string    `json:"workers,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+	Status     int         `json:"status"`
+	Outcome    string      `json:"outcome"`
+	Error      string      `json:"error,omitempty"`
+	Duration   float64     `json:"duration"`
+}
+
+func audit_init() {
+	auditWriter = &lumberjack.Logger{
+		Filename:   auditPath,
+		MaxSize:    auditMaxSize,
+		MaxBackups: auditMaxBackups,
+		MaxAge:     auditMaxAge,
+	}
+	logger.Info("Audit log enabled", zap.String("path", auditPath))
+}
+
+// bodyRecorder keeps a copy of the response body so the outcome of the
+// request can be audited
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	if w.body.Len() < 4096 {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func auditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		if auditWriter == nil || heartbeatPaths[c.Request.URL.Path] ||
+			(method != http.MethodPost && method != http.MethodPut && method != http.MethodDelete && method != http.MethodPatch) {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		var reqBody []byte
+		if c.Request.Body != nil {
+			reqBody, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(reqBody))
+		}
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		c.Next()
+
+		id := identityOf(c)
+		entry := AuditEntry{
+			Time:       start.UTC(),
+			Caller:     id.Name,
+			Via:        id.Via,
+			Listener:   listenerOf(c),
+			RemoteAddr: c.Request.RemoteAddr,
+			Method:     method,
+			Route:      c.FullPath(),
+			Path:       c.Request.URL.Path,
+			Query:      c.Request.URL.RawQuery,
+			Status:     c.Writer.Status(),
+			Duration:   time.Since(start).Seconds(),
+		}
+		var parsed interface{}
+		if len(reqBody) > 0 && json.Unmarshal(reqBody, &parsed) == nil {
+			entry.Body = redact(parsed)
+		}
+		entry.Service, entry.Workers = auditTargets(c, parsed)
+		entry.Outcome = "success"
+		if entry.Status >= 400 {
+			entry.Outcome = "failure"
+			var resp apiError
+			if json.Unmarshal(recorder.body.Bytes(), &resp) == nil {
+				entry.Error = resp.Error
+			}
+		}
+		writeAuditEntry(entry)
+	}
+}
+
+func writeAuditEntry(entry AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Error marshalling audit entry", zap.Error(err))
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := auditWriter.Write(append(line, '\n')); err != nil {
+		logger.Error("Error writing audit entry", zap.Error(err))
+	}
+}
+
+func redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if auditRedactKeys[strings.ToLower(k)] {
+				if s, ok := val.(string); ok && s == "" {
+					continue
+				}
+				t[k] = "[REDACTED]"
+				continue
+			}
+			t[k] = redact(val)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redact(t[i])
+		}
+	}
+	return v
+}
+
+// auditTargets finds the service and workers a request acts on from the
+// path parameters, the query and the request body
+func auditTargets(c *gin.Context, body interface{}) (string, []string) {
+	service := c.Param("service")
+	if service == "" {
+		service = c.Param("name")
+	}
+	var targets []string
+	add := func(w string) {
+		if w == "" {
+			return
+		}
+		for _, v := range targets {
+			if v == w {
+				return
+			}
+		}
+		targets = append(targets, w)
+	}
+	add(c.Param("worker_id"))
+	add(c.Query("src"))
+	add(c.Query("dest"))
+	if m, ok := body.(map[string]interface{}); ok {
+		if s, ok := m["service"].(string); ok && service == "" {
+			service = s
+		}
+		for _, key := range []string{"worker_id", "src", "dest"} {
+			if s, ok := m[key].(string); ok {
+				add(s)
+			}
+		}
+	}
+	return service, targets
+}
+
+// auditFiles returns the rotated audit files followed by the current one,
+// oldest first
+func auditFiles() []string {
+	ext := filepath.Ext(auditPath)
+	prefix := strings.TrimSuffix(auditPath, ext) + "-"
+	backups, _ := filepath.Glob(prefix + "*" + ext)
+	sort.Strings(backups)
+	return append(backups, auditPath)
+}
+
+type auditFilter struct {
+	service string
+	worker  string
+	since   time.Time
+	until   time.Time
+}
+
+func (f auditFilter) match(e AuditEntry) bool {
+	if f.service != "" && e.Service != f.service {
+		return false
+	}
+	if f.worker != "" {
+		found := false
+		for _, w := range e.Workers {
+			if w == f.worker {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && e.Time.After(f.until) {
+		return false
+	}
+	return true
+}
+
+func queryAudit(filter auditFilter, limit int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	for _, path := range auditFiles() {
+		file, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if filter.match(e) {
+				entries = append(entries, e)
+			}
+		}
+		file.Close()
+	}
+	// Keep the most recent entries
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+func getAuditHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	if auditWriter == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Audit log is disabled"})
+		return
+	}
+	filter := auditFilter{service: c.Query("service"), worker: c.Query("worker")}
+	var err error
+	if since := c.Query("since"); since != "" {
+		if filter.since, err = time.Parse(time.RFC3339, since); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since, expected RFC3339 time"})
+			return
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if filter.until, err = time.Parse(time.RFC3339, until); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until, expected RFC3339 time"})
+			return
+		}
+	}
+	limit := 100
+	if l := c.Query("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+	}
+
+	auditMu.Lock()
+	entries, err := queryAudit(filter, limit)
+	auditMu.Unlock()
+	if err != nil {
+		logger.Error("Error reading audit log", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading audit log:" + err.Error()})
+		return
+	}
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want interface{}
+	}{
+		{
+			name: "plain values are kept",
+			in:   map[string]interface{}{"src": "w1", "dest": "w2", "stop": true},
+			want: map[string]interface{}{"src": "w1", "dest": "w2", "stop": true},
+		},
+		{
+			name: "sensitive keys are redacted",
+			in:   map[string]interface{}{"passphrase_file": "/etc/key", "token": "abc", "src": "w1"},
+			want: map[string]interface{}{"passphrase_file": "[REDACTED]", "token": "[REDACTED]", "src": "w1"},
+		},
+		{
+			name: "keys match case insensitively",
+			in:   map[string]interface{}{"Passphrase": "x", "SECRET": 3},
+			want: map[string]interface{}{"Passphrase": "[REDACTED]", "SECRET": "[REDACTED]"},
+		},
+		{
+			name: "empty strings are left to show the option was not set",
+			in:   map[string]interface{}{"passphrase_file": ""},
+			want: map[string]interface{}{"passphrase_file": ""},
+		},
+		{
+			name: "nested objects and lists",
+			in: map[string]interface{}{
+				"copt":  map[string]interface{}{"passphrase_file": "/k", "leave_running": true},
+				"items": []interface{}{map[string]interface{}{"join_token": "t"}, "w1"},
+			},
+			want: map[string]interface{}{
+				"copt":  map[string]interface{}{"passphrase_file": "[REDACTED]", "leave_running": true},
+				"items": []interface{}{map[string]interface{}{"join_token": "[REDACTED]"}, "w1"},
+			},
+		},
+		{
+			name: "scalars pass through",
+			in:   "token",
+			want: "token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redact(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redact() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
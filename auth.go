@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type role int
+
+const (
+	roleNone role = iota
+	roleReader
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"reader":    roleReader,
+	"read-only": roleReader,
+	"operator":  roleOperator,
+	"admin":     roleAdmin,
+}
+
+func (r role) String() string {
+	switch r {
+	case roleReader:
+		return "reader"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+type identity struct {
+	Name string `json:"name"`
+	Role role   `json:"-"`
+	Via  string `json:"via"` //token, cert, local or anonymous
+}
+
+// Tokens are kept by their sha256 so lookups don't compare secrets directly
+var authTokens = make(map[[32]byte]identity)
+var authCertRoles = make(map[string]role)
+
+// When false requests on the unix socket are trusted as local admin
+var authUnix = false
+
+const (
+	listenerUnix = "unix"
+	listenerTCP  = "tcp"
+)
+
+type listenerKey struct{}
+
+func withListener(name string) func(context.Context, net.Conn) context.Context {
+	return func(ctx context.Context, _ net.Conn) context.Context {
+		return context.WithValue(ctx, listenerKey{}, name)
+	}
+}
+
+func listenerOf(c *gin.Context) string {
+	if name, ok := c.Request.Context().Value(listenerKey{}).(string); ok {
+		return name
+	}
+	return listenerTCP
+}
+
+func authEnabled() bool {
+	return len(authTokens) > 0 || len(authCertRoles) > 0
+}
+
+func identityOf(c *gin.Context) identity {
+	if v, ok := c.Get("identity"); ok {
+		return v.(identity)
+	}
+	return identity{Name: "anonymous", Role: roleNone, Via: "anonymous"}
+}
+
+// authenticate resolves the caller of a request. It only rejects requests
+// carrying invalid credentials, the role check is done by requireRole.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authEnabled() || (listenerOf(c) == listenerUnix && !authUnix) {
+			c.Set("identity", identity{Name: "local", Role: roleAdmin, Via: "local"})
+			c.Next()
+			return
+		}
+
+		if header := c.GetHeader("Authorization"); header != "" {
+			token := strings.TrimPrefix(header, "Bearer ")
+			id, found := authTokens[sha256.Sum256([]byte(token))]
+			if !strings.HasPrefix(header, "Bearer ") || !found {
+				logger.Warn("Invalid bearer token", zap.String("path", c.Request.URL.Path), zap.String("remote", c.ClientIP()))
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				return
+			}
+			c.Set("identity", id)
+			c.Next()
+			return
+		}
+
+		if c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0 {
+			cn := c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+			if r, ok := authCertRoles[cn]; ok {
+				c.Set("identity", identity{Name: cn, Role: r, Via: "cert"})
+			}
+		}
+		c.Next()
+	}
+}
+
+func requireRole(r role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := identityOf(c)
+		if id.Role == roleNone {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+		if id.Role < r {
+			logger.Warn("Permission denied", zap.String("caller", id.Name), zap.String("role", id.Role.String()), zap.String("required", r.String()), zap.String("path", c.Request.URL.Path))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Permission denied, requires role " + r.String()})
+			return
+		}
+		c.Next()
+	}
+}
+
+func auth_tokens_init(tokenPath string) {
+	file, err := os.Open(tokenPath)
+	if err != nil {
+		logger.Error("Error opening TokenFile", zap.Error(err))
+		return
+	}
+	defer file.Close()
+
+	// Each line is "<token> <role> [name]", without a name the caller is
+	// recorded by a prefix of the token's hash so that audit entries still
+	// tell tokens apart
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		r, ok := roleNames[fields[1]]
+		if !ok {
+			logger.Error("Unknown role in TokenFile", zap.String("role", fields[1]))
+			continue
+		}
+		sum := sha256.Sum256([]byte(fields[0]))
+		name := "token-" + hex.EncodeToString(sum[:4])
+		if len(fields) >= 3 {
+			name = fields[2]
+		}
+		authTokens[sum] = identity{Name: name, Role: r, Via: "token"}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Error("Error reading TokenFile", zap.Error(err))
+	}
+	logger.Info("Loaded API tokens", zap.Int("count", len(authTokens)))
+}
+
+func auth_certs_init(certPath string) {
+	file, err := os.Open(certPath)
+	if err != nil {
+		logger.Error("Error opening CertRoleFile", zap.Error(err))
+		return
+	}
+	defer file.Close()
+
+	// Each line is "<client cert common name> <role>"
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		cn, roleName := processLine(line)
+		if cn == "" {
+			continue
+		}
+		r, ok := roleNames[roleName]
+		if !ok {
+			logger.Error("Unknown role in CertRoleFile", zap.String("role", roleName))
+			continue
+		}
+		authCertRoles[cn] = r
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Error("Error reading CertRoleFile", zap.Error(err))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthTokensInit(t *testing.T) {
+	old := authTokens
+	authTokens = make(map[[32]byte]identity)
+	t.Cleanup(func() { authTokens = old })
+	path := filepath.Join(t.TempDir(), "tokens")
+	os.WriteFile(path, []byte("# token role name\ns3cret admin alice\nanon1 operator\nanon2 operator\nbad superuser\n"), 0600)
+
+	auth_tokens_init(path)
+	tests := []struct {
+		token string
+		name  string
+		role  role
+		found bool
+	}{
+		{token: "s3cret", name: "alice", role: roleAdmin, found: true},
+		{token: "anon1", role: roleOperator, found: true},
+		{token: "anon2", role: roleOperator, found: true},
+		{token: "bad"},
+	}
+	names := make(map[string]bool)
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			id, ok := authTokens[sha256.Sum256([]byte(tt.token))]
+			if ok != tt.found {
+				t.Fatalf("found = %v, want %v", ok, tt.found)
+			}
+			if !ok {
+				return
+			}
+			if id.Role != tt.role {
+				t.Errorf("role = %v, want %v", id.Role, tt.role)
+			}
+			if tt.name != "" && id.Name != tt.name {
+				t.Errorf("name = %q, want %q", id.Name, tt.name)
+			}
+			if tt.name == "" && (!strings.HasPrefix(id.Name, "token-") || strings.Contains(id.Name, tt.token)) {
+				t.Errorf("name = %q, want a hash prefix not showing the token", id.Name)
+			}
+			if names[id.Name] {
+				t.Errorf("name %q given to two tokens", id.Name)
+			}
+			names[id.Name] = true
+		})
+	}
+}
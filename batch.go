@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+type batchMigrationReq struct {
+	Items     []batchItem `json:"items"`
+	Order     string      `json:"order"`      //sequential (default), parallel or dependency
+	Limit     int         `json:"limit"`      //migrations run at the same time, 0 means no limit
+	OnFailure string      `json:"on_failure"` //stop (default), continue or rollback
+}
+
+type batchItem struct {
+	migrationReq
+	DependsOn []string `json:"depends_on"` //services of the batch migrated before this one, with order dependency
+}
+
+type batchItemResult struct {
+	Service  string  `json:"service"`
+	Src      string  `json:"src"`
+	Dest     string  `json:"dest"`
+	Status   string  `json:"status"`            //success, failed, skipped, rolled_back or rollback_failed
+	Outcome  string  `json:"outcome,omitempty"` //outcome of the migration, see MigrationRecord
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type batchMigrationResp struct {
+	Results []batchItemResult `json:"results"`
+}
+
+// batchDeps returns for each item the indexes of the items it waits for
+func batchDeps(req batchMigrationReq) ([][]int, error) {
+	index := make(map[string]int)
+	for i, item := range req.Items {
+		if _, ok := index[item.Service]; ok {
+			return nil, fmt.Errorf("service %s appears twice", item.Service)
+		}
+		index[item.Service] = i
+	}
+	deps := make([][]int, len(req.Items))
+	switch req.Order {
+	case "", "sequential":
+		for i := 1; i < len(req.Items); i++ {
+			deps[i] = []int{i - 1}
+		}
+	case "parallel":
+	case "dependency":
+		for i, item := range req.Items {
+			for _, name := range item.DependsOn {
+				j, ok := index[name]
+				if !ok {
+					return nil, fmt.Errorf("service %s depends on %s which is not in the batch", item.Service, name)
+				}
+				deps[i] = append(deps[i], j)
+			}
+		}
+		if batchHasCycle(deps) {
+			return nil, errors.New("dependency cycle")
+		}
+	default:
+		return nil, fmt.Errorf("unknown order %s", req.Order)
+	}
+	return deps, nil
+}
+
+func batchHasCycle(deps [][]int) bool {
+	state := make([]int, len(deps)) //0 unvisited, 1 visiting, 2 done
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		if state[i] == 1 {
+			return true
+		}
+		if state[i] == 2 {
+			return false
+		}
+		state[i] = 1
+		for _, j := range deps[i] {
+			if visit(j) {
+				return true
+			}
+		}
+		state[i] = 2
+		return false
+	}
+	for i := range deps {
+		if visit(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// runBatch migrates the items once the items they depend on succeeded, at
+// most limit at a time. Items whose dependencies failed are skipped, as are
+// all items not started yet after a failure unless the policy is continue.
+// With the rollback policy the migrated items are then moved back, the last
+// migrated first.
+func runBatch(ctx context.Context, req batchMigrationReq, deps [][]int) []batchItemResult {
+	logger := loggerFrom(ctx)
+	ctx, span := tracer.Start(ctx, "migrate.batch", trace.WithAttributes(
+		attribute.Int("cm.items", len(req.Items)),
+		attribute.String("cm.order", req.Order),
+	))
+	defer span.End()
+
+	results := make([]batchItemResult, len(req.Items))
+	for i, item := range req.Items {
+		results[i] = batchItemResult{Service: item.Service, Src: item.Src, Dest: item.Dest}
+	}
+	limit := req.Limit
+	if limit < 1 {
+		limit = len(req.Items)
+	}
+
+	var resMu sync.Mutex
+	var wg sync.WaitGroup
+	done := make(chan int, len(req.Items))
+	started := make([]bool, len(req.Items))
+	migrated := []int{}
+	failed := false
+	pending := len(req.Items)
+	running := 0
+
+	for pending > 0 {
+		// Start or skip every item whose dependencies are settled
+		resMu.Lock()
+		skipped := false
+		for i := range req.Items {
+			if started[i] {
+				continue
+			}
+			ready, skip := true, failed && req.OnFailure != "continue"
+			for _, j := range deps[i] {
+				switch results[j].Status {
+				case "":
+					ready = false
+				case "success":
+				default:
+					skip = true
+				}
+			}
+			if skip {
+				started[i] = true
+				results[i].Status = "skipped"
+				pending--
+				skipped = true
+				continue
+			}
+			if !ready || running >= limit {
+				continue
+			}
+			started[i] = true
+			running++
+			wg.Add(1)
+			go func(i int, item batchItem) {
+				defer wg.Done()
+				service, _ := getService(item.Service)
+				rec, err := migrateService(ctx, item.Src, item.Dest, service, item.Copt, item.Ropt, item.Sopt, item.Stop)
+				resMu.Lock()
+				results[i].Outcome = rec.Outcome
+				if err != nil {
+					logger.Error("Batch item failed", zap.String("service", item.Service), zap.Error(err))
+					results[i].Status = "failed"
+					results[i].Error = err.Error()
+				} else {
+					results[i].Status = "success"
+					results[i].Duration = rec.Duration
+				}
+				resMu.Unlock()
+				done <- i
+			}(i, req.Items[i])
+		}
+		resMu.Unlock()
+		if skipped {
+			// Items depending on the skipped ones may be settled now
+			continue
+		}
+		if running == 0 {
+			break
+		}
+
+		i := <-done
+		running--
+		pending--
+		resMu.Lock()
+		if results[i].Status == "success" {
+			migrated = append(migrated, i)
+		} else {
+			failed = true
+		}
+		resMu.Unlock()
+	}
+	wg.Wait()
+
+	if failed && req.OnFailure == "rollback" {
+		for k := len(migrated) - 1; k >= 0; k-- {
+			i := migrated[k]
+			item := req.Items[i]
+			if err := rollbackBatchItem(ctx, item); err != nil {
+				logger.Error("Error rolling back batch item", zap.String("service", item.Service), zap.Error(err))
+				results[i].Status = "rollback_failed"
+				results[i].Error = err.Error()
+				continue
+			}
+			results[i].Status = "rolled_back"
+		}
+	}
+	return results
+}
+
+// rollbackBatchItem undoes a migrated item. When the item left the source
+// running, the copy on dest is removed. Otherwise the service is migrated
+// back into its container on the source, started with the options it had
+// there.
+func rollbackBatchItem(ctx context.Context, item batchItem) error {
+	service, _ := getService(item.Service)
+	updateWorkerServices(ctx, item.Src, item.Service)
+	src, _ := getWorker(item.Src)
+	if _, stat := isServiceInWorker(src, item.Service); !item.Stop && stat == "running" {
+		dest, _ := getWorker(item.Dest)
+		if err := stopService(ctx, dest, service); err != nil {
+			return err
+		}
+		return removeService(ctx, dest, service)
+	}
+	sopt := lastStartOptions(item.Src, item.Service)
+	if sopt.Image == "" {
+		sopt = item.Sopt
+	}
+	_, err := migrateService(ctx, item.Dest, item.Src, service, item.Copt, item.Ropt, sopt, true)
+	return err
+}
+
+func batchMigrationHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "post"), zap.String("path", c.Request.URL.Path))
+	var requestBody batchMigrationReq
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		logger.Error("Error decoding JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
+		return
+	}
+	switch requestBody.OnFailure {
+	case "", "stop", "continue", "rollback":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown on_failure " + requestBody.OnFailure})
+		return
+	}
+	// Every item is checked before any is migrated
+	seen := make(map[string]bool)
+	for i := range requestBody.Items {
+		item := &requestBody.Items[i]
+		if seen[item.Service] {
+			logger.Error("Service appears twice in batch", zap.String("serviceName", item.Service))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Service appears twice: " + item.Service})
+			return
+		}
+		seen[item.Service] = true
+		if status, err := prepareMigration(&item.migrationReq); err != nil {
+			logger.Error("Invalid batch item", zap.String("serviceName", item.Service), zap.Error(err))
+			c.JSON(status, gin.H{"error": item.Service + ": " + err.Error()})
+			return
+		}
+		if item.Src == item.Dest {
+			logger.Error("Same source and destination", zap.String("serviceName", item.Service), zap.String("workerID", item.Src))
+			c.JSON(http.StatusBadRequest, gin.H{"error": item.Service + ": source and destination are the same worker"})
+			return
+		}
+	}
+	deps, err := batchDeps(requestBody)
+	if err != nil {
+		logger.Error("Invalid batch", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	names := []string{}
+	itemWorkers := make(map[string][]string)
+	for _, item := range requestBody.Items {
+		names = append(names, item.Service)
+		itemWorkers[item.Service] = []string{item.Src, item.Dest}
+	}
+	ctx, release, ok := lockForRequest(c, names, "batch_migrate", func(name string) []string { return itemWorkers[name] })
+	if !ok {
+		return
+	}
+	defer release()
+
+	logger.Info("Migrating batch", zap.Int("items", len(requestBody.Items)), zap.String("order", requestBody.Order), zap.String("on_failure", requestBody.OnFailure))
+	results := runBatch(ctx, requestBody, deps)
+
+	status := http.StatusOK
+	for _, r := range results {
+		if r.Status != "success" {
+			status = http.StatusMultiStatus
+		}
+	}
+	logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Int("status", status))
+	c.JSON(status, batchMigrationResp{Results: results})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBatchDeps(t *testing.T) {
+	item := func(service string, dependsOn ...string) batchItem {
+		return batchItem{migrationReq: migrationReq{Service: service}, DependsOn: dependsOn}
+	}
+	tests := []struct {
+		name    string
+		req     batchMigrationReq
+		want    [][]int
+		wantErr bool
+	}{
+		{
+			name: "sequential by default",
+			req:  batchMigrationReq{Items: []batchItem{item("a"), item("b"), item("c")}},
+			want: [][]int{nil, {0}, {1}},
+		},
+		{
+			name: "parallel has no dependencies",
+			req:  batchMigrationReq{Order: "parallel", Items: []batchItem{item("a"), item("b")}},
+			want: [][]int{nil, nil},
+		},
+		{
+			name: "dependency order",
+			req:  batchMigrationReq{Order: "dependency", Items: []batchItem{item("a", "c"), item("b"), item("c", "b")}},
+			want: [][]int{{2}, nil, {1}},
+		},
+		{
+			name:    "dependency outside the batch",
+			req:     batchMigrationReq{Order: "dependency", Items: []batchItem{item("a", "x")}},
+			wantErr: true,
+		},
+		{
+			name:    "dependency cycle",
+			req:     batchMigrationReq{Order: "dependency", Items: []batchItem{item("a", "b"), item("b", "a")}},
+			wantErr: true,
+		},
+		{
+			name:    "service twice",
+			req:     batchMigrationReq{Order: "parallel", Items: []batchItem{item("a"), item("a")}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown order",
+			req:     batchMigrationReq{Order: "random", Items: []batchItem{item("a")}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := batchDeps(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchHandlerRejectsBeforeMigrating(t *testing.T) {
+	ctls := withCluster(t, []string{"w1", "w2"}, "a", "b")
+	runOn(t, "w1", "a")
+	runOn(t, "w1", "b")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/migrations/batch", batchMigrationHandler)
+
+	tests := []struct {
+		name  string
+		items []migrationReq
+	}{
+		{"same source and destination", []migrationReq{{Service: "a", Src: "w1", Dest: "w2"}, {Service: "b", Src: "w1", Dest: "w1"}}},
+		{"service twice", []migrationReq{{Service: "a", Src: "w1", Dest: "w2"}, {Service: "a", Src: "w1", Dest: "w2"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := batchMigrationReq{OnFailure: "continue"}
+			for _, m := range tt.items {
+				req.Items = append(req.Items, batchItem{migrationReq: m})
+			}
+			body, _ := json.Marshal(req)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/migrations/batch", bytes.NewReader(body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400: %s", w.Code, w.Body.String())
+			}
+			if ctls["w1"].called("checkpoint a") || ctls["w2"].called("start") {
+				t.Errorf("a migration ran before the batch was rejected")
+			}
+		})
+	}
+}
+
+// prepareBatch fills in the items like the handler does
+func prepareBatch(t *testing.T, req batchMigrationReq) [][]int {
+	t.Helper()
+	for i := range req.Items {
+		if _, err := prepareMigration(&req.Items[i].migrationReq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deps, err := batchDeps(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deps
+}
+
+func TestBatchRollback(t *testing.T) {
+	tests := []struct {
+		name string
+		a    migrationReq
+		// status of a on w1 and w2 once rolled back
+		srcStatus  string
+		destStatus string
+	}{
+		{
+			name:       "stopped source is migrated back",
+			a:          migrationReq{Service: "a", Src: "w1", Dest: "w2", MigrateBody: MigrateBody{Stop: true}},
+			srcStatus:  "running",
+			destStatus: "exited",
+		},
+		{
+			name:       "running source is kept and dest removed",
+			a:          migrationReq{Service: "a", Src: "w1", Dest: "w2", MigrateBody: MigrateBody{Copt: CheckpointOptions{LeaveRun: true}}},
+			srcStatus:  "running",
+			destStatus: "",
+		},
+		{
+			name:       "checkpointed source without stop is migrated back",
+			a:          migrationReq{Service: "a", Src: "w1", Dest: "w2"},
+			srcStatus:  "running",
+			destStatus: "exited",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctls := withCluster(t, []string{"w1", "w2", "w3"}, "a", "b")
+			runOn(t, "w1", "a")
+			runOn(t, "w1", "b")
+			ctls["w3"].failOn("run", http.StatusInternalServerError)
+
+			req := batchMigrationReq{OnFailure: "rollback", Items: []batchItem{
+				{migrationReq: tt.a},
+				{migrationReq: migrationReq{Service: "b", Src: "w1", Dest: "w3", MigrateBody: MigrateBody{Stop: true}}},
+			}}
+			deps := prepareBatch(t, req)
+			results := runBatch(context.Background(), req, deps)
+
+			if results[0].Status != "rolled_back" || results[1].Status != "failed" {
+				t.Fatalf("results = %+v, want a rolled_back and b failed", results)
+			}
+			if got := statusOn(t, "w1", "a"); got != tt.srcStatus {
+				t.Errorf("a on w1 is %q, want %q", got, tt.srcStatus)
+			}
+			if got := statusOn(t, "w2", "a"); got != tt.destStatus {
+				t.Errorf("a on w2 is %q, want %q", got, tt.destStatus)
+			}
+			if got := statusOn(t, "w1", "b"); got != "running" {
+				t.Errorf("b on w1 is %q, want it restored", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Circuit breaker states, shown as Worker.Breaker
+const (
+	breakerClosed   = "closed"    //calls go through
+	breakerOpen     = "open"      //calls fail at once with errWorkerUnavailable
+	breakerHalfOpen = "half_open" //one trial call goes through, it closes or reopens the breaker
+)
+
+var breakerThreshold = 3               //consecutive failures opening the breaker
+var breakerCooldown = 30 * time.Second //half-open without heartbeat, for controllers not sending any
+
+var errWorkerUnavailable = errors.New("worker unavailable")
+
+// circuitBreaker of the controller at one address
+type circuitBreaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool //the half-open trial call is in flight
+}
+
+var breakerMu sync.Mutex
+var breakers = make(map[string]*circuitBreaker)
+
+var breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cm_manager_worker_breaker_transitions_total",
+	Help: "Circuit breaker state changes per controller address and new state.",
+}, []string{"addr", "state"})
+
+// controllerHost returns the host:port the worker's controller is called on
+func controllerHost(worker Worker) string {
+	u, err := url.Parse(controllerURL(worker, ""))
+	if err != nil {
+		return worker.IpAddrPort
+	}
+	return u.Host
+}
+
+// breakerAllow tells whether a call to host may go through. It returns the
+// new state when the call half-opens the breaker.
+func breakerAllow(host string) (bool, string, *circuitBreaker) {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		b = &circuitBreaker{state: breakerClosed}
+		breakers[host] = b
+	}
+	changed := ""
+	if b.state == breakerOpen && time.Since(b.openedAt) >= breakerCooldown {
+		b.state = breakerHalfOpen
+		changed = breakerHalfOpen
+	}
+	switch b.state {
+	case breakerOpen:
+		return false, changed, b
+	case breakerHalfOpen:
+		if b.trial {
+			return false, changed, b
+		}
+		b.trial = true
+	}
+	return true, changed, b
+}
+
+// breakerRecord counts the outcome of a call to host and returns the new
+// state when it changed
+func breakerRecord(host string, failed bool) string {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	b := breakers[host]
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.state = breakerClosed
+			return breakerClosed
+		}
+		return ""
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= breakerThreshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		return breakerOpen
+	}
+	return ""
+}
+
+// breakerHeartbeat half-opens the breaker of a worker that sent a heartbeat,
+// the next call tells whether its controller answers again
+func breakerHeartbeat(workerId string) {
+	worker, _ := getWorker(workerId)
+	host := controllerHost(worker)
+	breakerMu.Lock()
+	b, ok := breakers[host]
+	changed := ok && b.state == breakerOpen
+	if changed {
+		b.state = breakerHalfOpen
+	}
+	breakerMu.Unlock()
+	if changed {
+		breakerChanged(host, breakerHalfOpen)
+	}
+}
+
+// breakerChanged shows the new state on the workers of the controller at host
+func breakerChanged(host string, state string) {
+	breakerTransitions.WithLabelValues(host, state).Inc()
+	stateMu.Lock()
+	ids := []string{}
+	for id, w := range workers {
+		if controllerHost(w) == host {
+			ids = append(ids, id)
+		}
+	}
+	stateMu.Unlock()
+	for _, id := range ids {
+		setWorkerBreaker(id, state)
+	}
+	logger.Info("Worker circuit breaker", zap.String("addr", host), zap.Strings("workers", ids), zap.String("state", state))
+}
+
+// breakerFailure tells whether a call shows the controller unreachable or
+// unable to serve. Errors of the controller's own operation do not count.
+func breakerFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// breakerTransport fails calls to a controller whose breaker is open
+type breakerTransport struct {
+	base http.RoundTripper
+}
+
+func (t breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	ok, changed, b := breakerAllow(host)
+	if changed != "" {
+		breakerChanged(host, changed)
+	}
+	if !ok {
+		breakerMu.Lock()
+		err := fmt.Errorf("%w: circuit open for %s after %d consecutive failures", errWorkerUnavailable, host, b.failures)
+		breakerMu.Unlock()
+		loggerFrom(req.Context()).Debug("Controller call short-circuited", zap.String("url", req.URL.String()))
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		// Abandoned by the caller, says nothing about the controller
+		breakerMu.Lock()
+		b.trial = false
+		breakerMu.Unlock()
+		return resp, err
+	}
+	if changed := breakerRecord(host, breakerFailure(resp, err)); changed != "" {
+		breakerChanged(host, changed)
+	}
+	return resp, err
+}
+
+func breakControllerClient() {
+	base := controllerClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	controllerClient.Transport = breakerTransport{base: base}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
 	"go.uber.org/zap"
@@ -13,22 +16,63 @@ import (
 
 var lastChkRun = make(map[string]bool)
 
-func checkpointService(worker_id string, service Service, option CheckpointOptions) (string, error) {
+// Images of pre-copy rounds are named after the final one with this suffix,
+// they are not checkpoints of their own
+var preCopyImageRe = regexp.MustCompile(`_pre[0-9]+$`)
+
+// checkpointService checkpoints the service and records the image in the
+// catalog, the service's config, the metrics and the webhooks
+func checkpointService(ctx context.Context, worker_id string, service Service, option CheckpointOptions) (string, error) {
+	logger := loggerFrom(ctx)
+	image, err := dumpService(ctx, worker_id, service, option)
+	if err != nil {
+		observeCheckpoint(service.Name, "", err)
+		publishEvent("checkpoint.failure", checkpointEvent{Worker: worker_id, Service: service.Name, Error: err.Error()})
+		return "", err
+	}
+	option.ImgUrl = image
+	stateMu.Lock()
+	config := serviceConfigs[service.Name]
+	config.ChkOpt = option
+	serviceConfigs[service.Name] = config
+	lastChkRun[service.Name] = option.LeaveRun
+	stateMu.Unlock()
+	updateWorkerServices(ctx, worker_id, service.Name)
+	logger.Info("Checkpoint successfully the image name", zap.String("image", image))
+	addCheckpointFile(service.Name, image)
+	observeCheckpoint(service.Name, image, nil)
+	publishEvent("checkpoint.success", checkpointEvent{Worker: worker_id, Service: service.Name, Image: image})
+	return image, nil
+}
+
+// dumpService asks the controller for a checkpoint and returns the image,
+// nothing is recorded. Pre-copy rounds use it directly, their images only
+// feed the final checkpoint of the migration.
+func dumpService(ctx context.Context, worker_id string, service Service, option CheckpointOptions) (string, error) {
+	logger := loggerFrom(ctx)
 	logger.Debug("Checkpointing service", zap.String("service", service.Name))
-	url := "http://" + workers[worker_id].IpAddrPort + "/cm_controller/v1/checkpoint/" + service.Name
+	url := controllerURL(workers[worker_id], "/checkpoint/"+containerName(service.Name))
 	currentTime := time.Now().UTC()
 
 	// Format the time in ISO 8601 format
 	iso8601Format := "2006-01-02T15:04:05Z07:00"
 	iso8601Time := currentTime.Format(iso8601Format)
-	option.ImgUrl = "file:/checkpointfs/" + service.Name + "/" + service.Name + "_" + worker_id + "_" + iso8601Time
+	owner := service.Name
+	if option.imageOf != "" {
+		owner = option.imageOf
+	}
+	option.ImgUrl = "file:/checkpointfs/" + checkpointDir(owner) + "/" + containerName(owner) + "_" + worker_id + "_" + iso8601Time
+	if option.preCopyRound > 0 {
+		// Rounds of a pre-copy chain usually fall within the same second
+		option.ImgUrl += "_pre" + strconv.Itoa(option.preCopyRound)
+	}
 	requestBody, err := json.Marshal(option)
 	if err != nil {
 		logger.Error("Error marshalling JSON", zap.Error(err))
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		logger.Error("Error creating request", zap.Error(err))
 		return "", err
@@ -36,7 +80,7 @@ func checkpointService(worker_id string, service Service, option CheckpointOptio
 
 	req.Close = true
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client := controllerClient
 	logger.Debug("Sending request to controller", zap.String("url", url))
 	resp, err := client.Do(req)
 	if err != nil {
@@ -51,16 +95,9 @@ func checkpointService(worker_id string, service Service, option CheckpointOptio
 		return "", err
 	}
 	if resp.StatusCode == 200 {
-		config := serviceConfigs[service.Name]
-		config.ChkOpt = option
-		serviceConfigs[service.Name] = config
-		updateWorkerServices(worker_id, service.Name)
-		logger.Info("Checkpoint successfully the image name", zap.String("image", option.ImgUrl))
-		addCheckpointFile(service.Name, option.ImgUrl)
-		lastChkRun[service.Name] = option.LeaveRun
 		return option.ImgUrl, nil
 	} else {
-		updateWorkerServices(worker_id, service.Name)
+		updateWorkerServices(ctx, worker_id, service.Name)
 		logger.Error("Checkpoint service fail at worker", zap.String("worker", worker_id), zap.String("service", service.Name), zap.Int("status_code", resp.StatusCode), zap.String("body", string(body)))
 		return "", fmt.Errorf("checkpoint service fail at worker with response code %d", resp.StatusCode)
 
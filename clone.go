@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// A clone is a copy of a running service restored from a leave_running
+// checkpoint, the source keeps running. Each clone is registered as a new
+// service, by default an instance of the source's service named after its
+// worker, with the source's configuration.
+
+type cloneTarget struct {
+	Worker string `json:"worker"`
+	Name   string `json:"name,omitempty"` //new service or service/instance, defaults to <service>/<worker>
+}
+
+type cloneReq struct {
+	Src     string            `json:"src,omitempty"` //worker to checkpoint, defaults to the one running the service
+	Targets []cloneTarget     `json:"targets"`
+	Copt    CheckpointOptions `json:"copt"` //leave_running is always set
+	Ropt    RunOptions        `json:"ropt"` //image_url is set to the checkpoint
+	Sopt    StartOptions      `json:"sopt"` //defaults to the options the source was started with
+}
+
+type cloneResult struct {
+	Service string `json:"service"`
+	Worker  string `json:"worker"`
+	Status  string `json:"status"` //success or failed
+	Error   string `json:"error,omitempty"`
+}
+
+type cloneResp struct {
+	Service string        `json:"service"`
+	Src     string        `json:"src"`
+	Image   string        `json:"image,omitempty"` //checkpoint of the source, the first clone's image, the others restore links of it
+	Clones  []cloneResult `json:"clones"`
+	Retries []retryRecord `json:"retries,omitempty"`
+}
+
+// prepareClone checks the source and targets of a clone of name and fills in
+// the source worker and clone names left out. Only the workers listing the
+// service are asked for its status. On failure it returns the status to
+// answer with.
+func prepareClone(ctx context.Context, name string, req *cloneReq) (int, error) {
+	if _, ok := getService(name); !ok {
+		return http.StatusNotFound, errors.New("Service not found")
+	}
+	if len(req.Targets) == 0 {
+		return http.StatusBadRequest, errors.New("No target workers given")
+	}
+	if req.Src == "" {
+		for _, id := range workerIds() {
+			w, _ := getWorker(id)
+			if isIn, _ := isServiceInWorker(w, name); !isIn {
+				continue
+			}
+			updateWorkerServices(ctx, id, name)
+			w, _ = getWorker(id)
+			if _, stat := isServiceInWorker(w, name); stat == "running" {
+				if req.Src != "" {
+					return http.StatusBadRequest, errors.New("Service runs on several workers, give src")
+				}
+				req.Src = id
+			}
+		}
+		if req.Src == "" {
+			return http.StatusConflict, errors.New("Service is not running on any worker")
+		}
+	} else {
+		if _, ok := getWorker(req.Src); !ok {
+			return http.StatusNotFound, errors.New("Worker not found: " + req.Src)
+		}
+		updateWorkerServices(ctx, req.Src, name)
+		w, _ := getWorker(req.Src)
+		if _, stat := isServiceInWorker(w, name); stat != "running" {
+			return http.StatusConflict, errors.New("Service is not running on " + req.Src)
+		}
+	}
+
+	service, _ := splitInstance(name)
+	seen := make(map[string]bool)
+	for i, t := range req.Targets {
+		if _, ok := getWorker(t.Worker); !ok {
+			return http.StatusNotFound, errors.New("Worker not found: " + t.Worker)
+		}
+		if t.Name == "" {
+			req.Targets[i].Name = service + instanceSep + t.Worker
+		}
+		clone := req.Targets[i].Name
+		if seen[clone] {
+			return http.StatusBadRequest, errors.New("Clone name given twice: " + clone)
+		}
+		seen[clone] = true
+		if err := checkNewService(clone); err != nil {
+			return http.StatusBadRequest, errors.New(clone + ": " + err.Error())
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// cloneLocks returns the services a clone locks, the source and the clones
+// whose names are taken, and the workers of each
+func cloneLocks(name string, req cloneReq) ([]string, func(string) []string) {
+	names := []string{name}
+	lockWorkers := map[string][]string{name: {req.Src}}
+	for _, t := range req.Targets {
+		names = append(names, t.Name)
+		lockWorkers[t.Name] = []string{t.Worker}
+	}
+	return names, func(n string) []string { return lockWorkers[n] }
+}
+
+// cloneService checkpoints name on req.Src, leaving it running, and restores
+// the image on each target under its clone name. The image is named after the
+// first clone and the others get hard links of it under their own names, so
+// each clone owns its image like one of its own checkpoints: it is recorded on
+// the clone, not on the source, and a scan of the checkpoints gives it back to
+// the clone. A failed clone is removed and unregistered, the others go on.
+func cloneService(ctx context.Context, name string, req cloneReq) (cloneResp, int) {
+	logger := loggerFrom(ctx)
+	resp := cloneResp{Service: name, Src: req.Src, Clones: []cloneResult{}}
+	svc, _ := getService(name)
+
+	copt := req.Copt
+	copt.LeaveRun = true
+	first := req.Targets[0].Name
+	copt.imageOf = first
+	err := mkChkDir(checkpointDir(first))
+	var image string
+	if err == nil {
+		image, err = dumpService(ctx, req.Src, svc, copt)
+	}
+	copt.imageOf = ""
+	if err != nil {
+		observeCheckpoint(name, "", err)
+		publishEvent("checkpoint.failure", checkpointEvent{Worker: req.Src, Service: name, Error: err.Error()})
+		logger.Error("Error checkpointing the service to clone", zap.String("service", name), zap.Error(err))
+		for _, t := range req.Targets {
+			resp.Clones = append(resp.Clones, cloneResult{Service: t.Name, Worker: t.Worker, Status: "failed", Error: "checkpoint failed: " + err.Error()})
+		}
+		return resp, http.StatusInternalServerError
+	}
+	// The controller now reports the source checkpointed, it keeps running
+	stateMu.Lock()
+	lastChkRun[name] = true
+	stateMu.Unlock()
+	observeCheckpoint(name, image, nil)
+	publishEvent("checkpoint.success", checkpointEvent{Worker: req.Src, Service: name, Image: image})
+	resp.Image = image
+
+	sopt := req.Sopt
+	if reflect.DeepEqual(sopt, StartOptions{}) {
+		sopt = lastStartOptions(req.Src, name)
+		if sopt.Image == "" {
+			stateMu.Lock()
+			sopt = serviceConfigs[name].StartOpt
+			stateMu.Unlock()
+		}
+	}
+	if sopt.Image == "" {
+		sopt.Image = svc.Image
+	}
+	ropt := req.Ropt
+
+	status := http.StatusOK
+	for _, t := range req.Targets {
+		res := cloneResult{Service: t.Name, Worker: t.Worker, Status: "success"}
+		img := image
+		var err error
+		if t.Name != first {
+			img, err = linkCloneImage(image, first, t.Name)
+		}
+		if err != nil {
+			logger.Error("Error linking the image of a clone", zap.String("service", name), zap.String("clone", t.Name), zap.String("image", image), zap.Error(err))
+			res.Status = "failed"
+			res.Error = "image link failed: " + err.Error()
+			status = http.StatusMultiStatus
+		} else if err := restoreClone(ctx, svc, t, sopt, ropt, copt, img); err != nil {
+			logger.Error("Error cloning service", zap.String("service", name), zap.String("clone", t.Name), zap.String("worker", t.Worker), zap.Error(err))
+			res.Status = "failed"
+			res.Error = err.Error()
+			status = http.StatusMultiStatus
+		} else {
+			logger.Info("Service cloned", zap.String("service", name), zap.String("clone", t.Name), zap.String("worker", t.Worker), zap.String("image", img))
+		}
+		resp.Clones = append(resp.Clones, res)
+	}
+	return resp, status
+}
+
+// linkCloneImage gives clone its own image, hard links of the files of the
+// image named after first under the clone's directory and name
+func linkCloneImage(image string, first string, clone string) (string, error) {
+	linked := "file:/checkpointfs/" + checkpointDir(clone) + "/" + containerName(clone) + strings.TrimPrefix(path.Base(image), containerName(first))
+	src, dst := checkpointLocalPath(image), checkpointLocalPath(linked)
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0775)
+		}
+		return os.Link(p, filepath.Join(dst, rel))
+	})
+	if err != nil {
+		os.RemoveAll(dst)
+		return "", err
+	}
+	return linked, nil
+}
+
+// restoreClone registers the clone with the source's configuration and the
+// image it is restored from as its checkpoint, then starts it on its worker
+func restoreClone(ctx context.Context, src Service, t cloneTarget, sopt StartOptions, ropt RunOptions, copt CheckpointOptions, image string) error {
+	if _, err := addService(t.Name, src.Image); err != nil {
+		return err
+	}
+	copt.ImgUrl = image
+	ropt.ImageURL = image
+	stateMu.Lock()
+	config := serviceConfigs[src.Name]
+	config.Standby = StandbyConfig{}
+	config.ChkOpt = copt
+	serviceConfigs[t.Name] = config
+	lastChkRun[t.Name] = copt.LeaveRun
+	stateMu.Unlock()
+	addCheckpointFile(t.Name, copt.ImgUrl)
+
+	worker, _ := getWorker(t.Worker)
+	clone, _ := getService(t.Name)
+	sopt.ContainerName = t.Name
+	if err := startServiceContainer(ctx, worker, sopt); err != nil {
+		unregisterClone(t.Name)
+		return errors.New("start failed: " + err.Error())
+	}
+	if err := runService(ctx, worker, clone, ropt); err != nil {
+		if err := removeService(ctx, worker, clone); err != nil {
+			loggerFrom(ctx).Error("Error removing the container of a failed clone", zap.String("clone", t.Name), zap.String("worker", t.Worker), zap.Error(err))
+		}
+		unregisterClone(t.Name)
+		return errors.New("restore failed: " + err.Error())
+	}
+	return nil
+}
+
+// unregisterClone forgets a clone that could not be restored so the request
+// can be retried with the same name
+func unregisterClone(name string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	delete(services, name)
+	delete(serviceConfigs, name)
+	delete(lastChkRun, name)
+	removeInstanceFrom(name)
+}
+
+func cloneServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "post"), zap.String("path", c.Request.URL.Path))
+	name := c.Param("name")
+	var requestBody cloneReq
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		logger.Error("Error decoding JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
+		return
+	}
+	if status, err := prepareClone(c.Request.Context(), name, &requestBody); err != nil {
+		logger.Error("Invalid clone", zap.String("serviceName", name), zap.Error(err))
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	names, workersOf := cloneLocks(name, requestBody)
+	ctx, release, ok := lockForRequest(c, names, "clone", workersOf)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
+	resp, status := cloneService(ctx, name, requestBody)
+	resp.Retries = retries.list()
+
+	logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Any("response", resp), zap.Int("status", status))
+	c.JSON(status, resp)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cm_manager/cmpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPrepareClone(t *testing.T) {
+	tests := []struct {
+		name    string
+		running []string //workers running a
+		req     cloneReq
+		status  int
+		src     string
+		clones  []string
+	}{
+		{
+			name:    "source found",
+			running: []string{"w1"},
+			req:     cloneReq{Targets: []cloneTarget{{Worker: "w2"}, {Worker: "w3", Name: "b"}}},
+			status:  http.StatusOK,
+			src:     "w1",
+			clones:  []string{"a/w2", "b"},
+		},
+		{
+			name:    "runs on several workers",
+			running: []string{"w1", "w2"},
+			req:     cloneReq{Targets: []cloneTarget{{Worker: "w3"}}},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:   "runs nowhere",
+			req:    cloneReq{Targets: []cloneTarget{{Worker: "w3"}}},
+			status: http.StatusConflict,
+		},
+		{
+			name:    "given source not running it",
+			running: []string{"w1"},
+			req:     cloneReq{Src: "w2", Targets: []cloneTarget{{Worker: "w3"}}},
+			status:  http.StatusConflict,
+		},
+		{
+			name:    "no targets",
+			running: []string{"w1"},
+			req:     cloneReq{},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "unknown target worker",
+			running: []string{"w1"},
+			req:     cloneReq{Targets: []cloneTarget{{Worker: "w9"}}},
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "clone name taken",
+			running: []string{"w1"},
+			req:     cloneReq{Targets: []cloneTarget{{Worker: "w2", Name: "a"}}},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "clone name twice",
+			running: []string{"w1"},
+			req:     cloneReq{Targets: []cloneTarget{{Worker: "w2", Name: "b"}, {Worker: "w3", Name: "b"}}},
+			status:  http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctls := withCluster(t, []string{"w1", "w2", "w3"}, "a")
+			for _, id := range tt.running {
+				runOn(t, id, "a")
+			}
+			req := tt.req
+			status, err := prepareClone(context.Background(), "a", &req)
+			if status != tt.status {
+				t.Fatalf("status = %d (%v), want %d", status, err, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if req.Src != tt.src {
+				t.Errorf("src = %q, want %q", req.Src, tt.src)
+			}
+			clones := []string{}
+			for _, target := range req.Targets {
+				clones = append(clones, target.Name)
+			}
+			if !reflect.DeepEqual(clones, tt.clones) {
+				t.Errorf("clones = %v, want %v", clones, tt.clones)
+			}
+			for _, id := range []string{"w2", "w3"} {
+				ctls[id].mu.Lock()
+				queries := ctls[id].queries
+				ctls[id].mu.Unlock()
+				if queries > 0 {
+					t.Errorf("%s, not listing a, was asked for its status", id)
+				}
+			}
+		})
+	}
+}
+
+func TestCloneService(t *testing.T) {
+	ctls := withCluster(t, []string{"w1", "w2", "w3"}, "a")
+	runOn(t, "w1", "a")
+	ctls["w3"].failOn("run", http.StatusInternalServerError)
+	before := serviceConfigs["a"].ChkOpt
+
+	req := cloneReq{Targets: []cloneTarget{{Worker: "w2"}, {Worker: "w3"}}}
+	if _, err := prepareClone(context.Background(), "a", &req); err != nil {
+		t.Fatal(err)
+	}
+	resp, status := cloneService(context.Background(), "a", req)
+	if status != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207: %+v", status, resp)
+	}
+	if resp.Clones[0].Status != "success" || resp.Clones[1].Status != "failed" {
+		t.Errorf("clones = %+v, want a/w2 cloned and a/w3 failed", resp.Clones)
+	}
+
+	if got := services["a/w2"].ChkFiles; !reflect.DeepEqual(got, []string{resp.Image}) {
+		t.Errorf("chk_files of the clone = %v, want %s", got, resp.Image)
+	}
+	if got := serviceConfigs["a/w2"].ChkOpt; got.ImgUrl != resp.Image || !got.LeaveRun || !lastChkRun["a/w2"] {
+		t.Errorf("checkpoint of the clone = %+v, lastChkRun %v, want the clone image", got, lastChkRun["a/w2"])
+	}
+	if got := services["a"].ChkFiles; len(got) != 0 {
+		t.Errorf("chk_files of the source = %v, want none", got)
+	}
+	if got := serviceConfigs["a"].ChkOpt; !reflect.DeepEqual(got, before) {
+		t.Errorf("checkpoint options of the source changed: %+v", got)
+	}
+	if _, ok := services["a/w3"]; ok {
+		t.Errorf("failed clone a/w3 still registered")
+	}
+	if _, ok := lastChkRun["a/w3"]; ok {
+		t.Errorf("failed clone a/w3 left in lastChkRun")
+	}
+
+	for _, tt := range []struct{ worker, service, want string }{
+		{"w1", "a", "running"},
+		{"w2", "a/w2", "running"},
+		{"w3", "a/w3", ""},
+	} {
+		if got := statusOn(t, tt.worker, tt.service); got != tt.want {
+			t.Errorf("%s on %s is %q, want %q", tt.service, tt.worker, got, tt.want)
+		}
+	}
+}
+
+func TestCloneRequiresAdmin(t *testing.T) {
+	if grpcRoles["CloneService"] != roleAdmin {
+		t.Errorf("gRPC CloneService needs %v, want admin", grpcRoles["CloneService"])
+	}
+	for _, r := range v2Routes {
+		if r.Path == "/services/:name/actions/clone" && r.Role != roleAdmin {
+			t.Errorf("v2 clone route needs %v, want admin", r.Role)
+		}
+	}
+}
+
+func TestCloneImagesOwnedByClones(t *testing.T) {
+	// Only the images of this test are scanned
+	oldMount := checkpointMount
+	checkpointMount = t.TempDir() + "/"
+	t.Cleanup(func() { checkpointMount = oldMount })
+	withCluster(t, []string{"w1", "w2", "w3"}, "a")
+	runOn(t, "w1", "a")
+
+	req := cloneReq{Targets: []cloneTarget{{Worker: "w2"}, {Worker: "w3", Name: "copy"}}}
+	if _, err := prepareClone(context.Background(), "a", &req); err != nil {
+		t.Fatal(err)
+	}
+	resp, status := cloneService(context.Background(), "a", req)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %+v", status, resp)
+	}
+	images := make(map[string]string)
+	for _, tt := range []struct{ clone, prefix string }{
+		{"a/w2", "file:/checkpointfs/a/a.w2_w1_"},
+		{"copy", "file:/checkpointfs/copy/copy_w1_"},
+	} {
+		chk := services[tt.clone].ChkFiles
+		if len(chk) != 1 || !strings.HasPrefix(chk[0], tt.prefix) {
+			t.Fatalf("chk_files of %s = %v, want one image %s...", tt.clone, chk, tt.prefix)
+		}
+		if got := serviceConfigs[tt.clone].ChkOpt.ImgUrl; got != chk[0] {
+			t.Errorf("%s restored from %s, want its own image %s", tt.clone, got, chk[0])
+		}
+		if _, err := os.Stat(filepath.Join(checkpointLocalPath(chk[0]), "pages-1.img")); err != nil {
+			t.Errorf("image of %s: %v", tt.clone, err)
+		}
+		images[tt.clone] = chk[0]
+	}
+	if resp.Image != images["a/w2"] {
+		t.Errorf("image = %s, want the first clone's %s", resp.Image, images["a/w2"])
+	}
+
+	// A restart finds the images again, each goes back to its clone
+	stateMu.Lock()
+	for name, svc := range services {
+		svc.ChkFiles = []string{}
+		services[name] = svc
+	}
+	stateMu.Unlock()
+	scanCheckpointFiles(0, "")
+	for name, want := range map[string][]string{"a": {}, "a/w2": {images["a/w2"]}, "copy": {images["copy"]}} {
+		if got := services[name].ChkFiles; !reflect.DeepEqual(got, want) {
+			t.Errorf("after a scan chk_files of %s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestGRPCCloneReportsEveryTarget(t *testing.T) {
+	ctls := withCluster(t, []string{"w1", "w2", "w3"}, "a")
+	runOn(t, "w1", "a")
+	ctls["w1"].failOn("checkpoint", http.StatusInternalServerError)
+	client := grpcClient(t)
+
+	_, err := client.CloneService(context.Background(), &cmpb.CloneServiceRequest{
+		Service: "a",
+		Targets: []*cmpb.CloneTarget{{Worker: "w2"}, {Worker: "w3", Name: "b"}},
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("err = %v, want Internal", err)
+	}
+	msg := status.Convert(err).Message()
+	for _, want := range []string{"a/w2 on w2: checkpoint failed", "b on w3: checkpoint failed"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message %q doesn't report %q", msg, want)
+		}
+	}
+}
@@ -0,0 +1,748 @@
+// gRPC API of the manager, served with --grpc-addr. It mirrors the REST
+// operations and shares their implementation, see grpc.go.
+//
+// The Go code in this directory is generated from this file with
+// protoc-gen-go v1.31.0 and protoc-gen-go-grpc v1.3.0:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	       --go-grpc_out=. --go-grpc_opt=paths=source_relative cmpb/cm_manager.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: cmpb/cm_manager.proto
+
+package cmpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Manager_ListWorkers_FullMethodName       = "/cm_manager.v1.Manager/ListWorkers"
+	Manager_GetWorker_FullMethodName         = "/cm_manager.v1.Manager/GetWorker"
+	Manager_AddWorker_FullMethodName         = "/cm_manager.v1.Manager/AddWorker"
+	Manager_DeleteWorker_FullMethodName      = "/cm_manager.v1.Manager/DeleteWorker"
+	Manager_ListServices_FullMethodName      = "/cm_manager.v1.Manager/ListServices"
+	Manager_GetService_FullMethodName        = "/cm_manager.v1.Manager/GetService"
+	Manager_GetServiceConfig_FullMethodName  = "/cm_manager.v1.Manager/GetServiceConfig"
+	Manager_AddService_FullMethodName        = "/cm_manager.v1.Manager/AddService"
+	Manager_DeleteService_FullMethodName     = "/cm_manager.v1.Manager/DeleteService"
+	Manager_StartService_FullMethodName      = "/cm_manager.v1.Manager/StartService"
+	Manager_RunService_FullMethodName        = "/cm_manager.v1.Manager/RunService"
+	Manager_CheckpointService_FullMethodName = "/cm_manager.v1.Manager/CheckpointService"
+	Manager_MigrateService_FullMethodName    = "/cm_manager.v1.Manager/MigrateService"
+	Manager_CloneService_FullMethodName      = "/cm_manager.v1.Manager/CloneService"
+	Manager_StopService_FullMethodName       = "/cm_manager.v1.Manager/StopService"
+	Manager_RemoveService_FullMethodName     = "/cm_manager.v1.Manager/RemoveService"
+	Manager_Watch_FullMethodName             = "/cm_manager.v1.Manager/Watch"
+)
+
+// ManagerClient is the client API for Manager service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ManagerClient interface {
+	ListWorkers(ctx context.Context, in *ListWorkersRequest, opts ...grpc.CallOption) (*ListWorkersResponse, error)
+	GetWorker(ctx context.Context, in *GetWorkerRequest, opts ...grpc.CallOption) (*Worker, error)
+	AddWorker(ctx context.Context, in *AddWorkerRequest, opts ...grpc.CallOption) (*OperationResponse, error)
+	// DeleteWorker refuses, drains or forces out the services of the worker
+	DeleteWorker(ctx context.Context, in *DeleteWorkerRequest, opts ...grpc.CallOption) (*DeleteWorkerResponse, error)
+	ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error)
+	GetService(ctx context.Context, in *GetServiceRequest, opts ...grpc.CallOption) (*Service, error)
+	GetServiceConfig(ctx context.Context, in *GetServiceRequest, opts ...grpc.CallOption) (*ServiceConfig, error)
+	AddService(ctx context.Context, in *AddServiceRequest, opts ...grpc.CallOption) (*OperationResponse, error)
+	DeleteService(ctx context.Context, in *DeleteServiceRequest, opts ...grpc.CallOption) (*OperationResponse, error)
+	StartService(ctx context.Context, in *StartServiceRequest, opts ...grpc.CallOption) (*OperationResponse, error)
+	RunService(ctx context.Context, in *RunServiceRequest, opts ...grpc.CallOption) (*OperationResponse, error)
+	CheckpointService(ctx context.Context, in *CheckpointServiceRequest, opts ...grpc.CallOption) (*CheckpointServiceResponse, error)
+	MigrateService(ctx context.Context, in *MigrateServiceRequest, opts ...grpc.CallOption) (*MigrateServiceResponse, error)
+	// CloneService restores a leave_running checkpoint of a service on other
+	// workers as new services. Clones that fail are reported in the response.
+	CloneService(ctx context.Context, in *CloneServiceRequest, opts ...grpc.CallOption) (*CloneServiceResponse, error)
+	StopService(ctx context.Context, in *ServiceOnWorkerRequest, opts ...grpc.CallOption) (*OperationResponse, error)
+	RemoveService(ctx context.Context, in *ServiceOnWorkerRequest, opts ...grpc.CallOption) (*OperationResponse, error)
+	// Watch streams the events also sent to webhooks, worker status changes,
+	// migration outcomes and checkpoint results, until the client cancels
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Manager_WatchClient, error)
+}
+
+type managerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewManagerClient(cc grpc.ClientConnInterface) ManagerClient {
+	return &managerClient{cc}
+}
+
+func (c *managerClient) ListWorkers(ctx context.Context, in *ListWorkersRequest, opts ...grpc.CallOption) (*ListWorkersResponse, error) {
+	out := new(ListWorkersResponse)
+	err := c.cc.Invoke(ctx, Manager_ListWorkers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) GetWorker(ctx context.Context, in *GetWorkerRequest, opts ...grpc.CallOption) (*Worker, error) {
+	out := new(Worker)
+	err := c.cc.Invoke(ctx, Manager_GetWorker_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) AddWorker(ctx context.Context, in *AddWorkerRequest, opts ...grpc.CallOption) (*OperationResponse, error) {
+	out := new(OperationResponse)
+	err := c.cc.Invoke(ctx, Manager_AddWorker_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) DeleteWorker(ctx context.Context, in *DeleteWorkerRequest, opts ...grpc.CallOption) (*DeleteWorkerResponse, error) {
+	out := new(DeleteWorkerResponse)
+	err := c.cc.Invoke(ctx, Manager_DeleteWorker_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error) {
+	out := new(ListServicesResponse)
+	err := c.cc.Invoke(ctx, Manager_ListServices_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) GetService(ctx context.Context, in *GetServiceRequest, opts ...grpc.CallOption) (*Service, error) {
+	out := new(Service)
+	err := c.cc.Invoke(ctx, Manager_GetService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) GetServiceConfig(ctx context.Context, in *GetServiceRequest, opts ...grpc.CallOption) (*ServiceConfig, error) {
+	out := new(ServiceConfig)
+	err := c.cc.Invoke(ctx, Manager_GetServiceConfig_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) AddService(ctx context.Context, in *AddServiceRequest, opts ...grpc.CallOption) (*OperationResponse, error) {
+	out := new(OperationResponse)
+	err := c.cc.Invoke(ctx, Manager_AddService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) DeleteService(ctx context.Context, in *DeleteServiceRequest, opts ...grpc.CallOption) (*OperationResponse, error) {
+	out := new(OperationResponse)
+	err := c.cc.Invoke(ctx, Manager_DeleteService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) StartService(ctx context.Context, in *StartServiceRequest, opts ...grpc.CallOption) (*OperationResponse, error) {
+	out := new(OperationResponse)
+	err := c.cc.Invoke(ctx, Manager_StartService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) RunService(ctx context.Context, in *RunServiceRequest, opts ...grpc.CallOption) (*OperationResponse, error) {
+	out := new(OperationResponse)
+	err := c.cc.Invoke(ctx, Manager_RunService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) CheckpointService(ctx context.Context, in *CheckpointServiceRequest, opts ...grpc.CallOption) (*CheckpointServiceResponse, error) {
+	out := new(CheckpointServiceResponse)
+	err := c.cc.Invoke(ctx, Manager_CheckpointService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) MigrateService(ctx context.Context, in *MigrateServiceRequest, opts ...grpc.CallOption) (*MigrateServiceResponse, error) {
+	out := new(MigrateServiceResponse)
+	err := c.cc.Invoke(ctx, Manager_MigrateService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) CloneService(ctx context.Context, in *CloneServiceRequest, opts ...grpc.CallOption) (*CloneServiceResponse, error) {
+	out := new(CloneServiceResponse)
+	err := c.cc.Invoke(ctx, Manager_CloneService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) StopService(ctx context.Context, in *ServiceOnWorkerRequest, opts ...grpc.CallOption) (*OperationResponse, error) {
+	out := new(OperationResponse)
+	err := c.cc.Invoke(ctx, Manager_StopService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) RemoveService(ctx context.Context, in *ServiceOnWorkerRequest, opts ...grpc.CallOption) (*OperationResponse, error) {
+	out := new(OperationResponse)
+	err := c.cc.Invoke(ctx, Manager_RemoveService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *managerClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Manager_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Manager_ServiceDesc.Streams[0], Manager_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &managerWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Manager_WatchClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type managerWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *managerWatchClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ManagerServer is the server API for Manager service.
+// All implementations must embed UnimplementedManagerServer
+// for forward compatibility
+type ManagerServer interface {
+	ListWorkers(context.Context, *ListWorkersRequest) (*ListWorkersResponse, error)
+	GetWorker(context.Context, *GetWorkerRequest) (*Worker, error)
+	AddWorker(context.Context, *AddWorkerRequest) (*OperationResponse, error)
+	// DeleteWorker refuses, drains or forces out the services of the worker
+	DeleteWorker(context.Context, *DeleteWorkerRequest) (*DeleteWorkerResponse, error)
+	ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error)
+	GetService(context.Context, *GetServiceRequest) (*Service, error)
+	GetServiceConfig(context.Context, *GetServiceRequest) (*ServiceConfig, error)
+	AddService(context.Context, *AddServiceRequest) (*OperationResponse, error)
+	DeleteService(context.Context, *DeleteServiceRequest) (*OperationResponse, error)
+	StartService(context.Context, *StartServiceRequest) (*OperationResponse, error)
+	RunService(context.Context, *RunServiceRequest) (*OperationResponse, error)
+	CheckpointService(context.Context, *CheckpointServiceRequest) (*CheckpointServiceResponse, error)
+	MigrateService(context.Context, *MigrateServiceRequest) (*MigrateServiceResponse, error)
+	// CloneService restores a leave_running checkpoint of a service on other
+	// workers as new services. Clones that fail are reported in the response.
+	CloneService(context.Context, *CloneServiceRequest) (*CloneServiceResponse, error)
+	StopService(context.Context, *ServiceOnWorkerRequest) (*OperationResponse, error)
+	RemoveService(context.Context, *ServiceOnWorkerRequest) (*OperationResponse, error)
+	// Watch streams the events also sent to webhooks, worker status changes,
+	// migration outcomes and checkpoint results, until the client cancels
+	Watch(*WatchRequest, Manager_WatchServer) error
+	mustEmbedUnimplementedManagerServer()
+}
+
+// UnimplementedManagerServer must be embedded to have forward compatible implementations.
+type UnimplementedManagerServer struct {
+}
+
+func (UnimplementedManagerServer) ListWorkers(context.Context, *ListWorkersRequest) (*ListWorkersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListWorkers not implemented")
+}
+func (UnimplementedManagerServer) GetWorker(context.Context, *GetWorkerRequest) (*Worker, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetWorker not implemented")
+}
+func (UnimplementedManagerServer) AddWorker(context.Context, *AddWorkerRequest) (*OperationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddWorker not implemented")
+}
+func (UnimplementedManagerServer) DeleteWorker(context.Context, *DeleteWorkerRequest) (*DeleteWorkerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteWorker not implemented")
+}
+func (UnimplementedManagerServer) ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListServices not implemented")
+}
+func (UnimplementedManagerServer) GetService(context.Context, *GetServiceRequest) (*Service, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetService not implemented")
+}
+func (UnimplementedManagerServer) GetServiceConfig(context.Context, *GetServiceRequest) (*ServiceConfig, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetServiceConfig not implemented")
+}
+func (UnimplementedManagerServer) AddService(context.Context, *AddServiceRequest) (*OperationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddService not implemented")
+}
+func (UnimplementedManagerServer) DeleteService(context.Context, *DeleteServiceRequest) (*OperationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteService not implemented")
+}
+func (UnimplementedManagerServer) StartService(context.Context, *StartServiceRequest) (*OperationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StartService not implemented")
+}
+func (UnimplementedManagerServer) RunService(context.Context, *RunServiceRequest) (*OperationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RunService not implemented")
+}
+func (UnimplementedManagerServer) CheckpointService(context.Context, *CheckpointServiceRequest) (*CheckpointServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckpointService not implemented")
+}
+func (UnimplementedManagerServer) MigrateService(context.Context, *MigrateServiceRequest) (*MigrateServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MigrateService not implemented")
+}
+func (UnimplementedManagerServer) CloneService(context.Context, *CloneServiceRequest) (*CloneServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CloneService not implemented")
+}
+func (UnimplementedManagerServer) StopService(context.Context, *ServiceOnWorkerRequest) (*OperationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StopService not implemented")
+}
+func (UnimplementedManagerServer) RemoveService(context.Context, *ServiceOnWorkerRequest) (*OperationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveService not implemented")
+}
+func (UnimplementedManagerServer) Watch(*WatchRequest, Manager_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedManagerServer) mustEmbedUnimplementedManagerServer() {}
+
+// UnsafeManagerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ManagerServer will
+// result in compilation errors.
+type UnsafeManagerServer interface {
+	mustEmbedUnimplementedManagerServer()
+}
+
+func RegisterManagerServer(s grpc.ServiceRegistrar, srv ManagerServer) {
+	s.RegisterService(&Manager_ServiceDesc, srv)
+}
+
+func _Manager_ListWorkers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListWorkersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).ListWorkers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_ListWorkers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).ListWorkers(ctx, req.(*ListWorkersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_GetWorker_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetWorkerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).GetWorker(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_GetWorker_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).GetWorker(ctx, req.(*GetWorkerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_AddWorker_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddWorkerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).AddWorker(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_AddWorker_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).AddWorker(ctx, req.(*AddWorkerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_DeleteWorker_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteWorkerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).DeleteWorker(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_DeleteWorker_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).DeleteWorker(ctx, req.(*DeleteWorkerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_ListServices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListServicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).ListServices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_ListServices_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).ListServices(ctx, req.(*ListServicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_GetService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).GetService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_GetService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).GetService(ctx, req.(*GetServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_GetServiceConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).GetServiceConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_GetServiceConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).GetServiceConfig(ctx, req.(*GetServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_AddService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).AddService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_AddService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).AddService(ctx, req.(*AddServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_DeleteService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).DeleteService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_DeleteService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).DeleteService(ctx, req.(*DeleteServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_StartService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StartServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).StartService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_StartService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).StartService(ctx, req.(*StartServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_RunService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RunServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).RunService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_RunService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).RunService(ctx, req.(*RunServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_CheckpointService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckpointServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).CheckpointService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_CheckpointService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).CheckpointService(ctx, req.(*CheckpointServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_MigrateService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MigrateServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).MigrateService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_MigrateService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).MigrateService(ctx, req.(*MigrateServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_CloneService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CloneServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).CloneService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_CloneService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).CloneService(ctx, req.(*CloneServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_StopService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ServiceOnWorkerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).StopService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_StopService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).StopService(ctx, req.(*ServiceOnWorkerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_RemoveService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ServiceOnWorkerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ManagerServer).RemoveService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Manager_RemoveService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ManagerServer).RemoveService(ctx, req.(*ServiceOnWorkerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Manager_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ManagerServer).Watch(m, &managerWatchServer{stream})
+}
+
+type Manager_WatchServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type managerWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *managerWatchServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Manager_ServiceDesc is the grpc.ServiceDesc for Manager service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Manager_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cm_manager.v1.Manager",
+	HandlerType: (*ManagerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListWorkers",
+			Handler:    _Manager_ListWorkers_Handler,
+		},
+		{
+			MethodName: "GetWorker",
+			Handler:    _Manager_GetWorker_Handler,
+		},
+		{
+			MethodName: "AddWorker",
+			Handler:    _Manager_AddWorker_Handler,
+		},
+		{
+			MethodName: "DeleteWorker",
+			Handler:    _Manager_DeleteWorker_Handler,
+		},
+		{
+			MethodName: "ListServices",
+			Handler:    _Manager_ListServices_Handler,
+		},
+		{
+			MethodName: "GetService",
+			Handler:    _Manager_GetService_Handler,
+		},
+		{
+			MethodName: "GetServiceConfig",
+			Handler:    _Manager_GetServiceConfig_Handler,
+		},
+		{
+			MethodName: "AddService",
+			Handler:    _Manager_AddService_Handler,
+		},
+		{
+			MethodName: "DeleteService",
+			Handler:    _Manager_DeleteService_Handler,
+		},
+		{
+			MethodName: "StartService",
+			Handler:    _Manager_StartService_Handler,
+		},
+		{
+			MethodName: "RunService",
+			Handler:    _Manager_RunService_Handler,
+		},
+		{
+			MethodName: "CheckpointService",
+			Handler:    _Manager_CheckpointService_Handler,
+		},
+		{
+			MethodName: "MigrateService",
+			Handler:    _Manager_MigrateService_Handler,
+		},
+		{
+			MethodName: "CloneService",
+			Handler:    _Manager_CloneService_Handler,
+		},
+		{
+			MethodName: "StopService",
+			Handler:    _Manager_StopService_Handler,
+		},
+		{
+			MethodName: "RemoveService",
+			Handler:    _Manager_RemoveService_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Manager_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cmpb/cm_manager.proto",
+}
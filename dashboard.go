@@ -0,0 +1,33 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// The dashboard is a static page calling the v2 API from the browser, with
+// the token the user enters. Its files need no authentication, the data does.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+var dashboardEnabled = true
+
+func registerDashboard(router *gin.Engine) {
+	if !dashboardEnabled {
+		return
+	}
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		logger.Error("Error loading dashboard", zap.Error(err))
+		return
+	}
+	router.StaticFS("/dashboard", http.FS(files))
+	router.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/dashboard/")
+	})
+}
@@ -0,0 +1,251 @@
+"use strict";
+
+// Dashboard of the manager, everything goes through the v2 API
+const api = "/cm_manager/v2";
+const refreshInterval = 5000;
+
+let token = localStorage.getItem("cm_token") || "";
+let workers = [];
+const expanded = new Set(); // services whose checkpoint list is shown
+const checkpoints = {};     // service -> [{image, size}]
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k.startsWith("on")) {
+      e.addEventListener(k.slice(2), v);
+    } else if (v !== undefined && v !== null && v !== false) {
+      e.setAttribute(k, v === true ? "" : v);
+    }
+  }
+  for (const c of children) {
+    if (c === undefined || c === null) continue;
+    e.append(c instanceof Node ? c : String(c));
+  }
+  return e;
+}
+
+function badge(value) {
+  return el("span", { class: "badge " + (value || "") }, value || "-");
+}
+
+function since(t) {
+  if (!t || t.startsWith("0001")) return "-";
+  const s = Math.round((Date.now() - new Date(t)) / 1000);
+  if (s < 60) return s + "s ago";
+  if (s < 3600) return Math.floor(s / 60) + "m ago";
+  if (s < 86400) return Math.floor(s / 3600) + "h ago";
+  return new Date(t).toLocaleString();
+}
+
+function bytes(n) {
+  if (n < 0) return "unknown size";
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function seconds(v) {
+  return v ? v.toFixed(2) + "s" : "-";
+}
+
+async function call(method, path, body) {
+  const headers = { "Content-Type": "application/json" };
+  if (token) headers["Authorization"] = "Bearer " + token;
+  const resp = await fetch(api + path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  let data = null;
+  try {
+    data = await resp.json();
+  } catch (e) {
+    // 204 and errors without a body
+  }
+  if (!resp.ok && resp.status !== 207) {
+    let msg = (data && data.error) || resp.statusText;
+    if (data && data.lock) {
+      msg += ": " + data.lock.operation + " of " + data.lock.service + " since " + since(data.lock.since);
+    }
+    const err = new Error(resp.status + " " + msg);
+    err.status = resp.status;
+    throw err;
+  }
+  return data;
+}
+
+function show(text, ok) {
+  const m = document.getElementById("message");
+  m.textContent = text;
+  m.className = ok ? "ok" : "error";
+  m.hidden = false;
+  clearTimeout(show.timer);
+  if (ok) show.timer = setTimeout(() => (m.hidden = true), 8000);
+}
+
+// act runs an action from a button, disabled until it ends
+async function act(button, what, method, path, body) {
+  button.disabled = true;
+  show(what + "...", true);
+  try {
+    const data = await call(method, path, body);
+    show(what + ": " + ((data && (data.msg || data.state)) || "done"), true);
+  } catch (e) {
+    show(what + " failed: " + e.message, false);
+  } finally {
+    button.disabled = false;
+    refresh();
+  }
+}
+
+function servicePath(worker, service) {
+  return "/workers/" + encodeURIComponent(worker) + "/services/" + encodeURIComponent(service);
+}
+
+function checkpointService(button, worker, service) {
+  const leave = confirm("Leave " + service + " running after the checkpoint?\nOK: leave running, Cancel: stop it");
+  act(button, "Checkpoint " + service + " on " + worker, "POST", servicePath(worker, service) + "/actions/checkpoint", { leave_running: leave });
+}
+
+function stopService(button, worker, service) {
+  if (!confirm("Stop " + service + " on " + worker + "?")) return;
+  act(button, "Stop " + service + " on " + worker, "POST", servicePath(worker, service) + "/actions/stop");
+}
+
+function migrateService(button, worker, service) {
+  const dialog = document.getElementById("migrate");
+  document.getElementById("migrate-service").textContent = service;
+  document.getElementById("migrate-src").textContent = worker;
+  const dest = document.getElementById("migrate-dest");
+  dest.replaceChildren(el("option", { value: "" }, "a worker with a warm standby"));
+  for (const w of workers) {
+    if (w.id !== worker && w.status === "up") dest.append(el("option", { value: w.id }, w.id));
+  }
+  dialog.onclose = () => {
+    if (dialog.returnValue !== "ok") return;
+    act(button, "Migrate " + service + " from " + worker, "POST", "/migrations", {
+      service,
+      src: worker,
+      dest: dest.value,
+      copt: { leave_running: document.getElementById("migrate-leave").checked },
+      stop: document.getElementById("migrate-stop").checked,
+    });
+  };
+  dialog.showModal();
+}
+
+function renderWorkers() {
+  const body = document.querySelector("#workers tbody");
+  const rows = workers.map((w) => {
+    const services = (w.services || []).map((s) =>
+      el("div", { class: "svc" },
+        el("span", { class: "name" }, s.name), badge(s.status),
+        s.status === "running" ? el("button", { onclick: (e) => checkpointService(e.target, w.id, s.name) }, "Checkpoint") : null,
+        s.status === "running" ? el("button", { onclick: (e) => migrateService(e.target, w.id, s.name) }, "Migrate") : null,
+        s.status !== "exited" && s.status !== "stopped" ? el("button", { onclick: (e) => stopService(e.target, w.id, s.name) }, "Stop") : null,
+      ));
+    const running = (w.services || []).filter((s) => s.status === "running").length;
+    return el("tr", {},
+      el("td", {}, w.id),
+      el("td", {}, w.addr),
+      el("td", {}, badge(w.status)),
+      el("td", { title: w.status_since || "" }, since(w.status_since)),
+      el("td", {}, badge(w.breaker)),
+      el("td", {}, running + (w.capacity ? " / " + w.capacity : "")),
+      el("td", {}, ...(services.length ? services : ["-"])),
+    );
+  });
+  body.replaceChildren(...(rows.length ? rows : [el("tr", {}, el("td", { colspan: 7, class: "empty" }, "No workers"))]));
+}
+
+function renderServices(services) {
+  const body = document.querySelector("#services tbody");
+  const rows = services.map((s) => {
+    const on = workers.filter((w) => (w.services || []).some((ws) => ws.name === s.name && ws.status === "running")).map((w) => w.id);
+    const count = (s.chk_files || []).length;
+    const cell = el("td", {});
+    if (count) {
+      cell.append(el("button", { onclick: () => toggleCheckpoints(s.name) }, (expanded.has(s.name) ? "Hide " : "Show ") + count));
+      if (expanded.has(s.name)) {
+        const list = checkpoints[s.name] || [];
+        cell.append(el("ul", { class: "checkpoints" }, ...list.slice().reverse().map((c) => el("li", {}, c.image + " (" + bytes(c.size) + ")"))));
+      }
+    } else {
+      cell.append("none");
+    }
+    return el("tr", {}, el("td", {}, s.name), el("td", {}, s.image), el("td", {}, on.join(", ") || "-"), cell);
+  });
+  body.replaceChildren(...(rows.length ? rows : [el("tr", {}, el("td", { colspan: 4, class: "empty" }, "No services"))]));
+}
+
+function renderMigrations(records) {
+  const body = document.querySelector("#migrations tbody");
+  const rows = records.slice().reverse().map((m) =>
+    el("tr", {},
+      el("td", { title: m.start }, since(m.start)),
+      el("td", {}, m.service),
+      el("td", {}, m.src),
+      el("td", {}, m.dest),
+      el("td", {}, badge(m.outcome)),
+      el("td", {}, seconds(m.duration)),
+      el("td", {}, seconds(m.downtime)),
+      el("td", {}, m.error || ""),
+    ));
+  body.replaceChildren(...(rows.length ? rows : [el("tr", {}, el("td", { colspan: 8, class: "empty" }, "No migrations"))]));
+}
+
+async function loadCheckpoints(name) {
+  checkpoints[name] = await call("GET", "/services/" + encodeURIComponent(name) + "/checkpoints/sizes");
+}
+
+async function toggleCheckpoints(name) {
+  if (expanded.has(name)) {
+    expanded.delete(name);
+  } else {
+    expanded.add(name);
+    try {
+      await loadCheckpoints(name);
+    } catch (e) {
+      show("Loading checkpoints of " + name + " failed: " + e.message, false);
+    }
+  }
+  refresh();
+}
+
+async function refresh() {
+  try {
+    const [w, s, m] = await Promise.all([
+      call("GET", "/workers"),
+      call("GET", "/services"),
+      call("GET", "/migrations?limit=50"),
+    ]);
+    workers = (w || []).sort((a, b) => a.id.localeCompare(b.id));
+    const services = (s || []).sort((a, b) => a.name.localeCompare(b.name));
+    await Promise.all([...expanded].map((name) => loadCheckpoints(name).catch(() => {})));
+    renderWorkers();
+    renderServices(services);
+    renderMigrations(m || []);
+    document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+  } catch (e) {
+    document.getElementById("updated").textContent = "Update failed: " + e.message;
+    if (e.status === 401 || e.status === 403) document.getElementById("token").focus();
+  }
+}
+
+document.getElementById("token").value = token;
+document.getElementById("auth").addEventListener("submit", (e) => {
+  e.preventDefault();
+  token = document.getElementById("token").value.trim();
+  localStorage.setItem("cm_token", token);
+  refresh();
+});
+
+refresh();
+setInterval(() => {
+  if (!document.getElementById("migrate").open) refresh();
+}, refreshInterval);
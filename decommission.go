@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Modes of DELETE /worker/:worker_id for a worker that still has services
+const (
+	decommissionRefuse = "refuse" //answer 409, the default
+	decommissionDrain  = "drain"  //migrate the running services away, then remove the containers
+	decommissionForce  = "force"  //stop and remove the containers, going on when the controller fails
+)
+
+type rehomedService struct {
+	Service string `json:"service"`
+	Image   string `json:"image"`            //latest checkpoint, now the image the service is run from
+	Worker  string `json:"worker,omitempty"` //worker a standby container was started on
+	Error   string `json:"error,omitempty"`
+}
+
+type decommissionResp struct {
+	Worker   string           `json:"worker"`
+	Mode     string           `json:"mode"`
+	Deleted  bool             `json:"deleted"`
+	Services []string         `json:"services"`           //services on the worker when it was deleted
+	Migrated []rebalanceStep  `json:"migrated,omitempty"` //drain only
+	Removed  []string         `json:"removed,omitempty"`  //containers removed from the worker
+	Rehomed  []rehomedService `json:"rehomed,omitempty"`
+	Errors   []string         `json:"errors,omitempty"`
+	Retries  []retryRecord    `json:"retries,omitempty"`
+}
+
+// decommission locks the services of the worker and decommissions it. The
+// error is only set when the services could not be locked.
+func decommission(ctx context.Context, id string, mode string, wait bool) (decommissionResp, int, error) {
+	updateWorkerServices(ctx, id, "")
+	onWorker := append([]ServiceInWorker(nil), workers[id].Services...)
+	names := []string{}
+	for _, s := range onWorker {
+		names = append(names, s.Name)
+	}
+	if len(onWorker) > 0 && mode != decommissionRefuse {
+		var release func()
+		var err error
+		ctx, release, err = lockForOperation(ctx, names, "decommission", onWorkers(id), wait)
+		if err != nil {
+			return decommissionResp{}, http.StatusConflict, err
+		}
+		defer release()
+	}
+	ctx, retries := withRetryReport(ctx)
+	resp, status := decommissionWorker(ctx, id, mode, onWorker)
+	resp.Retries = retries.list()
+	return resp, status, nil
+}
+
+// decommissionWorker empties the worker according to mode and deletes it.
+// It returns the status to answer with, the worker is kept unless it is 200.
+func decommissionWorker(ctx context.Context, id string, mode string, services_ []ServiceInWorker) (decommissionResp, int) {
+	logger := loggerFrom(ctx)
+	resp := decommissionResp{Worker: id, Mode: mode, Services: []string{}}
+	for _, s := range services_ {
+		resp.Services = append(resp.Services, s.Name)
+	}
+	if len(services_) > 0 && mode == decommissionRefuse {
+		resp.Errors = append(resp.Errors, "worker has services, delete with mode drain or force")
+		return resp, http.StatusConflict
+	}
+
+	migrated := make(map[string]bool)
+	if mode == decommissionDrain {
+		plan := planRebalance([]string{id})
+		if len(plan.Unplaced) > 0 {
+			resp.Errors = append(resp.Errors, "not enough capacity to move away: "+strings.Join(plan.Unplaced, ", "))
+			return resp, http.StatusConflict
+		}
+		// Only the moves off this worker, not the rebalancing of the others
+		steps := []rebalanceStep{}
+		for _, step := range plan.Steps {
+			if step.Src == id {
+				steps = append(steps, step)
+			}
+		}
+		plan.Steps = steps
+		executeRebalance(ctx, &plan, rebalanceReq{Concurrency: 1})
+		resp.Migrated = plan.Steps
+		for _, step := range plan.Steps {
+			if step.Status != "success" {
+				resp.Errors = append(resp.Errors, "migrating "+step.Service+": "+step.Error)
+				continue
+			}
+			migrated[step.Service] = true
+		}
+		if len(resp.Errors) > 0 {
+			return resp, http.StatusMultiStatus
+		}
+	}
+
+	for _, s := range services_ {
+		if err := retireService(ctx, id, s.Name); err != nil {
+			logger.Error("Error removing service from decommissioned worker", zap.String("workerID", id), zap.String("service", s.Name), zap.Error(err))
+			resp.Errors = append(resp.Errors, "removing "+s.Name+": "+err.Error())
+			if mode == decommissionDrain {
+				return resp, http.StatusInternalServerError
+			}
+			continue
+		}
+		resp.Removed = append(resp.Removed, s.Name)
+	}
+
+	for _, s := range services_ {
+		if migrated[s.Name] || len(services[s.Name].ChkFiles) == 0 {
+			continue
+		}
+		resp.Rehomed = append(resp.Rehomed, rehomeService(ctx, s.Name, workers[id]))
+	}
+
+	deleteWorker(id)
+	resp.Deleted = true
+	logger.Info("Worker decommissioned", zap.String("workerID", id), zap.String("mode", mode), zap.Strings("services", resp.Services), zap.Int("errors", len(resp.Errors)))
+	return resp, http.StatusOK
+}
+
+// retireService stops and removes the service's container from the worker
+// and unsubscribes the worker from it
+func retireService(ctx context.Context, id string, name string) error {
+	worker := workers[id]
+	status, err := queryServiceStatus(ctx, id, name)
+	if err != nil {
+		return err
+	}
+	if status == "running" || status == "paused" || status == "standby" || status == "checkpointed" {
+		if err := stopService(ctx, worker, services[name]); err != nil {
+			return err
+		}
+	}
+	if err := removeService(ctx, worker, services[name]); err != nil {
+		return err
+	}
+	return unsubscribeService(ctx, id, name)
+}
+
+// rehomeService points the catalog entry of a service that lived on a
+// deleted worker at its latest checkpoint and starts a standby container on
+// the least loaded up worker, so that running it there restores it
+func rehomeService(ctx context.Context, name string, from Worker) rehomedService {
+	logger := loggerFrom(ctx)
+	svc := services[name]
+	res := rehomedService{Service: name, Image: svc.ChkFiles[len(svc.ChkFiles)-1]}
+
+	stateMu.Lock()
+	config := serviceConfigs[name]
+	config.RunOpt.ImageURL = res.Image
+	config.RunOpt.NoRestore = false
+	serviceConfigs[name] = config
+	ids := []string{}
+	load := make(map[string]int)
+	for wid, w := range workers {
+		if isIn, _ := isServiceInWorker(w, name); wid == from.Id || w.Status != workerUp || isIn {
+			continue
+		}
+		for _, s := range w.Services {
+			if s.Status == "running" {
+				load[wid]++
+			}
+		}
+		if w.Capacity == 0 || load[wid] < w.Capacity {
+			ids = append(ids, wid)
+		}
+	}
+	stateMu.Unlock()
+	if len(ids) == 0 {
+		res.Error = "no up worker to start a standby on"
+		return res
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if load[ids[i]] != load[ids[j]] {
+			return load[ids[i]] < load[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	sopt := from.lastSopt[name]
+	if sopt.ContainerName == "" {
+		sopt = config.StartOpt
+	}
+	if sopt.ContainerName == "" {
+		sopt.ContainerName = name
+	}
+	if sopt.Image == "" {
+		sopt.Image = svc.Image
+	}
+	if err := startServiceContainer(ctx, workers[ids[0]], sopt); err != nil {
+		logger.Error("Error starting standby to re-home service", zap.String("service", name), zap.String("worker", ids[0]), zap.Error(err))
+		res.Error = err.Error()
+		return res
+	}
+	res.Worker = ids[0]
+	logger.Info("Service re-homed", zap.String("service", name), zap.String("worker", ids[0]), zap.String("image", res.Image))
+	return res
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Worker liveness states. A worker is new until its first heartbeat, then up,
+// suspect when the failure detector starts doubting it and down once the
+// detector gives up and an active probe of its controller fails too. It is
+// left after announcing it is leaving, until it sends a heartbeat again.
+const (
+	workerNew     = "new"
+	workerUp      = "up"
+	workerSuspect = "suspect"
+	workerDown    = "down"
+	workerLeft    = "left"
+)
+
+// failureDetector tells from the heartbeats of the workers which ones are
+// failing
+type failureDetector interface {
+	heartbeat(workerId string, at time.Time)
+	// assess returns the suspicion level of the worker at now and the
+	// verdict, workerUp, workerSuspect or workerDown
+	assess(workerId string, now time.Time) (float64, string)
+	forget(workerId string)
+}
+
+var detector failureDetector = newTimeoutDetector(fdSuspectAfter, fdDownAfter)
+var detectorInterval = time.Second
+
+// Settings of the detectors, see failure_detector_init
+var detectorKind = "timeout"
+var fdSuspectAfter = 6 * time.Second
+var fdDownAfter = 9 * time.Second
+var fdPhiSuspect = 5.0
+var fdPhiDown = 8.0
+var fdHeartbeatInterval = 3 * time.Second //expected interval, the phi detector's first guess
+
+func failure_detector_init() {
+	switch detectorKind {
+	case "phi":
+		detector = newPhiDetector(fdPhiSuspect, fdPhiDown, fdHeartbeatInterval)
+	case "timeout":
+		detector = newTimeoutDetector(fdSuspectAfter, fdDownAfter)
+	default:
+		logger.Fatal("Unknown failure detector, use timeout or phi", zap.String("detector", detectorKind))
+	}
+	logger.Debug("Failure detector", zap.String("detector", detectorKind))
+}
+
+// timeoutDetector suspects a worker silent for suspectAfter and declares it
+// down after downAfter. Its suspicion level is the seconds since the last
+// heartbeat.
+type timeoutDetector struct {
+	mu           sync.Mutex
+	suspectAfter time.Duration
+	downAfter    time.Duration
+	last         map[string]time.Time
+}
+
+func newTimeoutDetector(suspectAfter time.Duration, downAfter time.Duration) *timeoutDetector {
+	return &timeoutDetector{suspectAfter: suspectAfter, downAfter: downAfter, last: make(map[string]time.Time)}
+}
+
+func (d *timeoutDetector) heartbeat(workerId string, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last[workerId] = at
+}
+
+func (d *timeoutDetector) assess(workerId string, now time.Time) (float64, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last, ok := d.last[workerId]
+	if !ok {
+		return 0, workerUp
+	}
+	silent := now.Sub(last)
+	switch {
+	case silent >= d.downAfter:
+		return silent.Seconds(), workerDown
+	case silent >= d.suspectAfter:
+		return silent.Seconds(), workerSuspect
+	}
+	return silent.Seconds(), workerUp
+}
+
+func (d *timeoutDetector) forget(workerId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.last, workerId)
+}
+
+// phiDetector is a phi accrual failure detector (Hayashibara et al.). It
+// learns the distribution of each worker's heartbeat intervals and its
+// suspicion level phi is -log10 of the probability that a heartbeat still
+// comes this late, so phi 1 means a 10% chance of a false suspicion, 2 a 1%
+// chance and so on.
+type phiDetector struct {
+	mu         sync.Mutex
+	suspectPhi float64
+	downPhi    float64
+	window     int           //intervals kept per worker
+	minStdDev  time.Duration //floor of the deviation, very regular heartbeats would make any delay fatal
+	firstGuess time.Duration //interval assumed until some are measured
+	history    map[string]*phiHistory
+}
+
+type phiHistory struct {
+	last      time.Time
+	intervals []float64 //seconds
+}
+
+func newPhiDetector(suspectPhi float64, downPhi float64, firstGuess time.Duration) *phiDetector {
+	return &phiDetector{suspectPhi: suspectPhi, downPhi: downPhi, window: 100, minStdDev: 500 * time.Millisecond, firstGuess: firstGuess, history: make(map[string]*phiHistory)}
+}
+
+func (d *phiDetector) heartbeat(workerId string, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.history[workerId]
+	if !ok {
+		d.history[workerId] = &phiHistory{last: at, intervals: []float64{d.firstGuess.Seconds()}}
+		return
+	}
+	h.intervals = append(h.intervals, at.Sub(h.last).Seconds())
+	if len(h.intervals) > d.window {
+		h.intervals = h.intervals[len(h.intervals)-d.window:]
+	}
+	h.last = at
+}
+
+func (d *phiDetector) assess(workerId string, now time.Time) (float64, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.history[workerId]
+	if !ok {
+		return 0, workerUp
+	}
+	phi := d.phi(h, now.Sub(h.last).Seconds())
+	switch {
+	case phi >= d.downPhi:
+		return phi, workerDown
+	case phi >= d.suspectPhi:
+		return phi, workerSuspect
+	}
+	return phi, workerUp
+}
+
+// phi uses the logistic approximation of the normal distribution's tail
+func (d *phiDetector) phi(h *phiHistory, elapsed float64) float64 {
+	mean, variance := 0.0, 0.0
+	for _, v := range h.intervals {
+		mean += v
+	}
+	mean /= float64(len(h.intervals))
+	for _, v := range h.intervals {
+		variance += (v - mean) * (v - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(h.intervals))), d.minStdDev.Seconds())
+
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	var phi float64
+	if elapsed > mean {
+		phi = -math.Log10(e / (1 + e))
+	} else {
+		phi = -math.Log10(1 - 1/(1+e))
+	}
+	if math.IsInf(phi, 0) || math.IsNaN(phi) || phi > 99 {
+		return 99
+	}
+	return phi
+}
+
+func (d *phiDetector) forget(workerId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.history, workerId)
+}
+
+// workerSuspicion keeps the last suspicion level of each worker for the metrics
+var workerSuspicion = make(map[string]float64)
+
+// evaluateWorkers applies the detector's verdicts. A worker it finds down is
+// probed first and only declared down when its controller does not answer.
+func evaluateWorkers(ctx context.Context) {
+	now := time.Now()
+	var probe []string
+	mu.Lock()
+	for _, id := range workerIds() {
+		w, ok := getWorker(id)
+		if !ok {
+			continue
+		}
+		level, verdict := detector.assess(id, now)
+		workerSuspicion[id] = level
+		if w.Status == workerNew || w.Status == workerLeft || w.Status == workerDown {
+			continue
+		}
+		switch verdict {
+		case workerUp:
+			if w.Status != workerUp {
+				logger.Info("Worker no longer suspected", zap.String("workerId", id), zap.Float64("suspicion", level))
+				setWorkerStatus(id, workerUp)
+			}
+		case workerSuspect:
+			if w.Status != workerSuspect {
+				logger.Warn("Worker suspected", zap.String("workerId", id), zap.Float64("suspicion", level))
+				setWorkerStatus(id, workerSuspect)
+			}
+		case workerDown:
+			probe = append(probe, id)
+		}
+	}
+	mu.Unlock()
+
+	// Not while holding the heartbeat lock, probing calls the controllers
+	for _, id := range probe {
+		pctx, cancel := context.WithTimeout(ctx, detectorInterval)
+		answered := isWorkerUp(pctx, id)
+		cancel()
+		mu.Lock()
+		w, ok := getWorker(id)
+		_, verdict := detector.assess(id, time.Now())
+		if ok && verdict == workerDown && (w.Status == workerUp || w.Status == workerSuspect) {
+			if answered {
+				// Its heartbeats are lost but the controller serves, keep it suspect
+				if w.Status != workerSuspect {
+					logger.Warn("Worker silent but answers probes", zap.String("workerId", id))
+					setWorkerStatus(id, workerSuspect)
+				}
+			} else {
+				logger.Error("Worker down", zap.String("workerId", id))
+				setWorkerStatus(id, workerDown)
+			}
+		}
+		mu.Unlock()
+	}
+}
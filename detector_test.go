@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTimeoutDetector(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name    string
+		beat    bool
+		silent  time.Duration
+		verdict string
+	}{
+		{name: "never heard of", silent: time.Hour, verdict: workerUp},
+		{name: "recent heartbeat", beat: true, silent: 2 * time.Second, verdict: workerUp},
+		{name: "suspect", beat: true, silent: 6 * time.Second, verdict: workerSuspect},
+		{name: "down", beat: true, silent: 9 * time.Second, verdict: workerDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTimeoutDetector(6*time.Second, 9*time.Second)
+			if tt.beat {
+				d.heartbeat("w1", start)
+			}
+			level, verdict := d.assess("w1", start.Add(tt.silent))
+			if verdict != tt.verdict {
+				t.Errorf("verdict = %s, want %s", verdict, tt.verdict)
+			}
+			if tt.beat && level != tt.silent.Seconds() {
+				t.Errorf("level = %v, want %v", level, tt.silent.Seconds())
+			}
+		})
+	}
+
+	d := newTimeoutDetector(6*time.Second, 9*time.Second)
+	d.heartbeat("w1", start)
+	d.forget("w1")
+	if _, verdict := d.assess("w1", start.Add(time.Hour)); verdict != workerUp {
+		t.Errorf("verdict = %s after forget, want %s", verdict, workerUp)
+	}
+}
+
+func TestPhiDetector(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name     string
+		interval time.Duration //between the regular heartbeats
+		beats    int
+		silent   time.Duration //since the last heartbeat
+		verdict  string
+	}{
+		{name: "never heard of", silent: time.Hour, verdict: workerUp},
+		{name: "first guess on time", beats: 1, silent: 3 * time.Second, verdict: workerUp},
+		{name: "on time", interval: time.Second, beats: 20, silent: time.Second, verdict: workerUp},
+		{name: "a bit late", interval: time.Second, beats: 20, silent: 2 * time.Second, verdict: workerUp},
+		{name: "late", interval: time.Second, beats: 20, silent: 3500 * time.Millisecond, verdict: workerSuspect},
+		{name: "very late", interval: time.Second, beats: 20, silent: 6 * time.Second, verdict: workerDown},
+		{name: "slow worker on time", interval: 5 * time.Second, beats: 20, silent: 5 * time.Second, verdict: workerUp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newPhiDetector(5, 8, 3*time.Second)
+			at := start
+			for i := 0; i < tt.beats; i++ {
+				if i > 0 {
+					at = at.Add(tt.interval)
+				}
+				d.heartbeat("w1", at)
+			}
+			phi, verdict := d.assess("w1", at.Add(tt.silent))
+			if verdict != tt.verdict {
+				t.Errorf("verdict = %s (phi %.2f), want %s", verdict, phi, tt.verdict)
+			}
+		})
+	}
+}
+
+func TestPhiGrowsWithSilence(t *testing.T) {
+	d := newPhiDetector(5, 8, 3*time.Second)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		d.heartbeat("w1", start.Add(time.Duration(i)*time.Second))
+	}
+	last := start.Add(9 * time.Second)
+	prev := -1.0
+	for s := 0; s <= 20; s++ {
+		phi, _ := d.assess("w1", last.Add(time.Duration(s)*time.Second))
+		if phi < prev {
+			t.Fatalf("phi went down from %.2f to %.2f after %ds", prev, phi, s)
+		}
+		if phi < 0 || phi > 99 {
+			t.Fatalf("phi = %.2f after %ds, want within [0, 99]", phi, s)
+		}
+		prev = phi
+	}
+	if prev != 99 {
+		t.Errorf("phi = %.2f after a long silence, want the cap of 99", prev)
+	}
+}
+
+// Run with -race, detector ticks and heartbeats overlap a migration's service
+// refreshes
+func TestEvaluateWorkersWhileServicesChange(t *testing.T) {
+	withCluster(t, []string{"w1", "w2"}, "a")
+	old := detector
+	detector = newTimeoutDetector(time.Hour, 2*time.Hour)
+	t.Cleanup(func() { detector = old })
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/heartbeat", heatbeatHandler)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			addRunService("w1", ServiceInWorker{Name: "a", Status: "running"})
+			deleteRunService("w1", "a")
+			runtime.Gosched()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		evaluateWorkers(context.Background())
+	}
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/heartbeat", strings.NewReader(`{"worker_id":"w2"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("heartbeat = %d: %s", w.Code, w.Body.String())
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if w, _ := getWorker("w2"); w.Status != workerUp || w.lastBeat.IsZero() {
+		t.Errorf("w2 is %s, last beat %v, want up after its heartbeats", w.Status, w.lastBeat)
+	}
+}
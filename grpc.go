@@ -0,0 +1,804 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cm_manager/cmpb"
+	"github.com/docker/docker/api/types/mount"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The gRPC API mirrors the REST operations, see cmpb/cm_manager.proto. It is
+// served on grpcAddr with the TCP listener's TLS configuration, empty leaves
+// it disabled. Reflection is enabled so grpcurl can be used without the proto.
+var grpcAddr string
+
+const listenerGRPC = "grpc"
+
+// Roles required by the Manager methods, like their REST routes
+var grpcRoles = map[string]role{
+	"ListWorkers":       roleReader,
+	"GetWorker":         roleReader,
+	"AddWorker":         roleAdmin,
+	"DeleteWorker":      roleAdmin,
+	"ListServices":      roleReader,
+	"GetService":        roleReader,
+	"GetServiceConfig":  roleReader,
+	"AddService":        roleAdmin,
+	"DeleteService":     roleAdmin,
+	"StartService":      roleOperator,
+	"RunService":        roleOperator,
+	"CheckpointService": roleOperator,
+	"MigrateService":    roleOperator,
+	"CloneService":      roleAdmin,
+	"StopService":       roleOperator,
+	"RemoveService":     roleOperator,
+	"Watch":             roleReader,
+}
+
+// Methods that change the cluster, they are audited like POST and DELETE
+var grpcMutating = map[string]bool{
+	"AddWorker":         true,
+	"DeleteWorker":      true,
+	"AddService":        true,
+	"DeleteService":     true,
+	"StartService":      true,
+	"RunService":        true,
+	"CheckpointService": true,
+	"MigrateService":    true,
+	"CloneService":      true,
+	"StopService":       true,
+	"RemoveService":     true,
+}
+
+type grpcServer struct {
+	cmpb.UnimplementedManagerServer
+}
+
+func serveGRPC(addr string, tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	cmpb.RegisterManagerServer(server, &grpcServer{})
+	reflection.Register(server)
+	logger.Info("Listening for gRPC", zap.String("addr", addr), zap.Bool("tls", tlsConfig != nil))
+	go server.Serve(listener)
+	return nil
+}
+
+// grpcContext tags the call with a request id, from the x-request-id metadata
+// when given, and checks the caller has the role the method requires.
+// Methods not in grpcRoles, like reflection, are open.
+func grpcContext(ctx context.Context, fullMethod string) (context.Context, identity, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := ""
+	if v := md.Get(strings.ToLower(requestIDHeader)); len(v) > 0 {
+		id = v[0]
+	}
+	if id == "" || len(id) > 64 {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestIDHeader), id))
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	ctx = context.WithValue(ctx, loggerKey{}, logger.With(zap.String("request_id", id)))
+	ctx = context.WithValue(ctx, listenerKey{}, listenerGRPC)
+
+	caller, err := grpcIdentity(ctx, md)
+	if err != nil {
+		return ctx, caller, err
+	}
+	required, ok := grpcRoles[path.Base(fullMethod)]
+	if !ok || !strings.HasPrefix(fullMethod, "/cm_manager.v1.Manager/") {
+		return ctx, caller, nil
+	}
+	if caller.Role == roleNone {
+		return ctx, caller, status.Error(codes.Unauthenticated, "Authentication required")
+	}
+	if caller.Role < required {
+		logger.Warn("Permission denied", zap.String("caller", caller.Name), zap.String("role", caller.Role.String()), zap.String("required", required.String()), zap.String("method", fullMethod))
+		return ctx, caller, status.Error(codes.PermissionDenied, "Permission denied, requires role "+required.String())
+	}
+	return ctx, caller, nil
+}
+
+// grpcIdentity resolves the caller like authenticate does, from the bearer
+// token in the authorization metadata or the client certificate
+func grpcIdentity(ctx context.Context, md metadata.MD) (identity, error) {
+	if !authEnabled() {
+		return identity{Name: "local", Role: roleAdmin, Via: "local"}, nil
+	}
+	if v := md.Get("authorization"); len(v) > 0 {
+		header := v[0]
+		token := strings.TrimPrefix(header, "Bearer ")
+		id, found := authTokens[sha256.Sum256([]byte(token))]
+		if !strings.HasPrefix(header, "Bearer ") || !found {
+			remote := ""
+			if p, ok := peer.FromContext(ctx); ok {
+				remote = p.Addr.String()
+			}
+			logger.Warn("Invalid bearer token", zap.String("listener", listenerGRPC), zap.String("remote", remote))
+			return identity{}, status.Error(codes.Unauthenticated, "Invalid token")
+		}
+		return id, nil
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			cn := info.State.VerifiedChains[0][0].Subject.CommonName
+			if r, ok := authCertRoles[cn]; ok {
+				return identity{Name: cn, Role: r, Via: "cert"}, nil
+			}
+		}
+	}
+	return identity{Name: "anonymous", Role: roleNone, Via: "anonymous"}, nil
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, caller, err := grpcContext(ctx, info.FullMethod)
+	var resp interface{}
+	if err == nil {
+		loggerFrom(ctx).Debug("request", zap.String("method", info.FullMethod))
+		resp, err = handler(ctx, req)
+		loggerFrom(ctx).Debug("response", zap.String("method", info.FullMethod), zap.String("code", status.Code(err).String()))
+	}
+	if grpcMutating[path.Base(info.FullMethod)] {
+		auditGRPC(ctx, caller, info.FullMethod, req, start, err)
+	}
+	return resp, err
+}
+
+func grpcStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, _, err := grpcContext(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &grpcStream{ServerStream: ss, ctx: ctx})
+}
+
+// grpcStream hands the tagged context to stream handlers
+type grpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcStream) Context() context.Context {
+	return s.ctx
+}
+
+func auditGRPC(ctx context.Context, caller identity, fullMethod string, req interface{}, start time.Time, err error) {
+	if auditWriter == nil {
+		return
+	}
+	code := status.Code(err)
+	entry := AuditEntry{
+		Time:     start.UTC(),
+		Caller:   caller.Name,
+		Via:      caller.Via,
+		Listener: listenerGRPC,
+		Method:   "GRPC",
+		Route:    fullMethod,
+		Path:     fullMethod,
+		Status:   grpcHTTPStatus(code),
+		Outcome:  "success",
+		Duration: time.Since(start).Seconds(),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.RemoteAddr = p.Addr.String()
+	}
+	if m, ok := req.(proto.Message); ok {
+		var parsed interface{}
+		if b, err := (protojson.MarshalOptions{UseProtoNames: true}).Marshal(m); err == nil && json.Unmarshal(b, &parsed) == nil {
+			entry.Body = redact(parsed)
+			if body, ok := parsed.(map[string]interface{}); ok {
+				entry.Service, _ = body["service"].(string)
+				if entry.Service == "" {
+					entry.Service, _ = body["name"].(string)
+				}
+				for _, key := range []string{"worker_id", "src", "dest"} {
+					if s, ok := body[key].(string); ok && s != "" {
+						entry.Workers = append(entry.Workers, s)
+					}
+				}
+			}
+		}
+	}
+	if err != nil {
+		entry.Outcome = "failure"
+		entry.Error = status.Convert(err).Message()
+	}
+	writeAuditEntry(entry)
+}
+
+// grpcCodes maps the statuses the operations answer REST with
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.Aborted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+func grpcHTTPStatus(code codes.Code) int {
+	if code == codes.OK {
+		return http.StatusOK
+	}
+	for s, c := range grpcCodes {
+		if c == code {
+			return s
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+func grpcStatusError(httpStatus int, err error) error {
+	code, ok := grpcCodes[httpStatus]
+	if !ok {
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+// grpcOpError converts the error of an operation on the controllers
+func grpcOpError(ctx context.Context, msg string, err error) error {
+	loggerFrom(ctx).Error(msg, zap.Error(err))
+	code := codes.Internal
+	switch {
+	case errors.Is(err, errWorkerUnavailable):
+		code = codes.Unavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, msg+":"+err.Error())
+}
+
+// grpcLock takes the service locks like lockForRequest, a busy service
+// fails with Aborted
+func grpcLock(ctx context.Context, services []string, op string, workersOf func(string) []string, wait bool) (context.Context, func(), error) {
+	ctx, release, err := lockForOperation(ctx, services, op, workersOf, wait)
+	if err != nil {
+		return nil, nil, status.Error(codes.Aborted, err.Error())
+	}
+	return ctx, release, nil
+}
+
+func grpcServiceOnWorker(worker_id string, service string) error {
+	if _, ok := getWorker(worker_id); !ok {
+		return status.Error(codes.NotFound, "Worker not found")
+	}
+	if _, ok := getService(service); !ok {
+		return status.Error(codes.NotFound, "Service not found")
+	}
+	return nil
+}
+
+func (s *grpcServer) ListWorkers(ctx context.Context, req *cmpb.ListWorkersRequest) (*cmpb.ListWorkersResponse, error) {
+	resp := &cmpb.ListWorkersResponse{}
+	for _, id := range workerIds() {
+		updateWorkerServices(ctx, id, "")
+		if w, ok := getWorker(id); ok {
+			resp.Workers = append(resp.Workers, workerToPb(w))
+		}
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) GetWorker(ctx context.Context, req *cmpb.GetWorkerRequest) (*cmpb.Worker, error) {
+	if _, ok := getWorker(req.WorkerId); !ok {
+		return nil, status.Error(codes.NotFound, "Worker not found")
+	}
+	updateWorkerServices(ctx, req.WorkerId, "")
+	worker, _ := getWorker(req.WorkerId)
+	return workerToPb(worker), nil
+}
+
+func (s *grpcServer) AddWorker(ctx context.Context, req *cmpb.AddWorkerRequest) (*cmpb.OperationResponse, error) {
+	if req.WorkerId == "" || req.Addr == "" {
+		return nil, status.Error(codes.InvalidArgument, "worker_id and addr are required")
+	}
+	if _, ok := getWorker(req.WorkerId); ok {
+		return nil, status.Error(codes.AlreadyExists, "Worker already exists")
+	}
+	addWorker(ctx, req.WorkerId, req.Addr, false)
+	if req.Capacity > 0 {
+		setWorkerCapacity(req.WorkerId, int(req.Capacity))
+	}
+	return &cmpb.OperationResponse{Msg: fmt.Sprintf("worker_id %s with address %s added", req.WorkerId, req.Addr)}, nil
+}
+
+func (s *grpcServer) DeleteWorker(ctx context.Context, req *cmpb.DeleteWorkerRequest) (*cmpb.DeleteWorkerResponse, error) {
+	if _, ok := getWorker(req.WorkerId); !ok {
+		return nil, status.Error(codes.NotFound, "Worker not found")
+	}
+	mode := req.Mode
+	if mode == "" {
+		mode = decommissionRefuse
+	}
+	if mode != decommissionRefuse && mode != decommissionDrain && mode != decommissionForce {
+		return nil, status.Error(codes.InvalidArgument, "Invalid mode, use refuse, drain or force")
+	}
+	if l, busy := workerBusy(req.WorkerId); busy {
+		return nil, status.Error(codes.Aborted, "Worker busy: "+errServiceBusy{holder: l}.Error())
+	}
+	resp, httpStatus, err := decommission(ctx, req.WorkerId, mode, req.Wait)
+	if err != nil {
+		return nil, grpcStatusError(httpStatus, err)
+	}
+	if httpStatus == http.StatusMultiStatus {
+		// Some services could not be moved, the worker is kept
+		httpStatus = http.StatusConflict
+	}
+	if httpStatus != http.StatusOK {
+		return nil, grpcStatusError(httpStatus, errors.New("Worker not deleted: "+strings.Join(resp.Errors, "; ")))
+	}
+	return decommissionToPb(resp), nil
+}
+
+func (s *grpcServer) ListServices(ctx context.Context, req *cmpb.ListServicesRequest) (*cmpb.ListServicesResponse, error) {
+	resp := &cmpb.ListServicesResponse{}
+	for _, name := range serviceNames() {
+		if svc, ok := getService(name); ok {
+			resp.Services = append(resp.Services, serviceToPb(svc))
+		}
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) GetService(ctx context.Context, req *cmpb.GetServiceRequest) (*cmpb.Service, error) {
+	svc, ok := getService(req.Name)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Service not found")
+	}
+	return serviceToPb(svc), nil
+}
+
+func (s *grpcServer) GetServiceConfig(ctx context.Context, req *cmpb.GetServiceRequest) (*cmpb.ServiceConfig, error) {
+	config, ok := getServiceConfig(req.Name)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Service not found")
+	}
+	return &cmpb.ServiceConfig{
+		Start:      startOptionsToPb(config.StartOpt),
+		Run:        runOptionsToPb(config.RunOpt),
+		Checkpoint: checkpointOptionsToPb(config.ChkOpt),
+		Standby:    &cmpb.StandbyConfig{Count: int32(config.Standby.Count), Workers: config.Standby.Workers},
+	}, nil
+}
+
+func (s *grpcServer) AddService(ctx context.Context, req *cmpb.AddServiceRequest) (*cmpb.OperationResponse, error) {
+	if _, instance := splitInstance(req.Name); req.Name == "" || (req.Image == "" && instance == "") {
+		return nil, status.Error(codes.InvalidArgument, "name and image are required")
+	}
+	if _, ok := getService(req.Name); ok {
+		return nil, status.Error(codes.AlreadyExists, "Service already exists")
+	}
+	svc, err := addService(req.Name, req.Image)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	scanCheckpointFiles(1, req.Name)
+	return &cmpb.OperationResponse{Msg: fmt.Sprintf("service %s with image %s added", svc.Name, svc.Image)}, nil
+}
+
+func (s *grpcServer) DeleteService(ctx context.Context, req *cmpb.DeleteServiceRequest) (*cmpb.OperationResponse, error) {
+	svc, ok := getService(req.Name)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Service not found")
+	}
+	if len(svc.Instances) > 0 {
+		return nil, status.Error(codes.FailedPrecondition, "Service has instances, delete them first")
+	}
+	ctx, release, err := grpcLock(ctx, []string{req.Name}, "delete", func(string) []string { return nil }, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := deleteService(ctx, req.Name); err != nil {
+		return nil, grpcOpError(ctx, "Error deleting service", err)
+	}
+	if req.DeleteCheckpoints {
+		if err := deleteCheckpointFiles(req.Name); err != nil {
+			return nil, grpcOpError(ctx, "Error deleting checkpoint files", err)
+		}
+	}
+	return &cmpb.OperationResponse{Msg: fmt.Sprintf("Service %s deleted", req.Name)}, nil
+}
+
+func (s *grpcServer) StartService(ctx context.Context, req *cmpb.StartServiceRequest) (*cmpb.OperationResponse, error) {
+	if err := grpcServiceOnWorker(req.WorkerId, req.Service); err != nil {
+		return nil, err
+	}
+	opts := startOptionsFromPb(req.Options)
+	if opts.ContainerName == "" {
+		opts.ContainerName = req.Service
+	}
+	if opts.Image == "" {
+		named, _ := getService(opts.ContainerName)
+		opts.Image = named.Image
+	}
+	ctx, release, err := grpcLock(ctx, []string{req.Service}, "start", onWorkers(req.WorkerId), req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	worker, _ := getWorker(req.WorkerId)
+	ctx, retries := withRetryReport(ctx)
+	if err := startServiceContainer(ctx, worker, opts); err != nil {
+		return nil, grpcOpError(ctx, "Error starting container", err)
+	}
+	return &cmpb.OperationResponse{
+		Msg:     fmt.Sprintf("Container of service %s with of worker %s started", opts.ContainerName, req.WorkerId),
+		Retries: retriesToPb(retries.list()),
+	}, nil
+}
+
+func (s *grpcServer) RunService(ctx context.Context, req *cmpb.RunServiceRequest) (*cmpb.OperationResponse, error) {
+	if err := grpcServiceOnWorker(req.WorkerId, req.Service); err != nil {
+		return nil, err
+	}
+	ctx, release, err := grpcLock(ctx, []string{req.Service}, "run", onWorkers(req.WorkerId), req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	worker, _ := getWorker(req.WorkerId)
+	svc, _ := getService(req.Service)
+	ctx, retries := withRetryReport(ctx)
+	if err := runService(ctx, worker, svc, runOptionsFromPb(req.Options)); err != nil {
+		return nil, grpcOpError(ctx, "Error running service", err)
+	}
+	return &cmpb.OperationResponse{
+		Msg:     fmt.Sprintf("service %s of worker %s is running", req.Service, req.WorkerId),
+		Retries: retriesToPb(retries.list()),
+	}, nil
+}
+
+func (s *grpcServer) CheckpointService(ctx context.Context, req *cmpb.CheckpointServiceRequest) (*cmpb.CheckpointServiceResponse, error) {
+	if err := grpcServiceOnWorker(req.WorkerId, req.Service); err != nil {
+		return nil, err
+	}
+	ctx, release, err := grpcLock(ctx, []string{req.Service}, "checkpoint", onWorkers(req.WorkerId), req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	svc, _ := getService(req.Service)
+	ctx, retries := withRetryReport(ctx)
+	image, err := checkpointService(ctx, req.WorkerId, svc, checkpointOptionsFromPb(req.Options))
+	if err != nil {
+		return nil, grpcOpError(ctx, "Error checkpointing service", err)
+	}
+	return &cmpb.CheckpointServiceResponse{
+		Msg:     fmt.Sprintf("service %s of %s is checkpointed", req.Service, req.WorkerId),
+		Image:   image,
+		Retries: retriesToPb(retries.list()),
+	}, nil
+}
+
+func (s *grpcServer) MigrateService(ctx context.Context, req *cmpb.MigrateServiceRequest) (*cmpb.MigrateServiceResponse, error) {
+	m := migrationReq{
+		Service: req.Service,
+		Src:     req.Src,
+		Dest:    req.Dest,
+		MigrateBody: MigrateBody{
+			Copt: checkpointOptionsFromPb(req.Checkpoint),
+			Ropt: runOptionsFromPb(req.Run),
+			Sopt: startOptionsFromPb(req.Start),
+			Stop: req.Stop,
+		},
+	}
+	if httpStatus, err := prepareMigration(&m); err != nil {
+		return nil, grpcStatusError(httpStatus, err)
+	}
+	ctx, release, err := grpcLock(ctx, []string{m.Service}, "migrate", onWorkers(m.Src, m.Dest), req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	service, _ := getService(m.Service)
+	ctx, retries := withRetryReport(ctx)
+	rec, err := migrateService(ctx, m.Src, m.Dest, service, m.Copt, m.Ropt, m.Sopt, m.Stop)
+	if err != nil {
+		opErr := grpcOpError(ctx, "Error migrating service", err)
+		if rec != nil {
+			return nil, status.Errorf(status.Code(opErr), "%s, state %s, failed in %s", status.Convert(opErr).Message(), rec.State, rec.FailedPhase)
+		}
+		return nil, opErr
+	}
+	return &cmpb.MigrateServiceResponse{
+		Id:       rec.Id,
+		Service:  rec.Service,
+		Src:      rec.Src,
+		Dest:     rec.Dest,
+		Duration: rec.Duration,
+		State:    rec.State,
+		Warnings: rec.Warnings,
+		Retries:  retriesToPb(retries.list()),
+	}, nil
+}
+
+func (s *grpcServer) CloneService(ctx context.Context, req *cmpb.CloneServiceRequest) (*cmpb.CloneServiceResponse, error) {
+	c := cloneReq{
+		Src:  req.Src,
+		Copt: checkpointOptionsFromPb(req.Checkpoint),
+		Ropt: runOptionsFromPb(req.Run),
+		Sopt: startOptionsFromPb(req.Start),
+	}
+	for _, t := range req.Targets {
+		c.Targets = append(c.Targets, cloneTarget{Worker: t.Worker, Name: t.Name})
+	}
+	if httpStatus, err := prepareClone(ctx, req.Service, &c); err != nil {
+		return nil, grpcStatusError(httpStatus, err)
+	}
+	names, workersOf := cloneLocks(req.Service, c)
+	ctx, release, err := grpcLock(ctx, names, "clone", workersOf, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
+	resp, httpStatus := cloneService(ctx, req.Service, c)
+	if httpStatus == http.StatusInternalServerError {
+		errs := make([]string, 0, len(resp.Clones))
+		for _, r := range resp.Clones {
+			errs = append(errs, r.Service+" on "+r.Worker+": "+r.Error)
+		}
+		return nil, status.Error(codes.Internal, "No clone made: "+strings.Join(errs, "; "))
+	}
+	out := &cmpb.CloneServiceResponse{Service: resp.Service, Src: resp.Src, Image: resp.Image, Retries: retriesToPb(retries.list())}
+	for _, r := range resp.Clones {
+		out.Clones = append(out.Clones, &cmpb.CloneResult{Service: r.Service, Worker: r.Worker, Status: r.Status, Error: r.Error})
+	}
+	return out, nil
+}
+
+func (s *grpcServer) StopService(ctx context.Context, req *cmpb.ServiceOnWorkerRequest) (*cmpb.OperationResponse, error) {
+	if err := grpcServiceOnWorker(req.WorkerId, req.Service); err != nil {
+		return nil, err
+	}
+	ctx, release, err := grpcLock(ctx, []string{req.Service}, "stop", onWorkers(req.WorkerId), req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	worker, _ := getWorker(req.WorkerId)
+	svc, _ := getService(req.Service)
+	ctx, retries := withRetryReport(ctx)
+	if err := stopService(ctx, worker, svc); err != nil {
+		return nil, grpcOpError(ctx, "Error stopping service", err)
+	}
+	return &cmpb.OperationResponse{
+		Msg:     fmt.Sprintf("service %s of %s is stopped", req.Service, req.WorkerId),
+		Retries: retriesToPb(retries.list()),
+	}, nil
+}
+
+func (s *grpcServer) RemoveService(ctx context.Context, req *cmpb.ServiceOnWorkerRequest) (*cmpb.OperationResponse, error) {
+	if err := grpcServiceOnWorker(req.WorkerId, req.Service); err != nil {
+		return nil, err
+	}
+	ctx, release, err := grpcLock(ctx, []string{req.Service}, "remove", onWorkers(req.WorkerId), req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	worker, _ := getWorker(req.WorkerId)
+	svc, _ := getService(req.Service)
+	ctx, retries := withRetryReport(ctx)
+	if err := removeService(ctx, worker, svc); err != nil {
+		return nil, grpcOpError(ctx, "Error removing service", err)
+	}
+	return &cmpb.OperationResponse{
+		Msg:     fmt.Sprintf("service %s of %s is removed", req.Service, req.WorkerId),
+		Retries: retriesToPb(retries.list()),
+	}, nil
+}
+
+func (s *grpcServer) Watch(req *cmpb.WatchRequest, stream cmpb.Manager_WatchServer) error {
+	events, stop := watchEvents()
+	defer stop()
+	logger := loggerFrom(stream.Context())
+	logger.Debug("Watch started", zap.Strings("events", req.Events))
+	for {
+		select {
+		case <-stream.Context().Done():
+			logger.Debug("Watch ended")
+			return nil
+		case event := <-events:
+			if !eventMatches(req.Events, event.Type) {
+				continue
+			}
+			if err := stream.Send(eventToPb(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func workerToPb(w Worker) *cmpb.Worker {
+	out := &cmpb.Worker{
+		Id:       w.Id,
+		Addr:     w.IpAddrPort,
+		Status:   w.Status,
+		Capacity: int32(w.Capacity),
+		Breaker:  w.Breaker,
+	}
+	if !w.Since.IsZero() {
+		out.StatusSince = timestamppb.New(w.Since)
+	}
+	for _, s := range w.Services {
+		out.Services = append(out.Services, &cmpb.ServiceInWorker{Name: s.Name, Status: s.Status})
+	}
+	return out
+}
+
+func serviceToPb(s Service) *cmpb.Service {
+	return &cmpb.Service{Name: s.Name, Image: s.Image, Checkpoints: s.ChkFiles, Instances: s.Instances}
+}
+
+func startOptionsToPb(o StartOptions) *cmpb.StartOptions {
+	out := &cmpb.StartOptions{
+		ContainerName: o.ContainerName,
+		Image:         o.Image,
+		AppPorts:      o.AppPorts,
+		Envs:          o.Envs,
+		Caps:          o.Caps,
+	}
+	for _, m := range o.Mounts {
+		out.Mounts = append(out.Mounts, &cmpb.Mount{Type: string(m.Type), Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly})
+	}
+	return out
+}
+
+func startOptionsFromPb(o *cmpb.StartOptions) StartOptions {
+	if o == nil {
+		return StartOptions{}
+	}
+	out := StartOptions{
+		ContainerName: o.ContainerName,
+		Image:         o.Image,
+		AppPorts:      o.AppPorts,
+		Envs:          o.Envs,
+		Caps:          o.Caps,
+	}
+	for _, m := range o.Mounts {
+		out.Mounts = append(out.Mounts, mount.Mount{Type: mount.Type(m.Type), Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly})
+	}
+	return out
+}
+
+func runOptionsToPb(o RunOptions) *cmpb.RunOptions {
+	return &cmpb.RunOptions{
+		AppArgs:        o.AppArgs,
+		ImageUrl:       o.ImageURL,
+		OnAppReady:     o.OnAppReady,
+		PassphraseFile: o.PassphraseFile,
+		PreservedPaths: o.PreservedPaths,
+		NoRestore:      o.NoRestore,
+		AllowBadImage:  o.AllowBadImage,
+		LeaveStopped:   o.LeaveStopped,
+		Verbose:        int32(o.Verbose),
+		Envs:           o.Envs,
+	}
+}
+
+func runOptionsFromPb(o *cmpb.RunOptions) RunOptions {
+	if o == nil {
+		return RunOptions{}
+	}
+	return RunOptions{
+		AppArgs:        o.AppArgs,
+		ImageURL:       o.ImageUrl,
+		OnAppReady:     o.OnAppReady,
+		PassphraseFile: o.PassphraseFile,
+		PreservedPaths: o.PreservedPaths,
+		NoRestore:      o.NoRestore,
+		AllowBadImage:  o.AllowBadImage,
+		LeaveStopped:   o.LeaveStopped,
+		Verbose:        int(o.Verbose),
+		Envs:           o.Envs,
+	}
+}
+
+func checkpointOptionsToPb(o CheckpointOptions) *cmpb.CheckpointOptions {
+	return &cmpb.CheckpointOptions{
+		LeaveRunning:   o.LeaveRun,
+		PassphraseFile: o.Passphrase,
+		PreservedPaths: o.Preserve_path,
+		NumShards:      int32(o.Num_shards),
+		CpuBudget:      o.Cpu_budget,
+		Verbose:        int32(o.Verbose),
+		Envs:           o.Envs,
+		PreCopy:        int32(o.PreCopy),
+	}
+}
+
+func checkpointOptionsFromPb(o *cmpb.CheckpointOptions) CheckpointOptions {
+	if o == nil {
+		return CheckpointOptions{}
+	}
+	return CheckpointOptions{
+		LeaveRun:      o.LeaveRunning,
+		Passphrase:    o.PassphraseFile,
+		Preserve_path: o.PreservedPaths,
+		Num_shards:    int(o.NumShards),
+		Cpu_budget:    o.CpuBudget,
+		Verbose:       int(o.Verbose),
+		Envs:          o.Envs,
+		PreCopy:       int(o.PreCopy),
+	}
+}
+
+func retriesToPb(records []retryRecord) []*cmpb.RetryRecord {
+	var out []*cmpb.RetryRecord
+	for _, r := range records {
+		out = append(out, &cmpb.RetryRecord{Operation: r.Operation, Worker: r.Worker, Attempts: int32(r.Attempts), Reasons: r.Reasons, Succeeded: r.Succeeded})
+	}
+	return out
+}
+
+func decommissionToPb(d decommissionResp) *cmpb.DeleteWorkerResponse {
+	out := &cmpb.DeleteWorkerResponse{
+		Worker:   d.Worker,
+		Mode:     d.Mode,
+		Deleted:  d.Deleted,
+		Services: d.Services,
+		Removed:  d.Removed,
+		Errors:   d.Errors,
+		Retries:  retriesToPb(d.Retries),
+	}
+	for _, s := range d.Migrated {
+		out.Migrated = append(out.Migrated, &cmpb.MigrationStep{Service: s.Service, Src: s.Src, Dest: s.Dest, Status: s.Status, Outcome: s.Outcome, Duration: s.Duration, Error: s.Error})
+	}
+	for _, r := range d.Rehomed {
+		out.Rehomed = append(out.Rehomed, &cmpb.RehomedService{Service: r.Service, Image: r.Image, Worker: r.Worker, Error: r.Error})
+	}
+	return out
+}
+
+func eventToPb(e WebhookEvent) *cmpb.Event {
+	out := &cmpb.Event{Id: e.Id, Type: e.Type, Time: timestamppb.New(e.Time)}
+	if b, err := json.Marshal(e.Data); err == nil {
+		out.DataJson = string(b)
+	}
+	switch d := e.Data.(type) {
+	case workerEvent:
+		out.Worker, out.Status = d.Worker, d.Status
+	case MigrationRecord:
+		out.Worker, out.Service, out.Status = d.Dest, d.Service, d.Outcome
+	case checkpointEvent:
+		out.Worker, out.Service = d.Worker, d.Service
+		out.Status = strings.TrimPrefix(e.Type, "checkpoint.")
+	}
+	return out
+}
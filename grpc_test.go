@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cm_manager/cmpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// grpcClient serves the Manager with its interceptors on an in-memory
+// listener and returns a client of it
+func grpcClient(t *testing.T) cmpb.ManagerClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	)
+	cmpb.RegisterManagerServer(server, &grpcServer{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return cmpb.NewManagerClient(conn)
+}
+
+// withTokens enables authentication with the given token -> identity
+func withTokens(t *testing.T, tokens map[string]identity) {
+	t.Helper()
+	oldTokens := authTokens
+	authTokens = make(map[[32]byte]identity)
+	for token, id := range tokens {
+		authTokens[sha256.Sum256([]byte(token))] = id
+	}
+	t.Cleanup(func() { authTokens = oldTokens })
+}
+
+// withAudit writes the audit log to a temporary file and returns a function
+// reading its entries
+func withAudit(t *testing.T) func() []AuditEntry {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	oldWriter := auditWriter
+	auditWriter = &lumberjack.Logger{Filename: path}
+	t.Cleanup(func() {
+		auditWriter.Close()
+		auditWriter = oldWriter
+	})
+	return func() []AuditEntry {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var entries []AuditEntry
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Fatalf("audit line %q: %v", scanner.Text(), err)
+			}
+			entries = append(entries, e)
+		}
+		return entries
+	}
+}
+
+func withBearer(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPCRolesAndAudit(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		call     func(ctx context.Context, client cmpb.ManagerClient) error
+		wantCode codes.Code
+		audited  bool
+		status   int //of the audit entry
+	}{
+		{
+			name:     "reader lists services",
+			token:    "reader-token",
+			call:     listServices,
+			wantCode: codes.OK,
+		},
+		{
+			name:     "no token",
+			call:     listServices,
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "unknown token",
+			token:    "nope",
+			call:     listServices,
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "reader can't add a service",
+			token:    "reader-token",
+			call:     addServiceB,
+			wantCode: codes.PermissionDenied,
+			audited:  true,
+			status:   http.StatusForbidden,
+		},
+		{
+			name:     "admin adds a service",
+			token:    "admin-token",
+			call:     addServiceB,
+			wantCode: codes.OK,
+			audited:  true,
+			status:   http.StatusOK,
+		},
+		{
+			name:  "admin deletes a missing worker",
+			token: "admin-token",
+			call: func(ctx context.Context, client cmpb.ManagerClient) error {
+				_, err := client.DeleteWorker(ctx, &cmpb.DeleteWorkerRequest{WorkerId: "w9"})
+				return err
+			},
+			wantCode: codes.NotFound,
+			audited:  true,
+			status:   http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCluster(t, []string{"w1"}, "a")
+			withTokens(t, map[string]identity{
+				"reader-token": {Name: "ro", Role: roleReader, Via: "token"},
+				"admin-token":  {Name: "ops", Role: roleAdmin, Via: "token"},
+			})
+			entries := withAudit(t)
+			client := grpcClient(t)
+
+			err := tt.call(withBearer(tt.token), client)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %v (%v), want %v", code, err, tt.wantCode)
+			}
+			got := entries()
+			if !tt.audited {
+				if len(got) != 0 {
+					t.Errorf("audited %+v, want no entry", got)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("%d audit entries, want 1", len(got))
+			}
+			e := got[0]
+			if e.Listener != listenerGRPC || e.Method != "GRPC" || e.Status != tt.status {
+				t.Errorf("entry %+v, want listener %s, method GRPC and status %d", e, listenerGRPC, tt.status)
+			}
+			if wantOutcome := map[bool]string{true: "success", false: "failure"}[tt.wantCode == codes.OK]; e.Outcome != wantOutcome {
+				t.Errorf("outcome = %q, want %q", e.Outcome, wantOutcome)
+			}
+		})
+	}
+}
+
+func listServices(ctx context.Context, client cmpb.ManagerClient) error {
+	_, err := client.ListServices(ctx, &cmpb.ListServicesRequest{})
+	return err
+}
+
+func addServiceB(ctx context.Context, client cmpb.ManagerClient) error {
+	_, err := client.AddService(ctx, &cmpb.AddServiceRequest{Name: "b", Image: "registry/b"})
+	return err
+}
+
+func TestGRPCAddServiceAudit(t *testing.T) {
+	withCluster(t, []string{"w1"}, "a")
+	withTokens(t, map[string]identity{"admin-token": {Name: "ops", Role: roleAdmin, Via: "token"}})
+	entries := withAudit(t)
+	client := grpcClient(t)
+
+	if err := addServiceB(withBearer("admin-token"), client); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := getService("b"); !ok {
+		t.Error("service b not added")
+	}
+	got := entries()
+	if len(got) != 1 {
+		t.Fatalf("%d audit entries, want 1", len(got))
+	}
+	e := got[0]
+	if e.Caller != "ops" || e.Via != "token" || e.Route != "/cm_manager.v1.Manager/AddService" || e.Service != "b" {
+		t.Errorf("entry %+v, want caller ops by token on AddService of b", e)
+	}
+}
+
+func TestGRPCStatusMapping(t *testing.T) {
+	tests := []struct {
+		httpStatus int
+		code       codes.Code
+		back       int //status audited for the code
+	}{
+		{http.StatusBadRequest, codes.InvalidArgument, http.StatusBadRequest},
+		{http.StatusUnauthorized, codes.Unauthenticated, http.StatusUnauthorized},
+		{http.StatusForbidden, codes.PermissionDenied, http.StatusForbidden},
+		{http.StatusNotFound, codes.NotFound, http.StatusNotFound},
+		{http.StatusConflict, codes.Aborted, http.StatusConflict},
+		{http.StatusServiceUnavailable, codes.Unavailable, http.StatusServiceUnavailable},
+		{http.StatusInternalServerError, codes.Internal, http.StatusInternalServerError},
+		{http.StatusTeapot, codes.Internal, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.httpStatus), func(t *testing.T) {
+			err := grpcStatusError(tt.httpStatus, errors.New("boom"))
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("grpcStatusError(%d) = %v, want %v", tt.httpStatus, code, tt.code)
+			}
+			if msg := status.Convert(err).Message(); msg != "boom" {
+				t.Errorf("message = %q, want boom", msg)
+			}
+			if back := grpcHTTPStatus(tt.code); back != tt.back {
+				t.Errorf("grpcHTTPStatus(%v) = %d, want %d", tt.code, back, tt.back)
+			}
+		})
+	}
+	if got := grpcHTTPStatus(codes.OK); got != http.StatusOK {
+		t.Errorf("grpcHTTPStatus(OK) = %d, want 200", got)
+	}
+	if got := status.Code(grpcOpError(context.Background(), "op", fmt.Errorf("w1: %w", errWorkerUnavailable))); got != codes.Unavailable {
+		t.Errorf("unavailable worker gives %v, want Unavailable", got)
+	}
+}
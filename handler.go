@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"reflect"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -11,11 +12,12 @@ import (
 type workerReq struct {
 	Worker_id string `json:"worker_id"`
 	Addr      string `json:"addr"`
+	Capacity  int    `json:"capacity"`
 }
 
 type serviceReq struct {
-	Name  string `json:"name"`
-	Image string `json:"image"`
+	Name  string `json:"name"`  //service/instance adds an instance of the service
+	Image string `json:"image"` //defaults to the service's image for an instance
 }
 
 type MigrateBody struct {
@@ -26,12 +28,14 @@ type MigrateBody struct {
 }
 
 func upHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	response := "up"
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
 	c.JSON(http.StatusOK, gin.H{"msg": response})
 }
 func addWorkerHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	var requestBody workerReq
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
@@ -45,7 +49,10 @@ func addWorkerHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Worker already exists"})
 		return
 	}
-	addWorker(requestBody.Worker_id, requestBody.Addr, false)
+	addWorker(c.Request.Context(), requestBody.Worker_id, requestBody.Addr, false)
+	if requestBody.Capacity > 0 {
+		setWorkerCapacity(requestBody.Worker_id, requestBody.Capacity)
+	}
 
 	response := fmt.Sprintf("worker_id %s with address %s added", requestBody.Worker_id, requestBody.Addr)
 
@@ -55,6 +62,7 @@ func addWorkerHandler(c *gin.Context) {
 }
 
 func addServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	var requestBody serviceReq
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
@@ -67,15 +75,20 @@ func addServiceHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Service already exists"})
 		return
 	}
-	addService(requestBody.Name, requestBody.Image)
+	svc, err := addService(requestBody.Name, requestBody.Image)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	scanCheckpointFiles(1, requestBody.Name)
-	response := fmt.Sprintf("service %s with image %s added", requestBody.Name, requestBody.Image)
+	response := fmt.Sprintf("service %s with image %s added", svc.Name, svc.Image)
 
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
 	c.JSON(http.StatusOK, gin.H{"msg": response})
 }
 
 func startServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	worker_id := c.Param("worker_id")
 	service := c.Param("service")
@@ -90,22 +103,32 @@ func startServiceHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Service not found"})
 		return
 	}
+	if requestBody.ContainerName == "" {
+		requestBody.ContainerName = service
+	}
 	if requestBody.Image == "" {
 		requestBody.Image = services[requestBody.ContainerName].Image
 	}
-	err := startServiceContainer(workers[worker_id], requestBody)
+	ctx, release, ok := lockForRequest(c, []string{service}, "start", onWorkers(worker_id))
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
+	err := startServiceContainer(ctx, workers[worker_id], requestBody)
 	if err != nil {
 		logger.Error("Error starting container", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error starting container:" + err.Error()})
+		c.JSON(http.StatusBadRequest, retries.addTo(gin.H{"error": "Error starting container:" + err.Error()}))
 		return
 	}
 	response := fmt.Sprintf("Container of service %s with of worker %s started", requestBody.ContainerName, worker_id)
 
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
-	c.JSON(http.StatusOK, gin.H{"msg": response})
+	c.JSON(http.StatusOK, retries.addTo(gin.H{"msg": response}))
 }
 
 func runServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	worker_id := c.Param("worker_id")
 	service := c.Param("service")
@@ -115,21 +138,27 @@ func runServiceHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
 		return
 	}
-	runCount = 0
-	err := runService(workers[worker_id], services[service], requestBody)
+	ctx, release, ok := lockForRequest(c, []string{service}, "run", onWorkers(worker_id))
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
+	err := runService(ctx, workers[worker_id], services[service], requestBody)
 	if err != nil {
 		logger.Error("Error running service", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error running service:" + err.Error()})
+		c.JSON(http.StatusBadRequest, retries.addTo(gin.H{"error": "Error running service:" + err.Error()}))
 		return
 	}
 
 	response := fmt.Sprintf("service %s of worker %s is running", service, worker_id)
 
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
-	c.JSON(http.StatusOK, gin.H{"msg": response})
+	c.JSON(http.StatusOK, retries.addTo(gin.H{"msg": response}))
 }
 
 func checkpointServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	worker_id := c.Param("worker_id")
 	service := c.Param("service")
@@ -139,20 +168,27 @@ func checkpointServiceHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
 		return
 	}
+	ctx, release, ok := lockForRequest(c, []string{service}, "checkpoint", onWorkers(worker_id))
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
 
-	_, err := checkpointService(worker_id, services[service], requestBody)
+	_, err := checkpointService(ctx, worker_id, services[service], requestBody)
 	if err != nil {
 		logger.Error("Error checkpointing service", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error checkpointing service:" + err.Error()})
+		c.JSON(http.StatusBadRequest, retries.addTo(gin.H{"error": "Error checkpointing service:" + err.Error()}))
 		return
 	}
 	response := fmt.Sprintf("service %s of %s is checkpointed", service, worker_id)
 
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
-	c.JSON(http.StatusOK, gin.H{"msg": response})
+	c.JSON(http.StatusOK, retries.addTo(gin.H{"msg": response}))
 }
 
 func migrateServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	service := c.Param("service")
 	src := c.Query("src")
@@ -164,34 +200,62 @@ func migrateServiceHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
 		return
 	}
+	if dest == "" {
+		warm, sopt, ok := warmWorkerFor(service, src)
+		if !ok {
+			logger.Error("No destination given and no warm standby", zap.String("serviceName", service))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No destination given and no warm standby for the service"})
+			return
+		}
+		dest = warm
+		if reflect.DeepEqual(requestBody.Sopt, StartOptions{}) {
+			requestBody.Sopt = sopt
+		}
+	}
 	if requestBody.Sopt.Image == "" {
 		requestBody.Sopt.Image = services[requestBody.Sopt.ContainerName].Image
 	}
-	duration, err := migrateService(src, dest, services[service], requestBody.Copt, requestBody.Ropt, requestBody.Sopt, requestBody.Stop)
+	if c.Query("dry_run") == "true" {
+		res := preflightMigration(c.Request.Context(), src, dest, service, requestBody.Sopt, requestBody.Copt)
+		logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Bool("ok", res.Ok), zap.Int("status", http.StatusOK))
+		c.JSON(http.StatusOK, res)
+		return
+	}
+	ctx, release, ok := lockForRequest(c, []string{service}, "migrate", onWorkers(src, dest))
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
+	rec, err := migrateService(ctx, src, dest, services[service], requestBody.Copt, requestBody.Ropt, requestBody.Sopt, requestBody.Stop)
 	if err != nil {
 		logger.Error("Error migrating service", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error migrating service:" + err.Error()})
+		c.JSON(http.StatusBadRequest, retries.addTo(gin.H{"error": "Error migrating service:" + err.Error(), "state": rec.State, "failed_phase": rec.FailedPhase, "compensations": rec.Compensations}))
 		return
 	}
 
 	response := fmt.Sprintf("service %s migrated from %s to %s", service, src, dest)
 
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
-	c.JSON(http.StatusOK, gin.H{"msg": response, "duration": duration})
+	c.JSON(http.StatusOK, retries.addTo(gin.H{"msg": response, "duration": rec.Duration, "state": rec.State, "warnings": rec.Warnings}))
 }
 
 func getAllWorkersHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	var workerArr []Worker
-	for _, v := range workers {
-		updateWorkerServices(v.Id, "")
-		workerArr = append(workerArr, v)
+	for _, id := range workerIds() {
+		updateWorkerServices(c.Request.Context(), id, "")
+		if w, ok := getWorker(id); ok {
+			workerArr = append(workerArr, w)
+		}
 	}
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
 	c.JSON(http.StatusOK, workerArr)
 }
 
 func getAllServicesHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	var serviceArr []Service
 	for _, v := range services {
@@ -202,21 +266,24 @@ func getAllServicesHandler(c *gin.Context) {
 }
 
 func getWorkerHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	worker_id := c.Param("worker_id")
 
-	if _, ok := workers[worker_id]; !ok {
+	if _, ok := getWorker(worker_id); !ok {
 		logger.Error("Worker not found", zap.String("workerID", worker_id))
 		c.JSON(http.StatusNotFound, gin.H{"error": "Worker not found"})
 		return
 	}
-	updateWorkerServices(worker_id, "")
+	updateWorkerServices(c.Request.Context(), worker_id, "")
+	worker, _ := getWorker(worker_id)
 
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
-	c.JSON(http.StatusOK, workers[worker_id])
+	c.JSON(http.StatusOK, worker)
 }
 
 func getServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	service := c.Param("name")
 	if _, ok := services[service]; !ok {
@@ -230,42 +297,57 @@ func getServiceHandler(c *gin.Context) {
 }
 
 func removeServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	worker_id := c.Param("worker_id")
 	service := c.Param("service")
+	ctx, release, ok := lockForRequest(c, []string{service}, "remove", onWorkers(worker_id))
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
 
-	err := removeService(workers[worker_id], services[service])
+	err := removeService(ctx, workers[worker_id], services[service])
 	if err != nil {
 		logger.Error("Error removing service", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error removing service:" + err.Error()})
+		c.JSON(http.StatusBadRequest, retries.addTo(gin.H{"error": "Error removing service:" + err.Error()}))
 		return
 	}
 
 	response := fmt.Sprintf("service %s of %s is removed", service, worker_id)
 
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
-	c.JSON(http.StatusOK, gin.H{"msg": response})
+	c.JSON(http.StatusOK, retries.addTo(gin.H{"msg": response}))
 }
 
 func stopServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	worker_id := c.Param("worker_id")
 	service := c.Param("service")
+	ctx, release, ok := lockForRequest(c, []string{service}, "stop", onWorkers(worker_id))
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
 
-	err := stopService(workers[worker_id], services[service])
+	err := stopService(ctx, workers[worker_id], services[service])
 	if err != nil {
 		logger.Error("Error stopping service", zap.Error(err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error stopping service:" + err.Error()})
+		c.JSON(http.StatusBadRequest, retries.addTo(gin.H{"error": "Error stopping service:" + err.Error()}))
 		return
 	}
 
 	response := fmt.Sprintf("service %s of %s is stopped", service, worker_id)
 
 	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
-	c.JSON(http.StatusOK, gin.H{"msg": response})
+	c.JSON(http.StatusOK, retries.addTo(gin.H{"msg": response}))
 }
 
 func getServiceConfigHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
 	service := c.Param("name")
 	if _, ok := serviceConfigs[service]; !ok {
@@ -278,20 +360,40 @@ func getServiceConfigHandler(c *gin.Context) {
 }
 
 func deleteWorkerHandler(c *gin.Context) {
-	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "delete"), zap.String("path", c.Request.URL.Path))
 	worker_id := c.Param("worker_id")
 	if _, ok := workers[worker_id]; !ok {
 		logger.Error("Worker not found", zap.String("workerID", worker_id))
 		c.JSON(http.StatusNotFound, gin.H{"error": "Worker not found"})
 		return
 	}
-	deleteWorker(worker_id)
-	response := fmt.Sprintf("Worker %s deleted", worker_id)
-	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusNoContent))
-	c.JSON(http.StatusNoContent, gin.H{"msg": response})
+	mode := c.DefaultQuery("mode", decommissionRefuse)
+	if mode != decommissionRefuse && mode != decommissionDrain && mode != decommissionForce {
+		logger.Error("Invalid mode", zap.String("mode", mode))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode, use refuse, drain or force"})
+		return
+	}
+	if l, busy := workerBusy(worker_id); busy {
+		logger.Error("Worker busy", zap.String("workerID", worker_id), zap.String("service", l.Service), zap.String("operation", l.Operation))
+		c.JSON(http.StatusConflict, gin.H{"error": "Worker busy", "lock": l})
+		return
+	}
+	resp, status, err := decommission(c.Request.Context(), worker_id, mode, c.Query("wait") == "true")
+	if err != nil {
+		body := gin.H{"error": err.Error()}
+		if busy, ok := err.(errServiceBusy); ok {
+			body["lock"] = busy.holder
+		}
+		c.JSON(status, body)
+		return
+	}
+	logger.Debug("response", zap.String("method", "delete"), zap.String("path", c.Request.URL.Path), zap.Any("response", resp), zap.Int("status", status))
+	c.JSON(status, resp)
 }
 
 func deleteServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
 	serviceName := c.Param("name")
 	delChk := c.Query("delChk")
 	if _, ok := services[serviceName]; !ok {
@@ -299,7 +401,17 @@ func deleteServiceHandler(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
 		return
 	}
-	err := deleteService(serviceName)
+	if len(services[serviceName].Instances) > 0 {
+		logger.Error("Service has instances", zap.String("serviceName", serviceName), zap.Strings("instances", services[serviceName].Instances))
+		c.JSON(http.StatusConflict, gin.H{"error": "Service has instances, delete them first"})
+		return
+	}
+	ctx, release, ok := lockForRequest(c, []string{serviceName}, "delete", func(string) []string { return nil })
+	if !ok {
+		return
+	}
+	defer release()
+	err := deleteService(ctx, serviceName)
 	if err != nil {
 		logger.Error("Error deleting service", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting service:" + err.Error()})
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type migrationReq struct {
+	Service string `json:"service"`
+	Src     string `json:"src"`
+	Dest    string `json:"dest"` //empty to use a worker with a warm standby
+	MigrateBody
+}
+
+type checkpointImage struct {
+	Image string `json:"image"`
+	Size  int64  `json:"size"` //bytes, -1 when the image is not readable from the manager
+}
+
+type migrationResp struct {
+	Id       string        `json:"id"`
+	Service  string        `json:"service"`
+	Src      string        `json:"src"`
+	Dest     string        `json:"dest"`
+	Duration float64       `json:"duration"`
+	State    string        `json:"state"`
+	Warnings []string      `json:"warnings,omitempty"`
+	Retries  []retryRecord `json:"retries,omitempty"` //controller calls that needed more than one attempt
+}
+
+// migrationErr is returned when a migration did not complete, State tells
+// whether it was rolled back
+type migrationErr struct {
+	Error         string        `json:"error"`
+	Id            string        `json:"id"`
+	State         string        `json:"state"`
+	FailedPhase   string        `json:"failed_phase"`
+	Compensations []string      `json:"compensations,omitempty"`
+	Retries       []retryRecord `json:"retries,omitempty"`
+}
+
+func getWorkerServicesHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	worker_id := c.Param("worker_id")
+	if _, ok := workers[worker_id]; !ok {
+		logger.Error("Worker not found", zap.String("workerID", worker_id))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Worker not found"})
+		return
+	}
+	updateWorkerServices(c.Request.Context(), worker_id, "")
+
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, workers[worker_id].Services)
+}
+
+func getWorkerServiceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	worker_id := c.Param("worker_id")
+	service := c.Param("service")
+	if _, ok := workers[worker_id]; !ok {
+		logger.Error("Worker not found", zap.String("workerID", worker_id))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Worker not found"})
+		return
+	}
+	updateWorkerServices(c.Request.Context(), worker_id, service)
+	isIn, status := isServiceInWorker(workers[worker_id], service)
+	if !isIn {
+		logger.Error("Service not found on worker", zap.String("workerID", worker_id), zap.String("serviceName", service))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found on worker"})
+		return
+	}
+
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, ServiceInWorker{Name: service, Status: status})
+}
+
+type instanceReq struct {
+	Name  string `json:"name"`  //instance name, addressed as service/name afterwards
+	Image string `json:"image"` //defaults to the service's image
+}
+
+func getServiceInstancesHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	service := c.Param("name")
+	if _, ok := services[service]; !ok {
+		logger.Error("Service not found", zap.String("serviceName", service))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		return
+	}
+	instances := []Service{}
+	for _, name := range services[service].Instances {
+		instances = append(instances, services[service+instanceSep+name])
+	}
+
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, instances)
+}
+
+func addServiceInstanceHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "post"), zap.String("path", c.Request.URL.Path))
+	service := c.Param("name")
+	var requestBody instanceReq
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		logger.Error("Error decoding JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
+		return
+	}
+	if _, ok := services[service]; !ok {
+		logger.Error("Service not found", zap.String("serviceName", service))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		return
+	}
+	if _, instance := splitInstance(service); instance != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Instances can't have instances"})
+		return
+	}
+	name := service + instanceSep + requestBody.Name
+	svc, err := addService(name, requestBody.Image)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	scanCheckpointFiles(1, name)
+	response := fmt.Sprintf("instance %s with image %s added", name, svc.Image)
+
+	logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, gin.H{"msg": response})
+}
+
+func getServiceCheckpointsHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	service := c.Param("name")
+	if _, ok := services[service]; !ok {
+		logger.Error("Service not found", zap.String("serviceName", service))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		return
+	}
+
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, services[service].ChkFiles)
+}
+
+// getServiceCheckpointSizesHandler lists the images with their size, walked
+// once per image and cached afterwards
+func getServiceCheckpointSizesHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	svc, ok := getService(c.Param("name"))
+	if !ok {
+		logger.Error("Service not found", zap.String("serviceName", c.Param("name")))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		return
+	}
+	images := []checkpointImage{}
+	for _, img := range svc.ChkFiles {
+		size, err := checkpointImageSize(img)
+		if err != nil {
+			size = -1
+		}
+		images = append(images, checkpointImage{Image: img, Size: size})
+	}
+
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, images)
+}
+
+// prepareMigration checks the service and workers of a migration and fills in
+// the destination and start options left out. On failure it returns the
+// status to answer with.
+func prepareMigration(req *migrationReq) (int, error) {
+	service, ok := getService(req.Service)
+	if !ok {
+		return http.StatusNotFound, errors.New("Service not found")
+	}
+	if req.Dest == "" {
+		warm, sopt, ok := warmWorkerFor(req.Service, req.Src)
+		if !ok {
+			return http.StatusBadRequest, errors.New("No destination given and no warm standby for the service")
+		}
+		req.Dest = warm
+		if reflect.DeepEqual(req.Sopt, StartOptions{}) {
+			req.Sopt = sopt
+		}
+	}
+	for _, worker_id := range []string{req.Src, req.Dest} {
+		if _, ok := getWorker(worker_id); !ok {
+			return http.StatusNotFound, errors.New("Worker not found: " + worker_id)
+		}
+	}
+	// Without options the service starts on dest the way it ran on src
+	if reflect.DeepEqual(req.Sopt, StartOptions{}) {
+		req.Sopt = lastStartOptions(req.Src, req.Service)
+		if req.Sopt.Image == "" {
+			stateMu.Lock()
+			req.Sopt = serviceConfigs[req.Service].StartOpt
+			stateMu.Unlock()
+		}
+	}
+	if req.Sopt.ContainerName == "" {
+		req.Sopt.ContainerName = req.Service
+	}
+	if req.Sopt.Image == "" {
+		req.Sopt.Image = service.Image
+	}
+	return http.StatusOK, nil
+}
+
+func createMigrationHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "post"), zap.String("path", c.Request.URL.Path))
+	var requestBody migrationReq
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		logger.Error("Error decoding JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
+		return
+	}
+	if status, err := prepareMigration(&requestBody); err != nil {
+		logger.Error("Invalid migration", zap.String("serviceName", requestBody.Service), zap.Error(err))
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("dry_run") == "true" {
+		res := preflightMigration(c.Request.Context(), requestBody.Src, requestBody.Dest, requestBody.Service, requestBody.Sopt, requestBody.Copt)
+		logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Bool("ok", res.Ok), zap.Int("status", http.StatusOK))
+		c.JSON(http.StatusOK, res)
+		return
+	}
+	ctx, release, ok := lockForRequest(c, []string{requestBody.Service}, "migrate", onWorkers(requestBody.Src, requestBody.Dest))
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, retries := withRetryReport(ctx)
+	rec, err := migrateService(ctx, requestBody.Src, requestBody.Dest, services[requestBody.Service], requestBody.Copt, requestBody.Ropt, requestBody.Sopt, requestBody.Stop)
+	if err != nil {
+		logger.Error("Error migrating service", zap.Error(err))
+		c.JSON(http.StatusBadRequest, migrationErr{Error: "Error migrating service:" + err.Error(), Id: rec.Id, State: rec.State, FailedPhase: rec.FailedPhase, Compensations: rec.Compensations, Retries: retries.list()})
+		return
+	}
+
+	logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusCreated))
+	c.JSON(http.StatusCreated, migrationResp{Id: rec.Id, Service: requestBody.Service, Src: requestBody.Src, Dest: requestBody.Dest, Duration: rec.Duration, State: rec.State, Warnings: rec.Warnings, Retries: retries.list()})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrepareMigrationStartOptions(t *testing.T) {
+	last := StartOptions{ContainerName: "a", Image: "registry/a:last", Envs: []string{"LAST=1"}}
+	configured := StartOptions{ContainerName: "a", Image: "registry/a:conf", Envs: []string{"CONF=1"}}
+	given := StartOptions{ContainerName: "a2", Image: "registry/a:given"}
+	tests := []struct {
+		name       string
+		sopt       StartOptions
+		last       StartOptions
+		configured StartOptions
+		want       StartOptions
+	}{
+		{name: "given options are kept", sopt: given, last: last, configured: configured, want: given},
+		{name: "options a on the source last ran with", last: last, configured: configured, want: last},
+		{name: "configured options", configured: configured, want: configured},
+		{name: "defaults", want: StartOptions{ContainerName: "a", Image: "registry/a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCluster(t, []string{"w1", "w2"}, "a")
+			if !reflect.DeepEqual(tt.last, StartOptions{}) {
+				updateEditLastSopt("w1", "a", tt.last)
+			}
+			serviceConfigs["a"] = ServiceConfig{StartOpt: tt.configured}
+
+			req := migrationReq{Service: "a", Src: "w1", Dest: "w2", MigrateBody: MigrateBody{Sopt: tt.sopt}}
+			if _, err := prepareMigration(&req); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(req.Sopt, tt.want) {
+				t.Errorf("sopt = %+v, want %+v", req.Sopt, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -10,7 +11,10 @@ import (
 var mu sync.Mutex
 
 type heartbeatBody struct {
-	WorkerId string `json:"worker_id"`
+	WorkerId  string `json:"worker_id"`
+	Addr      string `json:"addr,omitempty"`       //controller address, registers or moves the worker with --auto-register
+	JoinToken string `json:"join_token,omitempty"` //needed with addr when the manager has a join token
+	Leaving   bool   `json:"leaving,omitempty"`    //the controller is shutting down, the worker is marked left
 }
 
 func heatbeatHandler(c *gin.Context) {
@@ -23,26 +27,59 @@ func heatbeatHandler(c *gin.Context) {
 		return
 	}
 	workerId := body.WorkerId
-	_, ok := workers[workerId]
-	if !ok {
+	worker, ok := getWorker(workerId)
+	addr := ""
+	if autoRegister && body.Addr != "" {
+		addr = heartbeatAddr(c, body.Addr)
+	}
+	if !ok && addr == "" {
 		c.IndentedJSON(400, gin.H{"error": "worker not found"})
 		return
 	}
-	setWorkerCountdown(workerId, 3)
-	setWorkerStatus(workerId, "up")
+	if workerId == "" {
+		c.IndentedJSON(400, gin.H{"error": "worker_id missing"})
+		return
+	}
+	if !ok || (addr != "" && addr != worker.IpAddrPort) {
+		if err := checkJoin(c, body, ok); err != nil {
+			logger.Warn("Heartbeat refused to join", zap.String("workerId", workerId), zap.String("addr", addr), zap.String("remote", c.RemoteIP()), zap.Error(err))
+			c.IndentedJSON(403, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := detachContext(c.Request.Context())
+		if !ok {
+			addWorker(ctx, workerId, addr, true)
+			logger.Info("Worker registered by heartbeat", zap.String("workerId", workerId), zap.String("addr", addr))
+		} else {
+			setWorkerAddr(workerId, addr)
+			logger.Info("Worker address changed", zap.String("workerId", workerId), zap.String("from", worker.IpAddrPort), zap.String("to", addr))
+		}
+		// Not while holding the heartbeat lock, the scan calls the controller
+		go scanServicesOnAWorker(ctx, workerId)
+	}
+	now := time.Now()
+	worker, _ = getWorker(workerId)
+	if last := worker.lastBeat; !last.IsZero() {
+		heartbeatInterval.WithLabelValues(workerId).Observe(now.Sub(last).Seconds())
+	}
+	setWorkerLastBeat(workerId, now)
+	if body.Leaving {
+		// Not a failure, the detector starts over when it comes back
+		detector.forget(workerId)
+		if worker.Status != workerLeft {
+			logger.Info("Worker leaving", zap.String("workerId", workerId))
+		}
+		setWorkerStatus(workerId, workerLeft)
+		c.Status(200)
+		return
+	}
+	detector.heartbeat(workerId, now)
+	if status := worker.Status; status != workerUp {
+		logger.Info("Worker up", zap.String("workerId", workerId), zap.String("from", status))
+	}
+	setWorkerStatus(workerId, workerUp)
+	breakerHeartbeat(workerId)
 	logger.Debug("Heartbeat received from worker", zap.String("workerId", workerId))
 	c.Status(200)
 
 }
-
-func updateCountdown() {
-	mu.Lock()
-	defer mu.Unlock()
-	for _, v := range workers {
-		v.countDown--
-		if v.countDown <= 0 {
-			setWorkerStatus(v.Id, "down")
-		}
-		setWorkerCountdown(v.Id, v.countDown)
-	}
-}
@@ -1,16 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 
 	"go.uber.org/zap"
 )
 
-func updateWorkerServices(worker_id string, service string) error {
-	worker, ok := workers[worker_id]
+func updateWorkerServices(ctx context.Context, worker_id string, service string) error {
+	worker, ok := getWorker(worker_id)
 	if !ok {
 		return errors.New("worker not found")
 	}
@@ -18,10 +20,16 @@ func updateWorkerServices(worker_id string, service string) error {
 		if service != "" && service != v.Name {
 			continue
 		}
-		status, err := queryServiceStatus(worker_id, v.Name)
-		if err != nil {
+		status, err := queryServiceStatus(ctx, worker_id, v.Name)
+		switch {
+		case err == nil:
+		case errors.Is(err, errServiceNotFound):
 			deleteRunService(worker_id, v.Name)
 			continue
+		default:
+			// Breaker open or no answer, the container may still be there
+			loggerFrom(ctx).Warn("Service status unknown", zap.String("workerID", worker_id), zap.String("serviceName", v.Name), zap.Error(err))
+			status = "unknown"
 		}
 		_, ok := lastChkRun[v.Name]
 		if ok {
@@ -38,21 +46,27 @@ func updateWorkerServices(worker_id string, service string) error {
 	return nil
 }
 
-func queryServiceStatus(worker_id string, service string) (string, error) {
-	_, ok := workers[worker_id]
+// errServiceNotFound is returned when the controller answers it has no
+// container for the service. Controllers answer 404, or 400 and 500 for some
+// missing containers; 502 to 504 only say the controller is unavailable.
+var errServiceNotFound = errors.New("service not found on worker")
+
+func queryServiceStatus(ctx context.Context, worker_id string, service string) (string, error) {
+	logger := loggerFrom(ctx)
+	worker, ok := getWorker(worker_id)
 	if !ok {
 		return "", errors.New("worker not found")
 	}
-	url := "http://" + workers[worker_id].IpAddrPort + "/cm_controller/v1/service/" + service
+	url := controllerURL(worker, "/service/"+containerName(service))
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		logger.Error("Error creating request", zap.Error(err))
 		return "", err
 	}
 	req.Close = true
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client := controllerClient
 	logger.Debug("Sending request to controller", zap.String("url", url))
 	resp, err := client.Do(req)
 	if err != nil {
@@ -81,20 +95,25 @@ func queryServiceStatus(worker_id string, service string) (string, error) {
 		}
 		return "", errors.New("status not found")
 	}
+	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode <= http.StatusInternalServerError {
+		return "", fmt.Errorf("%w: controller answered %d", errServiceNotFound, resp.StatusCode)
+	}
 	logger.Error("Error getting status from controller", zap.Int("status", resp.StatusCode))
 	return "", errors.New("error getting status from controller")
 }
 
-func isWorkerUp(worker_id string) bool {
-	url := "http://" + workers[worker_id].IpAddrPort + "/cm_controller/v1/up"
-	req, err := http.NewRequest("GET", url, nil)
+func isWorkerUp(ctx context.Context, worker_id string) bool {
+	logger := loggerFrom(ctx)
+	worker, _ := getWorker(worker_id)
+	url := controllerURL(worker, "/up")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		logger.Error("Error creating request", zap.Error(err))
 		return false
 	}
 	req.Close = true
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client := controllerClient
 	logger.Debug("Sending request to controller", zap.String("url", url))
 	resp, err := client.Do(req)
 	if err != nil {
@@ -120,6 +139,8 @@ func isServiceInWorker(worker Worker, service string) (bool, string) {
 }
 
 func updateEditLastSopt(worker_id string, service string, lastSopt StartOptions) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	worker := workers[worker_id]
 	worker.lastSopt[service] = lastSopt
 	workers[worker_id] = worker
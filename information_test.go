@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpdateWorkerServicesKeepsUnanswered(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, ctl *fakeController)
+		want  string //status of a on w1 afterwards, "" when dropped
+	}{
+		{name: "answered", want: "running"},
+		{
+			name:  "not found on the controller",
+			setup: func(t *testing.T, ctl *fakeController) { ctl.failOn("service", http.StatusNotFound) },
+			want:  "",
+		},
+		{
+			name:  "controller error for a missing container",
+			setup: func(t *testing.T, ctl *fakeController) { ctl.failOn("service", http.StatusInternalServerError) },
+			want:  "",
+		},
+		{
+			name:  "controller rejects the query",
+			setup: func(t *testing.T, ctl *fakeController) { ctl.failOn("service", http.StatusBadRequest) },
+			want:  "",
+		},
+		{
+			name:  "controller unavailable",
+			setup: func(t *testing.T, ctl *fakeController) { ctl.failOn("service", http.StatusServiceUnavailable) },
+			want:  "unknown",
+		},
+		{
+			name:  "controller unreachable",
+			setup: func(t *testing.T, ctl *fakeController) { ctl.srv.Close() },
+			want:  "unknown",
+		},
+		{
+			name: "breaker open",
+			setup: func(t *testing.T, ctl *fakeController) {
+				u, _ := url.Parse(ctl.srv.URL)
+				oldClient := controllerClient
+				controllerClient = &http.Client{Transport: breakerTransport{base: http.DefaultTransport}}
+				breakerMu.Lock()
+				breakers[u.Host] = &circuitBreaker{state: breakerOpen, failures: breakerThreshold, openedAt: time.Now()}
+				breakerMu.Unlock()
+				t.Cleanup(func() {
+					controllerClient = oldClient
+					breakerMu.Lock()
+					delete(breakers, u.Host)
+					breakerMu.Unlock()
+				})
+			},
+			want: "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctls := withCluster(t, []string{"w1"}, "a")
+			runOn(t, "w1", "a")
+			if tt.setup != nil {
+				tt.setup(t, ctls["w1"])
+			}
+
+			updateWorkerServices(context.Background(), "w1", "")
+			isIn, status := isServiceInWorker(workers["w1"], "a")
+			if tt.want == "" && isIn {
+				t.Errorf("a kept on w1 as %q, want it dropped", status)
+			}
+			if tt.want != "" && status != tt.want {
+				t.Errorf("a on w1 is %q (listed %v), want %q", status, isIn, tt.want)
+			}
+		})
+	}
+}
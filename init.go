@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -22,8 +25,157 @@ func manager_init() {
 			servicePath := args[i+1]
 			service_init(servicePath)
 		}
+		if args[i] == "--auth-tokens" {
+			auth_tokens_init(args[i+1])
+		}
+		if args[i] == "--auth-certs" {
+			auth_certs_init(args[i+1])
+		}
+		if args[i] == "--auth-unix" {
+			authUnix = true
+		}
+		if args[i] == "--tls-cert" {
+			tlsCertFile = args[i+1]
+		}
+		if args[i] == "--tls-key" {
+			tlsKeyFile = args[i+1]
+		}
+		if args[i] == "--tls-client-ca" {
+			tlsClientCAFile = args[i+1]
+		}
+		if args[i] == "--controller-ca" {
+			controllerCAFile = args[i+1]
+		}
+		if args[i] == "--controller-cert" {
+			controllerCertFile = args[i+1]
+		}
+		if args[i] == "--controller-key" {
+			controllerKeyFile = args[i+1]
+		}
+		if args[i] == "--trace-otlp" {
+			traceOTLPEndpoint = args[i+1]
+		}
+		if args[i] == "--trace-file" {
+			traceFile = args[i+1]
+		}
+		if args[i] == "--trace-sample" {
+			traceSampleRatio, _ = strconv.ParseFloat(args[i+1], 64)
+		}
+		if args[i] == "--standby-interval" {
+			if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+				standbyInterval = d
+			}
+		}
+		if args[i] == "--retry-policy" {
+			retry_policy_init(args[i+1])
+		}
+		if args[i] == "--auto-register" {
+			autoRegister = true
+		}
+		if args[i] == "--join-token-file" {
+			join_token_init(args[i+1])
+		}
+		if args[i] == "--join-cidrs" {
+			join_cidrs_init(args[i+1])
+		}
+		if args[i] == "--failure-detector" {
+			detectorKind = args[i+1]
+		}
+		if args[i] == "--fd-interval" {
+			if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+				detectorInterval = d
+			}
+		}
+		if args[i] == "--fd-suspect-after" {
+			if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+				fdSuspectAfter = d
+			}
+		}
+		if args[i] == "--fd-down-after" {
+			if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+				fdDownAfter = d
+			}
+		}
+		if args[i] == "--fd-phi-suspect" {
+			if v, err := strconv.ParseFloat(args[i+1], 64); err == nil && v > 0 {
+				fdPhiSuspect = v
+			}
+		}
+		if args[i] == "--fd-phi-down" {
+			if v, err := strconv.ParseFloat(args[i+1], 64); err == nil && v > 0 {
+				fdPhiDown = v
+			}
+		}
+		if args[i] == "--fd-heartbeat-interval" {
+			if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+				fdHeartbeatInterval = d
+			}
+		}
+		if args[i] == "--breaker-threshold" {
+			if n, err := strconv.Atoi(args[i+1]); err == nil && n > 0 {
+				breakerThreshold = n
+			}
+		}
+		if args[i] == "--breaker-cooldown" {
+			if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+				breakerCooldown = d
+			}
+		}
+		if args[i] == "--lock-wait" {
+			if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+				lockWaitTimeout = d
+			}
+		}
+		if args[i] == "--op-timeout" {
+			if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+				opTimeout = d
+			}
+		}
+		if args[i] == "--migration-history" {
+			migrationHistoryPath = args[i+1]
+		}
+		if args[i] == "--migration-history-max" {
+			migrationHistoryMax, _ = strconv.Atoi(args[i+1])
+		}
+		if args[i] == "--no-dashboard" {
+			dashboardEnabled = false
+		}
+		if args[i] == "--grpc-addr" {
+			grpcAddr = args[i+1]
+		}
+		if args[i] == "--webhooks" {
+			webhooksPath = args[i+1]
+		}
+		if args[i] == "--audit-log" {
+			auditPath = args[i+1]
+		}
+		if args[i] == "--audit-max-size" {
+			auditMaxSize, _ = strconv.Atoi(args[i+1])
+		}
+		if args[i] == "--audit-max-backups" {
+			auditMaxBackups, _ = strconv.Atoi(args[i+1])
+		}
+		if args[i] == "--audit-max-age" {
+			auditMaxAge, _ = strconv.Atoi(args[i+1])
+		}
+	}
+	if autoRegister && joinToken == "" && len(joinCIDRs) == 0 {
+		logger.Warn("Auto-registration is open to any host and known workers can't move, set --join-token-file or --join-cidrs")
 	}
-	scanServicesOnWorkers()
+	failure_detector_init()
+	audit_init()
+	migration_history_init()
+	webhooks_init()
+	if err := controller_tls_init(); err != nil {
+		logger.Fatal("Error loading controller TLS configuration", zap.Error(err))
+	}
+	instrumentControllerClient()
+	tracing_init()
+	traceControllerClient()
+	forwardRequestID()
+	retryControllerClient()
+	breakControllerClient()
+	scanServicesOnWorkers(context.Background())
 	scanCheckpointFiles(0, "")
 }
 
@@ -49,7 +201,13 @@ func worker_init(workerPath string) {
 		if worker_id == "" || addr == "" {
 			continue
 		}
-		addWorker(worker_id, addr, true)
+		addWorker(context.Background(), worker_id, addr, true)
+		// Optional third column: capacity
+		if values := strings.Fields(line); len(values) >= 3 {
+			if capacity, err := strconv.Atoi(values[2]); err == nil {
+				setWorkerCapacity(worker_id, capacity)
+			}
+		}
 	}
 
 	// Check for errors during scanning
@@ -89,11 +247,12 @@ func service_init(servicePath string) {
 	}
 }
 
-func scanServicesOnWorkers() {
+func scanServicesOnWorkers(ctx context.Context) {
+	logger := loggerFrom(ctx)
 	for _, worker := range workers {
 		worker_id := worker.Id
 		for _, v := range services {
-			status, err := queryServiceStatus(worker_id, v.Name)
+			status, err := queryServiceStatus(ctx, worker_id, v.Name)
 			if err != nil {
 				continue
 			}
@@ -105,9 +264,10 @@ func scanServicesOnWorkers() {
 		}
 	}
 }
-func scanServicesOnAWorker(worker_id string) {
+func scanServicesOnAWorker(ctx context.Context, worker_id string) {
+	logger := loggerFrom(ctx)
 	for _, v := range services {
-		status, err := queryServiceStatus(worker_id, v.Name)
+		status, err := queryServiceStatus(ctx, worker_id, v.Name)
 		if err != nil {
 			continue
 		}
@@ -142,7 +302,7 @@ func scanCheckpointFiles(mode int, service string) {
 	//mode = 0 -> scan all services
 	//mode = 1 -> scan specific service
 	logger.Debug("Checking services' checkpoints")
-	dirPath := "/mnt/checkpointfs/"
+	dirPath := checkpointMount
 	dirEntries, err := os.ReadDir(dirPath)
 	if err != nil {
 		logger.Error("Error reading services dir", zap.Error(err))
@@ -155,7 +315,7 @@ func scanCheckpointFiles(mode int, service string) {
 		}
 
 		dirName := dirEntry.Name()
-		if mode == 1 && dirName != service {
+		if mode == 1 && dirName != checkpointDir(service) {
 			continue
 		}
 		servEntries, err := os.ReadDir(dirPath + dirName)
@@ -167,16 +327,23 @@ func scanCheckpointFiles(mode int, service string) {
 				continue
 			}
 			fileName := servEntry.Name()
+			if preCopyImageRe.MatchString(fileName) {
+				continue
+			}
 			fields := strings.Split(fileName, "_")
 
 			if len(fields) >= 1 {
-				serviceName := fields[0]
+				// Instances keep their images in the service's directory
+				serviceName := serviceOfContainer(fields[0])
+				if mode == 1 && serviceName != service {
+					continue
+				}
 				if _, ok := services[serviceName]; ok {
-					addCheckpointFile(serviceName, "file:/checkpointfs/"+serviceName+"/"+fileName)
+					addCheckpointFile(serviceName, "file:/checkpointfs/"+dirName+"/"+fileName)
 				}
 			}
 		}
-		if mode == 1 && dirName == service {
+		if mode == 1 && dirName == checkpointDir(service) {
 			break
 		}
 	}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// A service can have named instances, each its own container with its own
+// status, checkpoints and migrations. An instance is addressed as
+// "service/instance" (URL-encoded in paths, svc%2Fa) and is registered in
+// services under that name, so locks, configs, standbys and the migration
+// history work on it as on a service. Services without instances run a
+// single container named after the service, as before.
+//
+// Container names can't hold a slash: on the controllers and in checkpoint
+// file names the instance is "service.instance", its checkpoints are kept in
+// the service's directory.
+const instanceSep = "/"
+
+var instanceNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// splitInstance returns the service and instance of name, instance is empty
+// for a plain service
+func splitInstance(name string) (string, string) {
+	if i := strings.Index(name, instanceSep); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// containerName is the name of the service or instance on the controllers
+func containerName(name string) string {
+	service, instance := splitInstance(name)
+	if instance == "" {
+		return service
+	}
+	return service + "." + instance
+}
+
+// serviceOfContainer maps a container name back to the service or instance
+// it runs
+func serviceOfContainer(container string) string {
+	if _, ok := services[container]; ok {
+		return container
+	}
+	if i := strings.LastIndex(container, "."); i >= 0 {
+		name := container[:i] + instanceSep + container[i+1:]
+		if _, ok := services[name]; ok {
+			return name
+		}
+	}
+	return container
+}
+
+// checkpointDir is the directory under /checkpointfs holding the images
+func checkpointDir(name string) string {
+	service, _ := splitInstance(name)
+	return service
+}
+
+// checkNewService tells why name can't be added as a service or instance
+func checkNewService(name string) error {
+	if _, ok := services[name]; ok {
+		return errors.New("Service already existed")
+	}
+	if other := serviceOfContainer(containerName(name)); other != name {
+		if _, ok := services[other]; ok {
+			return errors.New("Service " + other + " already runs in container " + containerName(name))
+		}
+	}
+	service, instance := splitInstance(name)
+	if instance == "" {
+		return nil
+	}
+	if _, ok := services[service]; !ok {
+		return errors.New("Service " + service + " not found, add it before its instances")
+	}
+	if !instanceNameRe.MatchString(instance) {
+		return errors.New("Invalid instance name, use letters, digits and dashes")
+	}
+	return nil
+}
+
+// addInstanceTo records a new instance in its service, stateMu must be held
+func addInstanceTo(name string) {
+	service, instance := splitInstance(name)
+	parent := services[service]
+	parent.Instances = append(parent.Instances, instance)
+	services[service] = parent
+}
+
+// removeInstanceFrom forgets a deleted instance, stateMu must be held
+func removeInstanceFrom(name string) {
+	service, instance := splitInstance(name)
+	parent, ok := services[service]
+	if !ok || instance == "" {
+		return
+	}
+	for i, v := range parent.Instances {
+		if v == instance {
+			parent.Instances = append(parent.Instances[:i:i], parent.Instances[i+1:]...)
+			break
+		}
+	}
+	services[service] = parent
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitInstance(t *testing.T) {
+	tests := []struct {
+		name      string
+		service   string
+		instance  string
+		container string
+		dir       string
+	}{
+		{name: "web", service: "web", container: "web", dir: "web"},
+		{name: "web/a", service: "web", instance: "a", container: "web.a", dir: "web"},
+		{name: "web.v2", service: "web.v2", container: "web.v2", dir: "web.v2"},
+		{name: "web.v2/blue-1", service: "web.v2", instance: "blue-1", container: "web.v2.blue-1", dir: "web.v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, instance := splitInstance(tt.name)
+			if service != tt.service || instance != tt.instance {
+				t.Errorf("splitInstance = %q, %q, want %q, %q", service, instance, tt.service, tt.instance)
+			}
+			if got := containerName(tt.name); got != tt.container {
+				t.Errorf("containerName = %q, want %q", got, tt.container)
+			}
+			if got := checkpointDir(tt.name); got != tt.dir {
+				t.Errorf("checkpointDir = %q, want %q", got, tt.dir)
+			}
+		})
+	}
+}
+
+func TestServiceOfContainer(t *testing.T) {
+	withCluster(t, nil, "web", "web/a", "api.v2", "api.v2/b", "db.main")
+	tests := []struct {
+		container string
+		want      string
+	}{
+		{container: "web", want: "web"},
+		{container: "web.a", want: "web/a"},
+		{container: "api.v2", want: "api.v2"},
+		{container: "api.v2.b", want: "api.v2/b"},
+		{container: "db.main", want: "db.main"},
+		{container: "web.unknown", want: "web.unknown"},
+		{container: "other", want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.container, func(t *testing.T) {
+			if got := serviceOfContainer(tt.container); got != tt.want {
+				t.Errorf("serviceOfContainer(%q) = %q, want %q", tt.container, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckNewService(t *testing.T) {
+	withCluster(t, nil, "web", "web/a", "db.main")
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{name: "api"},
+		{name: "web/b"},
+		{name: "web", wantErr: "already existed"},
+		{name: "web/a", wantErr: "already existed"},
+		{name: "web.a", wantErr: "Service web/a already runs in container web.a"},
+		{name: "db/main", wantErr: "Service db.main already runs in container db.main"},
+		{name: "cache/main", wantErr: "Service cache not found"},
+		{name: "web/b_1", wantErr: "Invalid instance name"},
+		{name: "web/-b", wantErr: "Invalid instance name"},
+		{name: "web/", wantErr: "Service web already runs in container web"},
+		{name: "web/a/b", wantErr: "Invalid instance name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkNewService(tt.name)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("err = %v, want none", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+var lockWaitTimeout = 5 * time.Minute //how long a queued request waits for the lock
+var opTimeout = 10 * time.Minute      //deadline of an operation holding a lock
+
+// ServiceLock describes the operation holding a service
+type ServiceLock struct {
+	Service   string    `json:"service"`
+	Operation string    `json:"operation"`
+	Workers   []string  `json:"workers"`
+	RequestId string    `json:"request_id,omitempty"`
+	Since     time.Time `json:"since"`
+	Waiting   int       `json:"waiting"` //requests queued behind it
+}
+
+type errServiceBusy struct {
+	holder ServiceLock
+}
+
+func (e errServiceBusy) Error() string {
+	return fmt.Sprintf("service %s is busy with %s since %s", e.holder.Service, e.holder.Operation, e.holder.Since.Format(time.RFC3339))
+}
+
+var lockMu sync.Mutex
+var lockSlots = make(map[string]chan struct{})
+var lockHolders = make(map[string]ServiceLock)
+var lockWaiters = make(map[string]int)
+
+// acquireServiceLock takes the lock of service for op, acting on workers.
+// When it is held it fails with errServiceBusy, or with wait queues until
+// it is free or lockWaitTimeout passes. The returned release is idempotent.
+func acquireServiceLock(ctx context.Context, service string, op string, workers []string, wait bool) (func(), error) {
+	lockMu.Lock()
+	slot, ok := lockSlots[service]
+	if !ok {
+		slot = make(chan struct{}, 1)
+		lockSlots[service] = slot
+	}
+	lockMu.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+	default:
+		lockMu.Lock()
+		holder := lockHolders[service]
+		if !wait {
+			lockMu.Unlock()
+			return nil, errServiceBusy{holder: holder}
+		}
+		lockWaiters[service]++
+		lockMu.Unlock()
+		loggerFrom(ctx).Info("Waiting for service lock", zap.String("service", service), zap.String("operation", op), zap.String("holder", holder.Operation))
+
+		timer := time.NewTimer(lockWaitTimeout)
+		defer timer.Stop()
+		var err error
+		select {
+		case slot <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timer.C:
+			lockMu.Lock()
+			err = errServiceBusy{holder: lockHolders[service]}
+			lockMu.Unlock()
+		}
+		lockMu.Lock()
+		lockWaiters[service]--
+		lockMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lockMu.Lock()
+	lockHolders[service] = ServiceLock{Service: service, Operation: op, Workers: workers, RequestId: requestIDFrom(ctx), Since: time.Now().UTC()}
+	lockMu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lockMu.Lock()
+			delete(lockHolders, service)
+			lockMu.Unlock()
+			<-slot
+		})
+	}, nil
+}
+
+// lockServices takes the locks of several services, all or none
+func lockServices(ctx context.Context, names []string, op string, workersOf func(string) []string, wait bool) (func(), error) {
+	seen := make(map[string]bool)
+	sorted := []string{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted) //same order everywhere so that waiting cannot deadlock
+	var releases []func()
+	releaseAll := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	for _, name := range sorted {
+		release, err := acquireServiceLock(ctx, name, op, workersOf(name), wait)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releaseAll, nil
+}
+
+func serviceLocks() []ServiceLock {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	locks := []ServiceLock{}
+	for name, l := range lockHolders {
+		l.Waiting = lockWaiters[name]
+		locks = append(locks, l)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Service < locks[j].Service })
+	return locks
+}
+
+// workerBusy returns a lock held by an operation acting on worker
+func workerBusy(worker string) (ServiceLock, bool) {
+	for _, l := range serviceLocks() {
+		for _, w := range l.Workers {
+			if w == worker {
+				return l, true
+			}
+		}
+	}
+	return ServiceLock{}, false
+}
+
+// lockForOperation takes the locks of services for op. The returned context
+// carries the operation's deadline, release also cancels it.
+func lockForOperation(ctx context.Context, services []string, op string, workersOf func(string) []string, wait bool) (context.Context, func(), error) {
+	release, err := lockServices(ctx, services, op, workersOf, wait)
+	if err != nil {
+		loggerFrom(ctx).Error("Service busy", zap.Strings("services", services), zap.String("operation", op), zap.Error(err))
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	return ctx, func() {
+		cancel()
+		release()
+	}, nil
+}
+
+// lockForRequest takes the locks of services for the request's operation,
+// queuing when the request has wait=true. On failure it responds 409 and
+// returns false.
+func lockForRequest(c *gin.Context, services []string, op string, workersOf func(string) []string) (context.Context, func(), bool) {
+	ctx, release, err := lockForOperation(c.Request.Context(), services, op, workersOf, c.Query("wait") == "true")
+	if err != nil {
+		resp := gin.H{"error": err.Error()}
+		if busy, ok := err.(errServiceBusy); ok {
+			resp["lock"] = busy.holder
+		}
+		c.JSON(http.StatusConflict, resp)
+		return nil, nil, false
+	}
+	return ctx, release, true
+}
+
+// onWorkers is a workersOf for operations acting on the same workers for
+// every service
+func onWorkers(ids ...string) func(string) []string {
+	return func(string) []string { return ids }
+}
+
+func getLocksHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	locks := serviceLocks()
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, locks)
+}
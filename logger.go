@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var once sync.Once
 var logger *zap.Logger
+var logLevel zap.AtomicLevel
+
+const requestIDHeader = "X-Request-ID"
+
+type loggerKey struct{}
+type requestIDKey struct{}
 
 func getGlobalLogger() *zap.Logger {
 	once.Do(func() {
@@ -43,11 +58,25 @@ func initLogger() *zap.Logger {
 
 	// Creating console and file write syncers
 	consoleDebugging := zapcore.Lock(os.Stdout)
-	file, err := os.Create("cm_controller.log")
-	if err != nil {
-		panic(err)
+	fileWriter := &lumberjack.Logger{
+		Filename:   envOr("LOG_FILE", "cm_manager.log"),
+		MaxSize:    envIntOr("LOG_MAX_SIZE", 100), //megabytes
+		MaxBackups: envIntOr("LOG_MAX_BACKUPS", 10),
+		MaxAge:     envIntOr("LOG_MAX_AGE", 30), //days
 	}
-	fileDebugging := zapcore.AddSync(file)
+	if every := os.Getenv("LOG_ROTATE_EVERY"); every != "" {
+		interval, err := time.ParseDuration(every)
+		if err != nil || interval <= 0 {
+			log.Println(fmt.Errorf("invalid LOG_ROTATE_EVERY, time based rotation disabled: %v", every))
+		} else {
+			go func() {
+				for range time.Tick(interval) {
+					fileWriter.Rotate()
+				}
+			}()
+		}
+	}
+	fileDebugging := zapcore.AddSync(fileWriter)
 
 	//Setting log level
 	level := zap.InfoLevel
@@ -62,7 +91,8 @@ func initLogger() *zap.Logger {
 
 		level = levelFromEnv
 	}
-	logLevel := zap.NewAtomicLevelAt(level)
+	// Shared by both cores so the level can be changed at runtime
+	logLevel = zap.NewAtomicLevelAt(level)
 
 	// Creating core
 	core := zapcore.NewTee(
@@ -75,3 +105,90 @@ func initLogger() *zap.Logger {
 
 	return logger
 }
+
+func envOr(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envIntOr(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware tags each request with an id, taken from the client's
+// X-Request-ID when given, and attaches a logger carrying it to the request
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		c.Header(requestIDHeader, id)
+		c.Set("request_id", id)
+		reqLogger := logger.With(zap.String("request_id", id))
+		ctx := context.WithValue(c.Request.Context(), requestIDKey{}, id)
+		ctx = context.WithValue(ctx, loggerKey{}, reqLogger)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// loggerFrom returns the request's logger, with the trace id once a span is
+// attached, or the global logger outside of a request
+func loggerFrom(ctx context.Context) *zap.Logger {
+	l, ok := ctx.Value(loggerKey{}).(*zap.Logger)
+	if !ok {
+		l = logger
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With(zap.String("trace_id", sc.TraceID().String()))
+	}
+	return l
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDTransport forwards the request id to the controllers
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestIDFrom(req.Context()); id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(requestIDHeader, id)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func forwardRequestID() {
+	base := controllerClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	controllerClient.Transport = requestIDTransport{base: base}
+}
+
+// logLevelHandler serves GET (current level) and PUT {"level":"debug"}
+func logLevelHandler(c *gin.Context) {
+	if c.Request.Method == http.MethodPut {
+		logger.Info("Changing log level", zap.String("caller", identityOf(c).Name))
+	}
+	logLevel.ServeHTTP(c.Writer, c.Request)
+}
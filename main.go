@@ -1,18 +1,34 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
 func main() {
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--gen-openapi" && i+1 < len(args) {
+			if err := writeOpenAPISpec(args[i+1]); err != nil {
+				fmt.Printf("Error writing OpenAPI document: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	manager_init()
 	socketPath := "/var/run/cm_man.sock"
 
@@ -31,33 +47,73 @@ func main() {
 	logger.Info("Listening on Unix socket", zap.String("path", socketPath))
 
 	router := gin.New()
+	// Instances are addressed as service/instance, the slash is escaped in paths
+	router.UseRawPath = true
 
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowAllOrigins = true
+	corsConfig.AddAllowHeaders("Authorization", requestIDHeader)
+	corsConfig.AddExposeHeaders(requestIDHeader)
 	router.Use(
-		gin.LoggerWithWriter(gin.DefaultWriter, "/cm_manager/v1.0/heartbeat"),
+		gin.LoggerWithWriter(gin.DefaultWriter, "/cm_manager/v1.0/heartbeat", apiV2Prefix+"/heartbeat"),
 		gin.Recovery(),
-		cors.Default(),
+		requestIDMiddleware(),
+		cors.New(corsConfig),
+		tracingMiddleware(),
+		metricsMiddleware(),
+		auditMiddleware(),
+		authenticate(),
 	)
 
-	router.GET("/cm_manager/v1.0/up", upHandler)
-	router.POST("/cm_manager/v1.0/worker", addWorkerHandler)
-	router.GET("/cm_manager/v1.0/worker", getAllWorkersHandler)
-	router.GET("/cm_manager/v1.0/worker/:worker_id", getWorkerHandler)
-	router.DELETE("/cm_manager/v1.0/worker/:worker_id", deleteWorkerHandler)
-	router.POST("/cm_manager/v1.0/service", addServiceHandler)
-	router.GET("/cm_manager/v1.0/service", getAllServicesHandler)
-	router.GET("/cm_manager/v1.0/service/:name", getServiceHandler)
-	router.DELETE("/cm_manager/v1.0/service/:name", deleteServiceHandler)
-	router.GET("/cm_manager/v1.0/service/:name/config", getServiceConfigHandler)
-	router.POST("/cm_manager/v1.0/start/:worker_id/:service", startServiceHandler)
-	router.POST("/cm_manager/v1.0/run/:worker_id/:service", runServiceHandler)
-	router.POST("/cm_manager/v1.0/checkpoint/:worker_id/:service", checkpointServiceHandler)
-	router.POST("/cm_manager/v1.0/migrate/:service", migrateServiceHandler)
-	router.DELETE("/cm_manager/v1.0/remove/:worker_id/:service", removeServiceHandler)
-	router.POST("/cm_manager/v1.0/stop/:worker_id/:service", stopServiceHandler)
+	reader := requireRole(roleReader)
+	operator := requireRole(roleOperator)
+	admin := requireRole(roleAdmin)
 
+	router.GET("/cm_manager/v1.0/up", upHandler)
+	router.POST("/cm_manager/v1.0/worker", admin, addWorkerHandler)
+	router.GET("/cm_manager/v1.0/worker", reader, getAllWorkersHandler)
+	router.GET("/cm_manager/v1.0/worker/:worker_id", reader, getWorkerHandler)
+	router.DELETE("/cm_manager/v1.0/worker/:worker_id", admin, deleteWorkerHandler)
+	router.POST("/cm_manager/v1.0/service", admin, addServiceHandler)
+	router.GET("/cm_manager/v1.0/service", reader, getAllServicesHandler)
+	router.GET("/cm_manager/v1.0/service/:name", reader, getServiceHandler)
+	router.DELETE("/cm_manager/v1.0/service/:name", admin, deleteServiceHandler)
+	router.GET("/cm_manager/v1.0/service/:name/config", reader, getServiceConfigHandler)
+	router.GET("/cm_manager/v1.0/service/:name/standby", reader, getStandbyHandler)
+	router.PUT("/cm_manager/v1.0/service/:name/standby", admin, setStandbyHandler)
+	router.POST("/cm_manager/v1.0/service/:name/clone", admin, cloneServiceHandler)
+	router.GET("/cm_manager/v1.0/service/:name/migrations", reader, getServiceMigrationsHandler)
+	router.GET("/cm_manager/v1.0/service/:name/migrations/stats", reader, getMigrationStatsHandler)
+	router.GET("/cm_manager/v1.0/migration/stats", reader, getMigrationStatsHandler)
+	router.POST("/cm_manager/v1.0/rebalance/plan", reader, rebalanceHandler(true))
+	router.POST("/cm_manager/v1.0/rebalance", operator, rebalanceHandler(false))
+	router.POST("/cm_manager/v1.0/start/:worker_id/:service", operator, startServiceHandler)
+	router.POST("/cm_manager/v1.0/run/:worker_id/:service", operator, runServiceHandler)
+	router.POST("/cm_manager/v1.0/checkpoint/:worker_id/:service", operator, checkpointServiceHandler)
+	router.POST("/cm_manager/v1.0/migrate/:service", operator, migrateServiceHandler)
+	router.POST("/cm_manager/v1.0/migrate", operator, batchMigrationHandler)
+	router.DELETE("/cm_manager/v1.0/remove/:worker_id/:service", operator, removeServiceHandler)
+	router.POST("/cm_manager/v1.0/stop/:worker_id/:service", operator, stopServiceHandler)
+	router.GET("/cm_manager/v1.0/locks", reader, getLocksHandler)
+	router.GET("/cm_manager/v1.0/audit", admin, getAuditHandler)
+	router.GET("/cm_manager/v1.0/webhook", admin, getWebhooksHandler)
+	router.POST("/cm_manager/v1.0/webhook", admin, addWebhookHandler)
+	router.GET("/cm_manager/v1.0/webhook/:id", admin, getWebhookHandler)
+	router.DELETE("/cm_manager/v1.0/webhook/:id", admin, deleteWebhookHandler)
+	router.GET("/cm_manager/v1.0/webhook/:id/deliveries", admin, getWebhookDeliveriesHandler)
+	router.POST("/cm_manager/v1.0/webhook/:id/test", admin, testWebhookHandler)
+	router.GET("/metrics", reader, gin.WrapH(promhttp.Handler()))
+	router.GET("/cm_manager/v1.0/log/level", reader, logLevelHandler)
+	router.PUT("/cm_manager/v1.0/log/level", admin, logLevelHandler)
+
+	// Heartbeats come from the controllers and stay unauthenticated
 	router.POST("/cm_manager/v1.0/heartbeat", heatbeatHandler)
 
-	go http.Serve(listener, router)
+	registerV2Routes(router)
+	registerDashboard(router)
+
+	unixServer := &http.Server{Handler: router, ConnContext: withListener(listenerUnix)}
+	go unixServer.Serve(listener)
 
 	// Create another server on a different port but use the same handler
 	anotherListener, err := net.Listen("tcp", ":8080")
@@ -67,16 +123,46 @@ func main() {
 	}
 	defer anotherListener.Close()
 
-	logger.Info("Listening on TCP socket", zap.String("port", "8080"))
+	tlsConfig, err := listenerTLSConfig()
+	if err != nil {
+		fmt.Printf("Error loading TLS configuration: %v\n", err)
+		return
+	}
+	if tlsConfig != nil {
+		anotherListener = tls.NewListener(anotherListener, tlsConfig)
+	}
+	if !authEnabled() {
+		logger.Warn("No API tokens or client certificates configured, TCP listener is unauthenticated")
+	}
+
+	logger.Info("Listening on TCP socket", zap.String("port", "8080"), zap.Bool("tls", tlsConfig != nil))
 
 	// Use the same router as the handler for the second server
-	go http.Serve(anotherListener, router)
+	tcpServer := &http.Server{Handler: router, ConnContext: withListener(listenerTCP)}
+	go tcpServer.Serve(anotherListener)
+
+	if grpcAddr != "" {
+		if err := serveGRPC(grpcAddr, tlsConfig); err != nil {
+			fmt.Printf("Error creating gRPC server: %v\n", err)
+			return
+		}
+	}
+
+	go func() {
+		for range time.Tick(detectorInterval) {
+			evaluateWorkers(context.Background())
+		}
+	}()
 
 	go func() {
-		for range time.Tick(3 * time.Second) {
-			updateCountdown()
+		for range time.Tick(standbyInterval) {
+			reconcileStandbys(context.Background())
 		}
 	}()
 
-	select {}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	logger.Info("Shutting down")
+	tracing_shutdown()
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger = zap.NewNop()
+	// Checkpoint sizes are observed in the background, the paths stay the
+	// same for the whole run
+	dir, err := os.MkdirTemp("", "cm_manager_test")
+	if err != nil {
+		panic(err)
+	}
+	checkpointMount = filepath.Join(dir, "checkpointfs") + "/"
+	migrationHistoryPath = filepath.Join(dir, "migrations.jsonl")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// withState replaces the workers and services for the test, the previous
+// maps are put back when it ends
+func withState(t *testing.T, w map[string]Worker, s map[string]Service) {
+	t.Helper()
+	oldWorkers, oldServices, oldConfigs, oldChkRun := workers, services, serviceConfigs, lastChkRun
+	workers, services, serviceConfigs, lastChkRun = w, s, make(map[string]ServiceConfig), make(map[string]bool)
+	t.Cleanup(func() {
+		workers, services, serviceConfigs, lastChkRun = oldWorkers, oldServices, oldConfigs, oldChkRun
+	})
+}
+
+// fakeController stands in for a cm_controller, it keeps the status of its
+// containers in memory. Operations listed in fail answer with that code.
+type fakeController struct {
+	t       *testing.T
+	mu      sync.Mutex
+	status  map[string]string //container -> status
+	fail    map[string]int    //operation -> status code
+	after   map[string]int    //operation -> calls that succeed before fail applies
+	calls   []string          //"operation container"
+	queries int               //status queries, not in calls
+	srv     *httptest.Server
+}
+
+func newFakeController(t *testing.T) *fakeController {
+	f := &fakeController{t: t, status: make(map[string]string), fail: make(map[string]int), after: make(map[string]int)}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeController) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	op, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/cm_controller/v1/"), "/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if op == "service" {
+		f.queries++
+	} else if op != "up" {
+		f.calls = append(f.calls, strings.TrimSpace(op+" "+name))
+	}
+	if code, ok := f.fail[op]; ok && f.after[op] == 0 {
+		w.WriteHeader(code)
+		fmt.Fprint(w, `{"error":"injected"}`)
+		return
+	}
+	if f.after[op] > 0 {
+		f.after[op]--
+	}
+	switch op {
+	case "up", "unsubscribe":
+	case "start":
+		var sopt StartOptions
+		json.Unmarshal(body, &sopt)
+		f.status[sopt.ContainerName] = "standby"
+	case "run":
+		f.status[name] = "running"
+	case "checkpoint":
+		var copt CheckpointOptions
+		json.Unmarshal(body, &copt)
+		dir := checkpointLocalPath(copt.ImgUrl)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			f.t.Error(err)
+		}
+		os.WriteFile(filepath.Join(dir, "pages-1.img"), make([]byte, 1024), 0644)
+		f.status[name] = "checkpointed"
+	case "stop":
+		f.status[name] = "exited"
+	case "remove":
+		delete(f.status, name)
+	case "service":
+		st, ok := f.status[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"not found"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status":%q}`, st)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, `{"msg":"ok"}`)
+}
+
+func (f *fakeController) failOn(op string, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[op] = code
+}
+
+// failAfter lets n calls of op succeed before failing the next ones
+func (f *fakeController) failAfter(op string, n int, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[op] = code
+	f.after[op] = n
+}
+
+func (f *fakeController) called(call string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+// withCluster registers a worker backed by a fakeController for each id and
+// the given services, with an empty migration history
+func withCluster(t *testing.T, ids []string, names ...string) map[string]*fakeController {
+	t.Helper()
+	ctls := make(map[string]*fakeController)
+	w := make(map[string]Worker)
+	for _, id := range ids {
+		ctls[id] = newFakeController(t)
+		w[id] = Worker{Id: id, IpAddrPort: ctls[id].srv.URL, Status: "up", Services: []ServiceInWorker{}, Since: time.Now(),
+			lastSopt: make(map[string]StartOptions)}
+	}
+	s := make(map[string]Service)
+	for _, n := range names {
+		s[n] = Service{Name: n, Image: "registry/" + n, ChkFiles: []string{}}
+	}
+	withState(t, w, s)
+
+	for _, n := range names {
+		os.MkdirAll(checkpointLocalPath("file:/checkpointfs/"+checkpointDir(n)), 0755)
+	}
+	historyMu.Lock()
+	migrationHistory = nil
+	historyMu.Unlock()
+	return ctls
+}
+
+// runOn starts and runs name on the worker as a request would
+func runOn(t *testing.T, id string, name string) StartOptions {
+	t.Helper()
+	sopt := StartOptions{ContainerName: name, Image: services[name].Image}
+	if err := startServiceContainer(context.Background(), workers[id], sopt); err != nil {
+		t.Fatalf("start %s on %s: %v", name, id, err)
+	}
+	if err := runService(context.Background(), workers[id], services[name], RunOptions{NoRestore: true}); err != nil {
+		t.Fatalf("run %s on %s: %v", name, id, err)
+	}
+	return sopt
+}
+
+// statusOn returns the status of name on the worker as the manager sees it
+func statusOn(t *testing.T, id string, name string) string {
+	t.Helper()
+	updateWorkerServices(context.Background(), id, name)
+	_, stat := isServiceInWorker(workers[id], name)
+	return stat
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	controllerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm_manager_controller_requests_total",
+		Help: "Requests sent to worker controllers by operation and status code.",
+	}, []string{"operation", "code"})
+	controllerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cm_manager_controller_request_duration_seconds",
+		Help:    "Duration of requests sent to worker controllers.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"operation"})
+
+	migrationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm_manager_migrations_total",
+		Help: "Migrations by outcome.",
+	}, []string{"outcome"})
+	migrationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cm_manager_migration_duration_seconds",
+		Help:    "Total duration of successful migrations.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+	migrationDowntime = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cm_manager_migration_downtime_seconds",
+		Help:    "Time from the checkpoint on the source to the restore on the destination.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+	migrationPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cm_manager_migration_phase_duration_seconds",
+		Help:    "Duration of each migration phase (start, precopy, checkpoint, restore, stop, rollback).",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"phase"})
+
+	checkpointsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm_manager_checkpoints_total",
+		Help: "Checkpoints by service and outcome.",
+	}, []string{"service", "outcome"})
+	checkpointSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cm_manager_checkpoint_size_bytes",
+		Help:    "Size of the checkpoint images taken per service.",
+		Buckets: prometheus.ExponentialBuckets(1<<20, 2, 14),
+	}, []string{"service"})
+
+	heartbeatInterval = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cm_manager_heartbeat_interval_seconds",
+		Help:    "Time between two heartbeats of a worker.",
+		Buckets: []float64{0.5, 1, 2, 3, 5, 10, 30, 60},
+	}, []string{"worker"})
+
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm_manager_api_requests_total",
+		Help: "API requests by route and status code.",
+	}, []string{"method", "route", "code"})
+	apiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cm_manager_api_request_duration_seconds",
+		Help:    "Duration of API requests by route.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"method", "route"})
+)
+
+func init() {
+	prometheus.MustRegister(stateCollector{})
+}
+
+// stateCollector exports the worker and service state at scrape time
+type stateCollector struct{}
+
+var (
+	workerUpDesc        = prometheus.NewDesc("cm_manager_worker_up", "Whether the worker is up according to its heartbeats.", []string{"worker", "status"}, nil)
+	workerSuspicionDesc = prometheus.NewDesc("cm_manager_worker_suspicion", "Suspicion level of the failure detector, seconds since the last heartbeat (timeout) or phi (phi).", []string{"worker"}, nil)
+	heartbeatAgeDesc    = prometheus.NewDesc("cm_manager_heartbeat_age_seconds", "Time since the last heartbeat of the worker.", []string{"worker"}, nil)
+	workerServicesDesc  = prometheus.NewDesc("cm_manager_worker_services", "Services known on a worker.", []string{"worker"}, nil)
+	checkpointFilesDesc = prometheus.NewDesc("cm_manager_checkpoint_images", "Checkpoint images known for a service.", []string{"service"}, nil)
+)
+
+func (stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workerUpDesc
+	ch <- workerSuspicionDesc
+	ch <- heartbeatAgeDesc
+	ch <- workerServicesDesc
+	ch <- checkpointFilesDesc
+}
+
+func (stateCollector) Collect(ch chan<- prometheus.Metric) {
+	// The maps are copied under stateMu, the suspicion levels under mu
+	type workerState struct {
+		id, status string
+		lastBeat   time.Time
+		services   int
+	}
+	stateMu.Lock()
+	ws := make([]workerState, 0, len(workers))
+	for _, w := range workers {
+		ws = append(ws, workerState{id: w.Id, status: w.Status, lastBeat: w.lastBeat, services: len(w.Services)})
+	}
+	chkFiles := make(map[string]int, len(services))
+	for _, s := range services {
+		chkFiles[s.Name] = len(s.ChkFiles)
+	}
+	stateMu.Unlock()
+	mu.Lock()
+	suspicion := make(map[string]float64, len(workerSuspicion))
+	for id, level := range workerSuspicion {
+		suspicion[id] = level
+	}
+	mu.Unlock()
+
+	for _, w := range ws {
+		up := 0.0
+		if w.status == "up" {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(workerUpDesc, prometheus.GaugeValue, up, w.id, w.status)
+		ch <- prometheus.MustNewConstMetric(workerSuspicionDesc, prometheus.GaugeValue, suspicion[w.id], w.id)
+		if !w.lastBeat.IsZero() {
+			ch <- prometheus.MustNewConstMetric(heartbeatAgeDesc, prometheus.GaugeValue, time.Since(w.lastBeat).Seconds(), w.id)
+		}
+		ch <- prometheus.MustNewConstMetric(workerServicesDesc, prometheus.GaugeValue, float64(w.services), w.id)
+	}
+	for name, n := range chkFiles {
+		ch <- prometheus.MustNewConstMetric(checkpointFilesDesc, prometheus.GaugeValue, float64(n), name)
+	}
+}
+
+// metricsTransport counts the requests sent to the controllers. The operation
+// is the first path element after /cm_controller/v1/.
+type metricsTransport struct {
+	base http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := controllerOperation(req.URL.Path)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	controllerDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	controllerRequests.WithLabelValues(op, code).Inc()
+	return resp, err
+}
+
+func controllerOperation(path string) string {
+	op := strings.TrimPrefix(path, "/cm_controller/v1/")
+	if i := strings.Index(op, "/"); i >= 0 {
+		op = op[:i]
+	}
+	return op
+}
+
+func instrumentControllerClient() {
+	base := controllerClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	controllerClient.Transport = metricsTransport{base: base}
+}
+
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		apiDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+		apiRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	}
+}
+
+func observeCheckpoint(service string, imgUrl string, err error) {
+	if err != nil {
+		checkpointsTotal.WithLabelValues(service, "failure").Inc()
+		return
+	}
+	checkpointsTotal.WithLabelValues(service, "success").Inc()
+	// Walking the image on the shared FS can take a while, it must not delay
+	// the restore that follows the checkpoint of a migration
+	go func() {
+		if size, err := checkpointImageSize(imgUrl); err == nil {
+			checkpointSize.WithLabelValues(service).Observe(float64(size))
+		}
+	}()
+}
+
+// Where the shared checkpoint dir is mounted on the manager
+var checkpointMount = "/mnt/checkpointfs/"
+
+// checkpointLocalPath maps an image url as seen by the controllers
+// (file:/checkpointfs/...) to the shared checkpoint dir mounted on the manager
+func checkpointLocalPath(imgUrl string) string {
+	return checkpointMount + strings.TrimPrefix(imgUrl, "file:/checkpointfs/")
+}
+
+// Sizes of the images already walked, an image does not change once written
+var imageSizes = make(map[string]int64)
+var imageSizesMu sync.Mutex
+
+// checkpointImageSize returns the size of the image, walking it on the
+// shared FS the first time only
+func checkpointImageSize(imgUrl string) (int64, error) {
+	imageSizesMu.Lock()
+	size, ok := imageSizes[imgUrl]
+	imageSizesMu.Unlock()
+	if ok {
+		return size, nil
+	}
+	size, err := walkImageSize(imgUrl)
+	if err != nil {
+		return 0, err
+	}
+	imageSizesMu.Lock()
+	imageSizes[imgUrl] = size
+	imageSizesMu.Unlock()
+	return size, nil
+}
+
+// forgetImageSizes drops the cached sizes of the images under prefix once
+// they are deleted
+func forgetImageSizes(prefix string) {
+	imageSizesMu.Lock()
+	defer imageSizesMu.Unlock()
+	for img := range imageSizes {
+		if strings.HasPrefix(img, prefix) {
+			delete(imageSizes, img)
+		}
+	}
+}
+
+func walkImageSize(imgUrl string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(checkpointLocalPath(imgUrl), func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Run with -race, scrapes read the state while operations change it
+func TestStateCollectorWhileWriting(t *testing.T) {
+	withCluster(t, []string{"w1", "w2"}, "a", "b")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			setWorkerStatus("w1", []string{workerSuspect, workerUp}[i%2])
+			addCheckpointFile("a", "file:/checkpointfs/a/a_w1_x")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		ch := make(chan prometheus.Metric, 64)
+		stateCollector{}.Collect(ch)
+		close(ch)
+	}
+	wg.Wait()
+
+	// up, suspicion and services per worker, the heartbeat age is only
+	// reported after a heartbeat, checkpoint files per service
+	ch := make(chan prometheus.Metric, 64)
+	stateCollector{}.Collect(ch)
+	close(ch)
+	if n := len(ch); n != 2*3+2 {
+		t.Errorf("%d metrics, want %d", n, 2*3+2)
+	}
+}
@@ -1,83 +1,235 @@
 package main
 
 import (
-	//"reflect"
+	"context"
 	"errors"
 	"reflect"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
-func migrateService(src string, dest string, service Service, copt CheckpointOptions, ropt RunOptions, sopt StartOptions, stopSrc bool) (float64, error) {
+// Migration states. A migration goes through preflight, starting,
+// precopying (when copt.PreCopy is set), checkpointing, restoring and
+// stopping and ends in completed, rolled_back or failed. When a phase fails
+// the actions of the phases already done are compensated:
+//
+//	preflight     -> nothing, no change was made
+//	starting      -> remove the container started on dest
+//	precopying    -> remove the container started on dest, src kept running
+//	checkpointing -> remove the container started on dest
+//	restoring     -> remove the container started on dest, then resume src
+//	                 (leave_running) or restore it from the image just taken
+//	stopping      -> nothing, the service runs on dest, reported as a warning
+const (
+	migPreflight     = "preflight"
+	migStarting      = "starting"
+	migPreCopying    = "precopying"
+	migCheckpointing = "checkpointing"
+	migRestoring     = "restoring"
+	migStopping      = "stopping"
+	migCompensating  = "compensating"
+	migCompleted     = "completed"
+	migRolledBack    = "rolled_back"
+	migFailed        = "failed"
+)
+
+func (rec *MigrationRecord) transition(logger *zap.Logger, state string) {
+	logger.Debug("Migration state", zap.String("service", rec.Service), zap.String("from", rec.State), zap.String("to", state))
+	rec.State = state
+}
+
+// migrateService moves service from src to dest and returns the record of the
+// migration, whose State is the final state. err is nil once the service runs
+// on dest, even if stopping it on src failed.
+func migrateService(ctx context.Context, src string, dest string, service Service, copt CheckpointOptions, ropt RunOptions, sopt StartOptions, stopSrc bool) (rec *MigrationRecord, err error) {
+	logger := loggerFrom(ctx)
 	logger.Debug("Migrating service", zap.String("service", service.Name))
-	migrateStart := time.Now()
+	rec = newMigrationRecord(ctx, service.Name, src, dest, MigrateBody{Copt: copt, Ropt: ropt, Sopt: sopt, Stop: stopSrc})
+	defer func() { finishMigration(rec, err) }()
+	ctx, span := tracer.Start(ctx, "migrate", trace.WithAttributes(
+		attribute.String("cm.service", service.Name),
+		attribute.String("cm.src", src),
+		attribute.String("cm.dest", dest),
+	))
+	defer span.End()
 
-	// willStart := false
-	//startErrCh := make(chan error)
-	//checkpointErrCh := make(chan error)
-	var sErr error
+	rec.transition(logger, migPreflight)
+	pf := preflightMigration(ctx, src, dest, service.Name, sopt, copt)
+	rec.Warnings = append(rec.Warnings, pf.Warnings...)
+	if pfErr := pf.err(); pfErr != nil {
+		logger.Error("Migration preflight failed", zap.String("serviceName", service.Name), zap.Strings("issues", pf.Issues))
+		return rec, compensateMigration(ctx, rec, pfErr, false, false)
+	}
+
+	startedDest := false
+	rec.transition(logger, migStarting)
 	_, statDest := isServiceInWorker(workers[dest], service.Name)
 	logger.Debug("Service status on destination", zap.String("service", service.Name), zap.String("status", statDest))
 	logger.Debug("Start options", zap.Any("sopt", sopt), zap.Any("lastopt", workers[dest].lastSopt[service.Name]))
 	if !((statDest == "standby" || statDest == "checkpointed") && reflect.DeepEqual(sopt, workers[dest].lastSopt[service.Name])) {
-		// willStart = true
-		// go func() {
-		// startErrCh <- startServiceContainer(workers[dest], sopt)
-		// }()
+		phaseStart := time.Now()
+		pctx, pspan := tracer.Start(ctx, "migrate.start")
+		sErr := startServiceContainer(pctx, workers[dest], sopt)
+		endSpan(pspan, sErr)
+		rec.phase("start", phaseStart)
+		if sErr != nil {
+			logger.Error("Error starting service's container at destination", zap.String("serviceName", service.Name), zap.String("dest", dest), zap.Error(sErr))
+			// Only remove a container this start created, not one that was
+			// on dest before nor one the controller doesn't have
+			stat, qErr := queryServiceStatus(ctx, dest, service.Name)
+			return rec, compensateMigration(ctx, rec, sErr, statDest == "" && qErr == nil && stat != "", false)
+		}
+		startedDest = true
+	}
 
-		sErr = startServiceContainer(workers[dest], sopt)
+	// Pre-copy rounds dump the memory while the service keeps running, each
+	// on top of the previous one, so the final checkpoint only has the pages
+	// dirtied since and the downtime shrinks
+	var chain []string
+	if copt.PreCopy > 0 {
+		rec.transition(logger, migPreCopying)
+	}
+	for round := 1; round <= copt.PreCopy; round++ {
+		pcopt := copt
+		pcopt.LeaveRun = true
+		pcopt.PreCopy = 0
+		pcopt.preCopyRound = round
+		if len(chain) > 0 {
+			pcopt.ParentImage = chain[len(chain)-1]
+		}
+		phaseStart := time.Now()
+		pctx, pspan := tracer.Start(ctx, "migrate.precopy", trace.WithAttributes(attribute.Int("cm.round", round)))
+		image, pErr := dumpService(pctx, src, service, pcopt)
+		endSpan(pspan, pErr)
+		rec.phase("precopy", phaseStart)
+		if pErr != nil {
+			logger.Error("Error pre-copying service at source", zap.String("serviceName", service.Name), zap.String("src", src), zap.Int("round", round), zap.Error(pErr))
+			return rec, compensateMigration(ctx, rec, pErr, startedDest, false)
+		}
+		chain = append(chain, image)
+		rec.PreCopy = chain
 	}
-	// go func() {
-	// 	result, err := checkpointService(src, service, copt)
-	// 	ropt.ImageURL = result
-	// 	checkpointErrCh <- err
-	// }()
-	if sErr != nil {
-		logger.Error("Error starting service's container at destination", zap.String("serviceName", service.Name), zap.String("dest", dest), zap.Error(sErr))
-		return -1, sErr
+	copt.PreCopy = 0
+	if len(chain) > 0 {
+		copt.ParentImage = chain[len(chain)-1]
 	}
-	var cErr error
-	ropt.ImageURL, cErr = checkpointService(src, service, copt)
-
-	// var sErr error
-	// if willStart {
-	// 	sErr = <-startErrCh
-	// }
-	//cErr := <-checkpointErrCh
+
+	rec.transition(logger, migCheckpointing)
+	downStart := time.Now()
+	pctx, pspan := tracer.Start(ctx, "migrate.checkpoint")
+	image, cErr := checkpointService(pctx, src, service, copt)
+	endSpan(pspan, cErr)
+	rec.phase("checkpoint", downStart)
 	if cErr != nil {
 		logger.Error("Error checkpoint service at source", zap.String("serviceName", service.Name), zap.String("src", src), zap.Error(cErr))
-
-		return -1, cErr
+		return rec, compensateMigration(ctx, rec, cErr, startedDest, false)
 	}
-	//startServiceContainer(workers[dest], sopt)
-	//time.Sleep(200 * time.Millisecond) //If too fast ffd may not ready
-	runCount = 0
-	rErr := runService(workers[dest], service, ropt)
+	rec.Image = image
+	ropt.ImageURL = image
+	ropt.ParentImages = chain
+
+	rec.transition(logger, migRestoring)
+	restoreStart := time.Now()
+	pctx, pspan = tracer.Start(ctx, "migrate.restore")
+	rErr := runService(pctx, workers[dest], service, ropt)
+	endSpan(pspan, rErr)
+	rec.phase("restore", restoreStart)
 	if rErr != nil {
-		logger.Error("Failed to run service on destination, will start the service on source again", zap.String("serviceName", service.Name), zap.String("src", src), zap.String("dest", dest), zap.Error(rErr))
-		runCount = 0
-		var rrErr error
-		rrErr = runService(workers[src], service, ropt)
-		if rrErr != nil {
-			logger.Error("Failed to rerun service on source", zap.String("serviceName", service.Name), zap.String("src", src), zap.Error(rErr))
-			rrErr = errors.New(rErr.Error() + ",and cannot rerun on source")
-			return -1, rrErr
-		}
-		rrErr = errors.New(rErr.Error() + ",rerun on source")
-		return -1, rrErr
+		logger.Error("Failed to run service on destination, will bring the service back on source", zap.String("serviceName", service.Name), zap.String("src", src), zap.String("dest", dest), zap.Error(rErr))
+		return rec, compensateMigration(ctx, rec, rErr, startedDest, true)
 	}
-	migrateDur := time.Since(migrateStart)
+	migrateDur := time.Since(rec.Start)
+	rec.Downtime = time.Since(downStart).Seconds()
+
 	if stopSrc {
-		stErr := stopService(workers[src], service)
+		rec.transition(logger, migStopping)
+		stopStart := time.Now()
+		pctx, pspan = tracer.Start(ctx, "migrate.stop")
+		stErr := stopService(pctx, workers[src], service)
+		endSpan(pspan, stErr)
+		rec.phase("stop", stopStart)
 		if stErr != nil {
-			logger.Error("Failed to stop service on source", zap.String("serviceName", service.Name), zap.String("src", src), zap.Error(rErr))
-			return -1, stErr
+			// The service already runs on dest, the migration stands
+			logger.Warn("Failed to stop service on source", zap.String("serviceName", service.Name), zap.String("src", src), zap.Error(stErr))
+			rec.Warnings = append(rec.Warnings, "stop on source failed: "+stErr.Error())
 		}
 	}
 
+	rec.transition(logger, migCompleted)
 	logger.Info("Migrate service successfully", zap.String("service", service.Name), zap.String("src", src), zap.String("dest", dest), zap.Duration("time", migrateDur))
-	updateWorkerServices(src, service.Name)
-	updateWorkerServices(dest, service.Name)
-	return migrateDur.Seconds(), nil
+	updateWorkerServices(ctx, src, service.Name)
+	updateWorkerServices(ctx, dest, service.Name)
+	return rec, nil
+}
+
+// compensateMigration undoes what the migration did before failing with
+// cause and sets the final state. removeDest removes the service's container
+// from dest, restoreSrc brings the service back on src once it was
+// checkpointed there.
+func compensateMigration(ctx context.Context, rec *MigrationRecord, cause error, removeDest bool, restoreSrc bool) error {
+	logger := loggerFrom(ctx)
+	rec.FailedPhase = rec.State
+	if !removeDest && !restoreSrc {
+		rec.transition(logger, migFailed)
+		return cause
+	}
+
+	rec.transition(logger, migCompensating)
+	rec.Rollback = true
+	rollbackStart := time.Now()
+	// The operation may have failed on its deadline, compensating gets its own
+	ctx, cancel := context.WithTimeout(detachContext(ctx), opTimeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "migrate.rollback")
+	defer func() { rec.phase("rollback", rollbackStart) }()
+	service := services[rec.Service]
+	var failures []string
+
+	if removeDest {
+		err := removeService(ctx, workers[rec.Dest], service)
+		if err != nil {
+			logger.Error("Failed to remove service's container from destination", zap.String("serviceName", rec.Service), zap.String("dest", rec.Dest), zap.Error(err))
+			failures = append(failures, "remove on destination: "+err.Error())
+		} else {
+			rec.Compensations = append(rec.Compensations, "removed_dest")
+		}
+	}
+
+	if restoreSrc {
+		updateWorkerServices(ctx, rec.Src, rec.Service)
+		_, statSrc := isServiceInWorker(workers[rec.Src], rec.Service)
+		if rec.Options.Copt.LeaveRun && statSrc == "running" {
+			// Checkpointed with leave_running, the source never stopped
+			rec.Compensations = append(rec.Compensations, "resumed_src")
+		} else {
+			srcRopt := rec.Options.Ropt
+			srcRopt.ImageURL = rec.Image
+			srcRopt.ParentImages = rec.PreCopy
+			srcRopt.NoRestore = false
+			srcRopt.LeaveStopped = false
+			err := runService(ctx, workers[rec.Src], service, srcRopt)
+			if err != nil {
+				logger.Error("Failed to restore service on source", zap.String("serviceName", rec.Service), zap.String("src", rec.Src), zap.Error(err))
+				failures = append(failures, "restore on source: "+err.Error())
+			} else {
+				rec.Compensations = append(rec.Compensations, "restored_src")
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		rec.Outcome = "rollback_failed"
+		rec.transition(logger, migFailed)
+		err := errors.New(cause.Error() + ", and rollback failed")
+		rec.Warnings = append(rec.Warnings, failures...)
+		endSpan(span, err)
+		return err
+	}
+	rec.Outcome = "rolled_back"
+	rec.transition(logger, migRolledBack)
+	endSpan(span, nil)
+	return errors.New(cause.Error() + ", rolled back")
 }
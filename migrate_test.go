@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMigrateService(t *testing.T) {
+	tests := []struct {
+		name          string
+		copt          CheckpointOptions
+		fail          map[string]string //operation -> worker failing it
+		destStub      map[string]string //containers the controller of w2 reports
+		wantErr       bool
+		state         string
+		failedPhase   string
+		outcome       string
+		compensations []string
+		src, dest     string //status of the service on w1 and w2 afterwards
+	}{
+		{
+			name:    "completed",
+			state:   migCompleted,
+			outcome: "success",
+			src:     "exited",
+			dest:    "running",
+		},
+		{
+			name:    "stop failure leaves the migration standing",
+			fail:    map[string]string{"stop": "w1"},
+			state:   migCompleted,
+			outcome: "success",
+			src:     "checkpointed",
+			dest:    "running",
+		},
+		{
+			name:        "start failure changes nothing",
+			fail:        map[string]string{"start": "w2"},
+			wantErr:     true,
+			state:       migFailed,
+			failedPhase: migStarting,
+			outcome:     "failure",
+			src:         "running",
+			dest:        "",
+		},
+		{
+			name:          "start failure removes a container the start left",
+			fail:          map[string]string{"start": "w2"},
+			destStub:      map[string]string{"a": "exited"},
+			wantErr:       true,
+			state:         migRolledBack,
+			failedPhase:   migStarting,
+			outcome:       "rolled_back",
+			compensations: []string{"removed_dest"},
+			src:           "running",
+			dest:          "",
+		},
+		{
+			name:        "start failure without a container on dest",
+			fail:        map[string]string{"start": "w2"},
+			destStub:    map[string]string{"a": ""},
+			wantErr:     true,
+			state:       migFailed,
+			failedPhase: migStarting,
+			outcome:     "failure",
+			src:         "running",
+			dest:        "",
+		},
+		{
+			name:          "checkpoint failure removes dest",
+			fail:          map[string]string{"checkpoint": "w1"},
+			wantErr:       true,
+			state:         migRolledBack,
+			failedPhase:   migCheckpointing,
+			outcome:       "rolled_back",
+			compensations: []string{"removed_dest"},
+			src:           "running",
+			dest:          "",
+		},
+		{
+			name:          "restore failure restores src from the image",
+			fail:          map[string]string{"run": "w2"},
+			wantErr:       true,
+			state:         migRolledBack,
+			failedPhase:   migRestoring,
+			outcome:       "rolled_back",
+			compensations: []string{"removed_dest", "restored_src"},
+			src:           "running",
+			dest:          "",
+		},
+		{
+			name:          "restore failure resumes a src left running",
+			copt:          CheckpointOptions{LeaveRun: true},
+			fail:          map[string]string{"run": "w2"},
+			wantErr:       true,
+			state:         migRolledBack,
+			failedPhase:   migRestoring,
+			outcome:       "rolled_back",
+			compensations: []string{"removed_dest", "resumed_src"},
+			src:           "running",
+			dest:          "",
+		},
+		{
+			name:          "failed compensation",
+			fail:          map[string]string{"run": "w2", "remove": "w2"},
+			wantErr:       true,
+			state:         migFailed,
+			failedPhase:   migRestoring,
+			outcome:       "rollback_failed",
+			compensations: []string{"restored_src"},
+			src:           "running",
+			dest:          "standby",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctls := withCluster(t, []string{"w1", "w2"}, "a")
+			sopt := runOn(t, "w1", "a")
+			for op, id := range tt.fail {
+				ctls[id].failOn(op, http.StatusInternalServerError)
+			}
+			for c, st := range tt.destStub {
+				ctls["w2"].status[c] = st
+			}
+
+			rec, err := migrateService(context.Background(), "w1", "w2", services["a"], tt.copt, RunOptions{}, sopt, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if rec.State != tt.state || rec.FailedPhase != tt.failedPhase || rec.Outcome != tt.outcome {
+				t.Errorf("state %s, failed phase %q, outcome %s, want %s, %q, %s", rec.State, rec.FailedPhase, rec.Outcome, tt.state, tt.failedPhase, tt.outcome)
+			}
+			if !reflect.DeepEqual(rec.Compensations, tt.compensations) {
+				t.Errorf("compensations = %v, want %v", rec.Compensations, tt.compensations)
+			}
+			if got := statusOn(t, "w1", "a"); got != tt.src {
+				t.Errorf("a on w1 is %q, want %q", got, tt.src)
+			}
+			if got := statusOn(t, "w2", "a"); got != tt.dest {
+				t.Errorf("a on w2 is %q, want %q", got, tt.dest)
+			}
+			if recs := getMigrationRecords("a"); len(recs) != 1 || recs[0].State != tt.state {
+				t.Errorf("history = %+v, want the record of the migration", recs)
+			}
+		})
+	}
+}
+
+func TestCompensateMigrationWithoutActions(t *testing.T) {
+	rec := &MigrationRecord{State: migPreflight}
+	cause := errors.New("preflight failed")
+	if err := compensateMigration(context.Background(), rec, cause, false, false); err != cause {
+		t.Errorf("err = %v, want the cause", err)
+	}
+	if rec.State != migFailed || rec.FailedPhase != migPreflight || rec.Rollback {
+		t.Errorf("record = %+v, want failed in preflight without rollback", rec)
+	}
+}
+
+func TestMigratePreflightFailure(t *testing.T) {
+	ctls := withCluster(t, []string{"w1", "w2"}, "a")
+	sopt := StartOptions{ContainerName: "a", Image: services["a"].Image}
+	rec, err := migrateService(context.Background(), "w1", "w2", services["a"], CheckpointOptions{}, RunOptions{}, sopt, true)
+	if err == nil || !strings.Contains(err.Error(), "not on source worker") {
+		t.Fatalf("err = %v, want the preflight issue", err)
+	}
+	if rec.State != migFailed || rec.FailedPhase != migPreflight || len(rec.Compensations) > 0 {
+		t.Errorf("record = %+v, want failed in preflight", rec)
+	}
+	if ctls["w2"].called("start") {
+		t.Errorf("dest was started after a failed preflight")
+	}
+}
+
+func TestMigratePreCopyRecordsOnlyTheFinalImage(t *testing.T) {
+	tests := []struct {
+		name       string
+		failFinal  bool
+		chkFiles   int
+		events     []string
+		lastChkRun bool
+	}{
+		{name: "completed", chkFiles: 1, events: []string{"checkpoint.success", "migration.success"}},
+		{name: "final checkpoint failed", failFinal: true, chkFiles: 0, events: []string{"checkpoint.failure", "migration.rolled_back"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctls := withCluster(t, []string{"w1", "w2"}, "a")
+			sopt := runOn(t, "w1", "a")
+			before := serviceConfigs["a"].ChkOpt
+			events, stop := watchEvents()
+			defer stop()
+			if tt.failFinal {
+				// The rounds are dumped, only the final checkpoint fails
+				ctls["w1"].failAfter("checkpoint", 2, http.StatusInternalServerError)
+			}
+
+			rec, _ := migrateService(context.Background(), "w1", "w2", services["a"], CheckpointOptions{PreCopy: 2}, RunOptions{}, sopt, true)
+			if len(rec.PreCopy) != 2 {
+				t.Fatalf("pre-copy chain = %v, want 2 rounds", rec.PreCopy)
+			}
+			chkFiles := services["a"].ChkFiles
+			if len(chkFiles) != tt.chkFiles {
+				t.Errorf("chk_files = %v, want %d images", chkFiles, tt.chkFiles)
+			}
+			for _, img := range chkFiles {
+				if preCopyImageRe.MatchString(img) {
+					t.Errorf("pre-copy image %s recorded in chk_files", img)
+				}
+			}
+			if tt.failFinal && !reflect.DeepEqual(serviceConfigs["a"].ChkOpt, before) {
+				t.Errorf("checkpoint options changed by the rounds: %+v", serviceConfigs["a"].ChkOpt)
+			}
+			if lastChkRun["a"] {
+				t.Errorf("lastChkRun set by a leave_running round")
+			}
+			got := []string{}
+			for len(events) > 0 {
+				got = append(got, (<-events).Type)
+			}
+			if !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("events = %v, want %v", got, tt.events)
+			}
+		})
+	}
+}
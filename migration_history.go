@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+var migrationHistoryPath = "cm_manager_migrations.jsonl"
+
+// Only the most recent records are kept, in memory and on disk, 0 keeps all
+var migrationHistoryMax = 10000
+
+var migrationHistory []MigrationRecord
+var historyMu sync.Mutex
+
+// Records in the history file, it is compacted once they exceed the maximum
+// by a tenth
+var historyOnDisk int
+
+type MigrationRecord struct {
+	Id        string             `json:"id"`
+	RequestId string             `json:"request_id,omitempty"`
+	Service   string             `json:"service"`
+	Src       string             `json:"src"`
+	Dest      string             `json:"dest"`
+	Options   MigrateBody        `json:"options"`
+	Start     time.Time          `json:"start"`
+	End       time.Time          `json:"end"`
+	Phases    map[string]float64 `json:"phases"` //seconds per phase
+	Duration  float64            `json:"duration"`
+	Downtime  float64            `json:"downtime"`
+	Image     string             `json:"image,omitempty"`
+	PreCopy   []string           `json:"pre_copy_images,omitempty"`
+	Outcome   string             `json:"outcome"` //success, failure, rolled_back or rollback_failed
+	Rollback  bool               `json:"rollback"`
+	Error     string             `json:"error,omitempty"`
+
+	State         string   `json:"state"`                  //completed, rolled_back or failed once finished
+	FailedPhase   string   `json:"failed_phase,omitempty"` //state the migration failed in
+	Compensations []string `json:"compensations,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+}
+
+type MigrationStats struct {
+	Count        int     `json:"count"`
+	Failures     int     `json:"failures"`
+	FailureRate  float64 `json:"failure_rate"`
+	DowntimeP50  float64 `json:"downtime_p50"`
+	DowntimeP95  float64 `json:"downtime_p95"`
+	DurationP50  float64 `json:"duration_p50"`
+	DurationP95  float64 `json:"duration_p95"`
+	LastOutcome  string  `json:"last_outcome,omitempty"`
+	LastDuration float64 `json:"last_duration,omitempty"`
+}
+
+type WorkerPairStats struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
+	MigrationStats
+}
+
+type migrationStatsResp struct {
+	Overall MigrationStats    `json:"overall"`
+	Pairs   []WorkerPairStats `json:"pairs"`
+}
+
+func migration_history_init() {
+	file, err := os.Open(migrationHistoryPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("Error opening migration history", zap.Error(err))
+		}
+		return
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec MigrationRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			logger.Error("Skipping invalid migration history line", zap.Error(err))
+			continue
+		}
+		// Files written before options were redacted
+		rec.Options = redactOptions(rec.Options)
+		migrationHistory = append(migrationHistory, rec)
+		historyOnDisk++
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Error("Error reading migration history", zap.Error(err))
+	}
+	file.Close()
+	trimMigrationHistory()
+	logger.Debug("Loaded migration history", zap.Int("count", len(migrationHistory)))
+}
+
+func newMigrationRecord(ctx context.Context, service string, src string, dest string, opts MigrateBody) *MigrationRecord {
+	return &MigrationRecord{
+		Id:        newRequestID(),
+		RequestId: requestIDFrom(ctx),
+		Service:   service,
+		Src:       src,
+		Dest:      dest,
+		Options:   opts,
+		Start:     time.Now().UTC(),
+		Phases:    make(map[string]float64),
+		Outcome:   "success",
+		State:     "pending",
+	}
+}
+
+// phase records the duration of a migration phase that began at start
+func (rec *MigrationRecord) phase(name string, start time.Time) {
+	d := time.Since(start).Seconds()
+	rec.Phases[name] += d
+	migrationPhaseDuration.WithLabelValues(name).Observe(d)
+}
+
+// finishMigration stores the record and updates the migration metrics
+func finishMigration(rec *MigrationRecord, err error) {
+	rec.End = time.Now().UTC()
+	rec.Duration = rec.End.Sub(rec.Start).Seconds()
+	if err != nil {
+		rec.Error = err.Error()
+		if rec.Outcome == "success" {
+			rec.Outcome = "failure"
+		}
+	}
+	migrationsTotal.WithLabelValues(rec.Outcome).Inc()
+	if rec.Outcome == "success" {
+		migrationDuration.Observe(rec.Duration)
+		if !rec.Options.Copt.LeaveRun {
+			migrationDowntime.Observe(rec.Downtime)
+		}
+	}
+	// The migration keeps the options it ran with for its compensations, the
+	// history and the webhooks get them without the passphrase files
+	stored := *rec
+	stored.Options = redactOptions(rec.Options)
+	saveMigrationRecord(stored)
+	publishEvent("migration."+rec.Outcome, stored)
+}
+
+// redactOptions hides the keys the audit log redacts from migration options
+func redactOptions(opts MigrateBody) MigrateBody {
+	var parsed interface{}
+	b, _ := json.Marshal(opts)
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return MigrateBody{}
+	}
+	b, _ = json.Marshal(redact(parsed))
+	var out MigrateBody
+	if err := json.Unmarshal(b, &out); err != nil {
+		return MigrateBody{}
+	}
+	return out
+}
+
+func saveMigrationRecord(rec MigrationRecord) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	migrationHistory = append(migrationHistory, rec)
+	historyOnDisk++
+	if trimMigrationHistory() {
+		return
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logger.Error("Error marshalling migration record", zap.Error(err))
+		return
+	}
+	file, err := os.OpenFile(migrationHistoryPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("Error opening migration history", zap.Error(err))
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		logger.Error("Error writing migration history", zap.Error(err))
+	}
+}
+
+// trimMigrationHistory drops the oldest records over migrationHistoryMax and
+// rewrites the file when it holds too many, it returns true when the file was
+// rewritten. historyMu must be held once the manager is running.
+func trimMigrationHistory() bool {
+	if migrationHistoryMax <= 0 {
+		return false
+	}
+	if over := len(migrationHistory) - migrationHistoryMax; over > 0 {
+		migrationHistory = append([]MigrationRecord(nil), migrationHistory[over:]...)
+	}
+	if historyOnDisk <= migrationHistoryMax+migrationHistoryMax/10 {
+		return false
+	}
+	tmp := migrationHistoryPath + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("Error compacting migration history", zap.Error(err))
+		return false
+	}
+	w := bufio.NewWriter(file)
+	for _, rec := range migrationHistory {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		w.Write(append(line, '\n'))
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, migrationHistoryPath)
+	}
+	if err != nil {
+		logger.Error("Error compacting migration history", zap.Error(err))
+		os.Remove(tmp)
+		return false
+	}
+	historyOnDisk = len(migrationHistory)
+	return true
+}
+
+// getMigrationRecords returns the records of a service, or of all services
+// when service is empty, oldest first
+func getMigrationRecords(service string) []MigrationRecord {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	recs := []MigrationRecord{}
+	for _, rec := range migrationHistory {
+		if service == "" || rec.Service == service {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+func computeMigrationStats(recs []MigrationRecord) MigrationStats {
+	stats := MigrationStats{Count: len(recs)}
+	var downtimes, durations []float64
+	for _, rec := range recs {
+		if rec.Outcome != "success" {
+			stats.Failures++
+			continue
+		}
+		durations = append(durations, rec.Duration)
+		if !rec.Options.Copt.LeaveRun {
+			downtimes = append(downtimes, rec.Downtime)
+		}
+	}
+	if stats.Count > 0 {
+		stats.FailureRate = float64(stats.Failures) / float64(stats.Count)
+		stats.LastOutcome = recs[len(recs)-1].Outcome
+		stats.LastDuration = recs[len(recs)-1].Duration
+	}
+	stats.DowntimeP50 = percentile(downtimes, 50)
+	stats.DowntimeP95 = percentile(downtimes, 95)
+	stats.DurationP50 = percentile(durations, 50)
+	stats.DurationP95 = percentile(durations, 95)
+	return stats
+}
+
+func migrationStatsByPair(recs []MigrationRecord) []WorkerPairStats {
+	byPair := make(map[[2]string][]MigrationRecord)
+	for _, rec := range recs {
+		key := [2]string{rec.Src, rec.Dest}
+		byPair[key] = append(byPair[key], rec)
+	}
+	pairs := []WorkerPairStats{}
+	for key, pairRecs := range byPair {
+		pairs = append(pairs, WorkerPairStats{Src: key[0], Dest: key[1], MigrationStats: computeMigrationStats(pairRecs)})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Src != pairs[j].Src {
+			return pairs[i].Src < pairs[j].Src
+		}
+		return pairs[i].Dest < pairs[j].Dest
+	})
+	return pairs
+}
+
+// percentile uses the nearest-rank method
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func getServiceMigrationsHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	service := c.Param("name")
+	if _, ok := services[service]; !ok && service != "" {
+		logger.Error("Service not found", zap.String("serviceName", service))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		return
+	}
+	recs := getMigrationRecords(service)
+	if l := c.Query("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		if limit > 0 && len(recs) > limit {
+			recs = recs[len(recs)-limit:]
+		}
+	}
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, recs)
+}
+
+func getMigrationStatsHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	service := c.Param("name")
+	if service == "" {
+		service = c.Query("service")
+	}
+	if _, ok := services[service]; !ok && service != "" {
+		logger.Error("Service not found", zap.String("serviceName", service))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		return
+	}
+	recs := getMigrationRecords(service)
+	resp := migrationStatsResp{
+		Overall: computeMigrationStats(recs),
+		Pairs:   migrationStatsByPair(recs),
+	}
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRedactOptions(t *testing.T) {
+	opts := MigrateBody{
+		Copt: CheckpointOptions{Passphrase: "/etc/cm/key", LeaveRun: true},
+		Ropt: RunOptions{PassphraseFile: "/etc/cm/key"},
+		Sopt: StartOptions{Image: "img"},
+		Stop: true,
+	}
+	got := redactOptions(opts)
+	if got.Copt.Passphrase != "[REDACTED]" || got.Ropt.PassphraseFile != "[REDACTED]" {
+		t.Errorf("passphrase files not redacted: %+v", got)
+	}
+	if !got.Copt.LeaveRun || got.Sopt.Image != "img" || !got.Stop {
+		t.Errorf("other options changed: %+v", got)
+	}
+	if opts.Copt.Passphrase != "/etc/cm/key" {
+		t.Errorf("the options given were changed")
+	}
+	if got := redactOptions(MigrateBody{}); got.Copt.Passphrase != "" {
+		t.Errorf("unset passphrase file = %q, want empty", got.Copt.Passphrase)
+	}
+}
+
+func TestMigrationHistoryCap(t *testing.T) {
+	defer func(path string, max int) {
+		migrationHistoryPath, migrationHistoryMax = path, max
+		migrationHistory, historyOnDisk = nil, 0
+	}(migrationHistoryPath, migrationHistoryMax)
+	migrationHistoryPath = filepath.Join(t.TempDir(), "migrations.jsonl")
+	migrationHistoryMax = 10
+	migrationHistory, historyOnDisk = nil, 0
+
+	for i := 0; i < 25; i++ {
+		saveMigrationRecord(MigrationRecord{Id: strconv.Itoa(i), Service: "svc"})
+	}
+	recs := getMigrationRecords("")
+	if len(recs) != 10 || recs[0].Id != "15" || recs[9].Id != "24" {
+		t.Fatalf("kept %d records from %v, want the 10 most recent", len(recs), recs[0].Id)
+	}
+	lines := countLines(t, migrationHistoryPath)
+	if lines > 11 {
+		t.Errorf("history file has %d lines, want at most 11", lines)
+	}
+
+	migrationHistory, historyOnDisk = nil, 0
+	migration_history_init()
+	recs = getMigrationRecords("svc")
+	if len(recs) != 10 || recs[9].Id != "24" {
+		t.Errorf("reloaded %d records, want the 10 most recent", len(recs))
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	n := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
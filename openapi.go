@@ -0,0 +1,247 @@
+package main
+
+//go:generate go run . --gen-openapi API_doc_v2.yml
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+type openapiGen struct {
+	schemas map[string]interface{}
+}
+
+func buildOpenAPISpec() map[string]interface{} {
+	g := &openapiGen{schemas: make(map[string]interface{})}
+	paths := make(map[string]interface{})
+
+	for _, route := range v2Routes {
+		path, params := openapiPath(route.Path)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = g.operation(route, params)
+	}
+	paths[apiV2Prefix+"/openapi"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"tags":    []string{"Manager"},
+			"summary": "Get the OpenAPI document of this API",
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "OK"},
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.2",
+		"info": map[string]interface{}{
+			"title":   "CM Manager APIs Specification",
+			"version": "2.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+// openapiPath converts a gin path like /workers/:worker_id into
+// /cm_manager/v2/workers/{worker_id} and returns the path parameter names.
+func openapiPath(ginPath string) (string, []string) {
+	var params []string
+	segments := strings.Split(ginPath, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			params = append(params, seg[1:])
+			segments[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return apiV2Prefix + strings.Join(segments, "/"), params
+}
+
+func (g *openapiGen) operation(route apiRoute, pathParams []string) map[string]interface{} {
+	op := map[string]interface{}{
+		"tags":    []string{route.Tag},
+		"summary": route.Summary,
+	}
+	if route.Role != roleNone {
+		op["description"] = "Requires role " + route.Role.String() + " on the TCP listener."
+		op["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+	}
+
+	var params []interface{}
+	for _, name := range pathParams {
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, q := range route.Query {
+		params = append(params, map[string]interface{}{
+			"name":        q.Name,
+			"in":          "query",
+			"description": q.Description,
+			"required":    q.Required,
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if route.Body != nil {
+		op["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": g.schemaFor(reflect.TypeOf(route.Body)),
+				},
+			},
+		}
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if route.Response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": g.schemaFor(reflect.TypeOf(route.Response)),
+			},
+		}
+	}
+	errResp := map[string]interface{}{
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": g.schemaFor(reflect.TypeOf(apiError{})),
+			},
+		},
+	}
+	responses := map[string]interface{}{
+		strconv.Itoa(status): success,
+	}
+	if route.Body != nil || route.Method != "GET" {
+		responses["400"] = withDescription(errResp, "Bad Request")
+	}
+	if len(pathParams) > 0 {
+		responses["404"] = withDescription(errResp, "Not Found")
+	}
+	if route.Role != roleNone {
+		responses["401"] = withDescription(errResp, "Unauthorized")
+		responses["403"] = withDescription(errResp, "Forbidden")
+	}
+	op["responses"] = responses
+	return op
+}
+
+func withDescription(resp map[string]interface{}, description string) map[string]interface{} {
+	out := map[string]interface{}{"description": description}
+	for k, v := range resp {
+		out[k] = v
+	}
+	return out
+}
+
+// schemaFor returns the schema of t, registering named struct types under
+// components/schemas and referencing them.
+func (g *openapiGen) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.PkgPath() == "time" && t.Name() == "Time" {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// Placeholder first so recursive types terminate
+			g.schemas[t.Name()] = map[string]interface{}{}
+			g.schemas[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (g *openapiGen) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	g.addFields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (g *openapiGen) addFields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.addFields(f.Type, props)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schemaFor(f.Type)
+	}
+}
+
+func openapiHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, buildOpenAPISpec())
+}
+
+func writeOpenAPISpec(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	enc := yaml.NewEncoder(file)
+	enc.SetIndent(2)
+	if err := enc.Encode(buildOpenAPISpec()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types/mount"
 	"go.uber.org/zap"
@@ -19,6 +21,9 @@ var serviceConfigs = make(map[string]ServiceConfig)
 var workers = make(map[string]Worker)
 
 func addService(name string, image string) (Service, error) {
+	if service, instance := splitInstance(name); instance != "" && image == "" {
+		image = services[service].Image
+	}
 	newService := Service{
 		Name:     name,
 		ChkFiles: []string{},
@@ -56,36 +61,49 @@ func addService(name string, image string) (Service, error) {
 			Envs:          []string{},
 		},
 	}
-	if _, ok := services[name]; !ok {
-		err := mkChkDir(name)
+	if err := checkNewService(name); err == nil {
+		err := mkChkDir(checkpointDir(name))
 		if err != nil {
 			logger.Error("Error creating checkpoint directory", zap.Error(err))
 			return newService, err
 		}
+		stateMu.Lock()
 		services[name] = newService
 		serviceConfigs[name] = newServiceConfig
+		if _, instance := splitInstance(name); instance != "" {
+			addInstanceTo(name)
+		}
+		stateMu.Unlock()
 
 		logger.Debug("Service added", zap.String("serviceName", name))
 		return newService, nil
 	} else {
-		logger.Error("Service already existed", zap.String("serviceName", name))
-		return newService, errors.New("Service already existed")
+		logger.Error("Error adding service", zap.String("serviceName", name), zap.Error(err))
+		return newService, err
 	}
 }
 
-func addWorker(worker_id string, ipAddrPort string, init bool) (Worker, error) {
+func addWorker(ctx context.Context, worker_id string, ipAddrPort string, init bool) (Worker, error) {
+	logger := loggerFrom(ctx)
 	newWorker := Worker{
-		Id:         worker_id,
-		IpAddrPort: ipAddrPort,
-		Status:     "new",
-		Services:   []ServiceInWorker{},
-		countDown:  0,
-		lastSopt:   make(map[string]StartOptions),
-	}
-	if _, ok := workers[worker_id]; !ok {
+		Id:          worker_id,
+		IpAddrPort:  ipAddrPort,
+		Status:      workerNew,
+		Breaker:     breakerClosed,
+		Since:       time.Now().UTC(),
+		Transitions: map[string]time.Time{workerNew: time.Now().UTC()},
+		Services:    []ServiceInWorker{},
+		lastSopt:    make(map[string]StartOptions),
+	}
+	stateMu.Lock()
+	_, exists := workers[worker_id]
+	if !exists {
 		workers[worker_id] = newWorker
+	}
+	stateMu.Unlock()
+	if !exists {
 		if !init {
-			scanServicesOnAWorker(worker_id)
+			scanServicesOnAWorker(ctx, worker_id)
 		}
 		logger.Debug("Worker added", zap.String("workerID", worker_id))
 		return newWorker, nil
@@ -96,6 +114,8 @@ func addWorker(worker_id string, ipAddrPort string, init bool) (Worker, error) {
 }
 
 func addCheckpointFile(name string, path string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	if s, ok := services[name]; !ok {
 		fmt.Printf("Service with name %s not found\n", name)
 	} else {
@@ -106,22 +126,23 @@ func addCheckpointFile(name string, path string) {
 
 }
 
-func deleteService(name string) error {
+func deleteService(ctx context.Context, name string) error {
+	logger := loggerFrom(ctx)
 	for _, worker := range workers {
 		for _, service := range worker.Services {
 			if service.Name == name {
-				status, err := queryServiceStatus(worker.Id, name)
+				status, err := queryServiceStatus(ctx, worker.Id, name)
 				if err != nil {
 					logger.Debug("Error querying service status", zap.Error(err))
 					break
 				} else if status == "running" || status == "paused" || status == "standby" || status == "checkpointed" {
-					err := stopService(worker, services[name])
+					err := stopService(ctx, worker, services[name])
 					if err != nil {
 						logger.Error("Error stopping service", zap.Error(err))
 						return err
 					}
 				}
-				err = removeService(worker, services[name])
+				err = removeService(ctx, worker, services[name])
 				if err != nil {
 					logger.Error("Error removing service", zap.Error(err))
 					return err
@@ -130,7 +151,10 @@ func deleteService(name string) error {
 			}
 		}
 	}
+	stateMu.Lock()
 	delete(services, name)
+	removeInstanceFrom(name)
+	stateMu.Unlock()
 	return nil
 }
 
@@ -162,21 +186,22 @@ func deleteServiceCheckpoint(name string) error {
 	return nil
 }
 
-func unsubscribeService(worker_id string, name string) error {
+func unsubscribeService(ctx context.Context, worker_id string, name string) error {
+	logger := loggerFrom(ctx)
 	worker, ok := workers[worker_id]
 	if !ok {
 		fmt.Printf("Worker with id %s not found\n", worker_id)
 		return errors.New("Worker not found")
 	}
-	url := "http://" + worker.IpAddrPort + "/cm_controller/v1/unsubscribe/" + name
+	url := controllerURL(worker, "/unsubscribe/"+containerName(name))
 
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
 	if err != nil {
 		logger.Error("Error creating request", zap.Error(err))
 		return err
 	}
 	req.Close = true
-	client := &http.Client{}
+	client := controllerClient
 	logger.Debug("Sending request to controller", zap.String("url", url))
 	resp, err := client.Do(req)
 	if err != nil {
@@ -200,7 +225,13 @@ func unsubscribeService(worker_id string, name string) error {
 }
 
 func deleteWorker(worker_id string) {
+	mu.Lock()
+	defer mu.Unlock()
+	stateMu.Lock()
 	delete(workers, worker_id)
+	stateMu.Unlock()
+	detector.forget(worker_id)
+	delete(workerSuspicion, worker_id)
 }
 
 func deleteCheckpointFiles(service string) error {
@@ -210,8 +241,28 @@ func deleteCheckpointFiles(service string) error {
 			"deleteCheckpointFiles"))
 		return errors.New("No service name provided to delete checkpoint files")
 	}
-	dirPath := "/mnt/checkpointfs/" + service + "/"
+	dirPath := "/mnt/checkpointfs/" + checkpointDir(service) + "/"
 
+	if _, instance := splitInstance(service); instance != "" {
+		// The instance shares the directory of its service
+		entries, err := os.ReadDir(dirPath)
+		if err != nil {
+			logger.Error("Error reading service checkpoint directory", zap.Error(err))
+			return err
+		}
+		forgetImageSizes("file:/checkpointfs/" + checkpointDir(service) + "/" + containerName(service) + "_")
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), containerName(service)+"_") {
+				continue
+			}
+			if err := os.RemoveAll(dirPath + entry.Name()); err != nil {
+				logger.Error("Error removing instance checkpoint", zap.Error(err))
+				return err
+			}
+		}
+		return nil
+	}
+	forgetImageSizes("file:/checkpointfs/" + checkpointDir(service) + "/")
 	err := os.RemoveAll(dirPath)
 	if err != nil {
 		logger.Error("Error removing service checkpoint directory", zap.Error(err))
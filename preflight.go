@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+type preflightResult struct {
+	Ok       bool     `json:"ok"`
+	Issues   []string `json:"issues"`   //block the migration
+	Warnings []string `json:"warnings"` //do not
+}
+
+func (r *preflightResult) issue(format string, args ...interface{}) {
+	r.Issues = append(r.Issues, fmt.Sprintf(format, args...))
+}
+
+func (r *preflightResult) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (r preflightResult) err() error {
+	if len(r.Issues) == 0 {
+		return nil
+	}
+	return errors.New("preflight failed: " + strings.Join(r.Issues, "; "))
+}
+
+// preflightMigration checks what would make migrating service from src to
+// dest fail, without changing anything
+func preflightMigration(ctx context.Context, src string, dest string, service string, sopt StartOptions, copt CheckpointOptions) preflightResult {
+	logger := loggerFrom(ctx)
+	res := preflightResult{Issues: []string{}, Warnings: []string{}}
+	svc, ok := services[service]
+	if !ok {
+		res.issue("service %s not found", service)
+	}
+	srcWorker, srcOk := workers[src]
+	destWorker, destOk := workers[dest]
+	if !srcOk {
+		res.issue("source worker %s not found", src)
+	}
+	if !destOk {
+		res.issue("destination worker %s not found", dest)
+	}
+	if src == dest {
+		res.issue("source and destination are the same worker")
+	}
+	if len(res.Issues) > 0 {
+		return res
+	}
+
+	for _, w := range []Worker{srcWorker, destWorker} {
+		if !isWorkerUp(ctx, w.Id) {
+			res.issue("worker %s is not reachable", w.Id)
+		} else if w.Status != "up" {
+			res.warn("worker %s is %s according to its heartbeats", w.Id, w.Status)
+		}
+	}
+	if len(res.Issues) > 0 {
+		return res
+	}
+
+	updateWorkerServices(ctx, src, service)
+	updateWorkerServices(ctx, dest, service)
+	srcWorker, destWorker = workers[src], workers[dest]
+	if isIn, stat := isServiceInWorker(srcWorker, service); !isIn {
+		res.issue("service is not on source worker %s", src)
+	} else if stat != "running" {
+		res.issue("service is %s on source worker %s, not running", stat, src)
+	}
+
+	// Same rules as startServiceContainer, a standby with the same options is reused
+	_, statDest := isServiceInWorker(destWorker, service)
+	sameSopt := reflect.DeepEqual(sopt, destWorker.lastSopt[service])
+	switch {
+	case statDest == "running":
+		res.issue("service is already running on destination worker %s", dest)
+	case (statDest == "standby" || statDest == "checkpointed") && !sameSopt:
+		res.issue("service's container on destination worker %s was started with different options, remove it first", dest)
+	case (statDest == "exited" || statDest == "paused" || statDest == "stopped") && !sameSopt:
+		res.issue("service's container on destination worker %s exists with different options, remove it first", dest)
+	}
+	if sopt.Image == "" {
+		res.issue("no container image for the service")
+	}
+	checkCheckpointImages(svc, copt, &res)
+	if destWorker.Capacity > 0 {
+		running := 0
+		for _, s := range destWorker.Services {
+			if s.Status == "running" {
+				running++
+			}
+		}
+		if running >= destWorker.Capacity {
+			res.warn("destination worker %s is at its capacity of %d services", dest, destWorker.Capacity)
+		}
+	}
+
+	checkCheckpointStorage(svc, &res)
+	res.Ok = len(res.Issues) == 0
+	logger.Debug("Migration preflight", zap.String("service", service), zap.String("src", src), zap.String("dest", dest), zap.Strings("issues", res.Issues), zap.Strings("warnings", res.Warnings))
+	return res
+}
+
+// checkCheckpointImages checks that the images the checkpoint builds on are
+// on the shared FS. A missing last checkpoint only warns, the migration takes
+// a new one, but the catalog no longer matches the storage.
+func checkCheckpointImages(svc Service, copt CheckpointOptions, res *preflightResult) {
+	if copt.ParentImage != "" && !imageExists(copt.ParentImage) {
+		res.issue("parent image %s is missing from the checkpoint storage", copt.ParentImage)
+	}
+	if len(svc.ChkFiles) > 0 {
+		if last := svc.ChkFiles[len(svc.ChkFiles)-1]; !imageExists(last) {
+			res.warn("last checkpoint %s is missing from the checkpoint storage", last)
+		}
+	}
+}
+
+func imageExists(imgUrl string) bool {
+	info, err := os.Stat(checkpointLocalPath(imgUrl))
+	return err == nil && info.IsDir()
+}
+
+// W_OK of access(2)
+const accessWrite = 0x2
+
+// checkCheckpointStorage checks that the service's checkpoint dir is writable
+// and has room for an image the size of the last one
+func checkCheckpointStorage(svc Service, res *preflightResult) {
+	dir := checkpointLocalPath("file:/checkpointfs/" + checkpointDir(svc.Name))
+	if err := syscall.Access(dir, accessWrite); err != nil {
+		res.issue("checkpoint directory %s is not writable: %v", dir, err)
+		return
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		res.warn("cannot read free space of %s: %v", dir, err)
+		return
+	}
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	if len(svc.ChkFiles) == 0 {
+		return
+	}
+	size, err := checkpointImageSize(svc.ChkFiles[len(svc.ChkFiles)-1])
+	if err != nil {
+		return
+	}
+	if free < uint64(size) {
+		res.issue("checkpoint storage has %d bytes free, the last image took %d", free, size)
+	} else if free < 2*uint64(size) {
+		res.warn("checkpoint storage has %d bytes free, the last image took %d", free, size)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreflightMigration(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T)
+		dest    string
+		copt    CheckpointOptions
+		issue   string
+		warning string
+	}{
+		{name: "ok", dest: "w2"},
+		{name: "same worker", dest: "w1", issue: "same worker"},
+		{
+			name:  "already running on dest",
+			dest:  "w2",
+			setup: func(t *testing.T) { runOn(t, "w2", "a") },
+			issue: "already running on destination",
+		},
+		{
+			name:  "parent image missing",
+			dest:  "w2",
+			copt:  CheckpointOptions{ParentImage: "file:/checkpointfs/a/a_w1_gone"},
+			issue: "parent image file:/checkpointfs/a/a_w1_gone is missing",
+		},
+		{
+			name: "last checkpoint missing",
+			dest: "w2",
+			setup: func(t *testing.T) {
+				addCheckpointFile("a", "file:/checkpointfs/a/a_w1_gone")
+			},
+			warning: "last checkpoint file:/checkpointfs/a/a_w1_gone is missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCluster(t, []string{"w1", "w2"}, "a")
+			sopt := runOn(t, "w1", "a")
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+			res := preflightMigration(context.Background(), "w1", tt.dest, "a", sopt, tt.copt)
+			if tt.issue == "" && !res.Ok {
+				t.Errorf("issues = %v, want none", res.Issues)
+			}
+			if tt.issue != "" && (res.Ok || !strings.Contains(strings.Join(res.Issues, "; "), tt.issue)) {
+				t.Errorf("issues = %v, want %q", res.Issues, tt.issue)
+			}
+			if tt.warning != "" && !strings.Contains(strings.Join(res.Warnings, "; "), tt.warning) {
+				t.Errorf("warnings = %v, want %q", res.Warnings, tt.warning)
+			}
+		})
+	}
+}
+
+func TestCheckpointImageSizeIsCached(t *testing.T) {
+	img := "file:/checkpointfs/sizes/sizes_w1_2024"
+	dir := checkpointLocalPath(img)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "pages-1.img"), make([]byte, 100), 0644)
+	defer forgetImageSizes("file:/checkpointfs/sizes/")
+
+	if size, err := checkpointImageSize(img); err != nil || size != 100 {
+		t.Fatalf("size = %d, %v, want 100", size, err)
+	}
+	os.WriteFile(filepath.Join(dir, "pages-2.img"), make([]byte, 50), 0644)
+	if size, _ := checkpointImageSize(img); size != 100 {
+		t.Errorf("size = %d, want the cached 100", size)
+	}
+	forgetImageSizes("file:/checkpointfs/sizes/")
+	if size, _ := checkpointImageSize(img); size != 150 {
+		t.Errorf("size = %d after forgetting, want 150", size)
+	}
+	if _, err := checkpointImageSize("file:/checkpointfs/sizes/missing"); err == nil {
+		t.Errorf("no error for a missing image")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+type rebalanceReq struct {
+	Evacuate    []string          `json:"evacuate"`    //workers to empty
+	Concurrency int               `json:"concurrency"` //migrations run at the same time, default 1
+	Copt        CheckpointOptions `json:"copt"`
+	Ropt        RunOptions        `json:"ropt"`
+}
+
+type rebalanceStep struct {
+	Service  string  `json:"service"`
+	Src      string  `json:"src"`
+	Dest     string  `json:"dest"`
+	Status   string  `json:"status"`            //planned, success or failed
+	Outcome  string  `json:"outcome,omitempty"` //outcome of the migration, see MigrationRecord
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type rebalancePlan struct {
+	Before   map[string]int  `json:"before"` //running services per worker
+	After    map[string]int  `json:"after"`
+	Steps    []rebalanceStep `json:"steps"`
+	Unplaced []string        `json:"unplaced,omitempty"` //services of evacuated workers without a destination
+}
+
+// planRebalance computes the migrations that empty the evacuated workers,
+// bring every worker under its capacity and then even out the number of
+// running services between the up workers. Every step moves one service by
+// one and no service is moved twice, so the plan is the smallest greedy one.
+func planRebalance(evacuate []string) rebalancePlan {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	evac := make(map[string]bool)
+	for _, id := range evacuate {
+		evac[id] = true
+	}
+
+	plan := rebalancePlan{Before: make(map[string]int), After: make(map[string]int), Steps: []rebalanceStep{}}
+	load := make(map[string]int)
+	capacity := make(map[string]int)
+	movable := make(map[string][]string)
+	targets := []string{}
+	for id, w := range workers {
+		if w.Status != "up" && !evac[id] {
+			continue
+		}
+		for _, s := range w.Services {
+			if s.Status != "running" {
+				continue
+			}
+			load[id]++
+			if _, ok := services[s.Name]; ok {
+				movable[id] = append(movable[id], s.Name)
+			} else if evac[id] {
+				plan.Unplaced = append(plan.Unplaced, s.Name)
+			}
+		}
+		sort.Strings(movable[id])
+		plan.Before[id] = load[id]
+		capacity[id] = w.Capacity
+		if !evac[id] {
+			targets = append(targets, id)
+		}
+	}
+	sort.Strings(targets)
+
+	// pickTarget returns the least loaded worker with room left, "" if none
+	pickTarget := func(exclude string) string {
+		best := ""
+		for _, id := range targets {
+			if id == exclude || (capacity[id] > 0 && load[id] >= capacity[id]) {
+				continue
+			}
+			if best == "" || load[id] < load[best] {
+				best = id
+			}
+		}
+		return best
+	}
+	move := func(src string, dest string) {
+		service := movable[src][0]
+		movable[src] = movable[src][1:]
+		load[src]--
+		load[dest]++
+		plan.Steps = append(plan.Steps, rebalanceStep{Service: service, Src: src, Dest: dest, Status: "planned"})
+	}
+
+	for _, id := range sortedKeys(evac) {
+		for len(movable[id]) > 0 {
+			dest := pickTarget(id)
+			if dest == "" {
+				plan.Unplaced = append(plan.Unplaced, movable[id]...)
+				movable[id] = nil
+				break
+			}
+			move(id, dest)
+		}
+	}
+	for _, id := range targets {
+		for capacity[id] > 0 && load[id] > capacity[id] && len(movable[id]) > 0 {
+			dest := pickTarget(id)
+			if dest == "" {
+				break
+			}
+			move(id, dest)
+		}
+	}
+	for {
+		src := ""
+		for _, id := range targets {
+			if len(movable[id]) > 0 && (src == "" || load[id] > load[src]) {
+				src = id
+			}
+		}
+		if src == "" {
+			break
+		}
+		dest := pickTarget(src)
+		if dest == "" || load[src]-load[dest] <= 1 {
+			break
+		}
+		move(src, dest)
+	}
+
+	for id := range plan.Before {
+		plan.After[id] = load[id]
+	}
+	return plan
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// executeRebalance runs the steps of the plan, at most concurrency at a
+// time. A failed step is rolled back by migrateService and does not stop the
+// other steps.
+func executeRebalance(ctx context.Context, plan *rebalancePlan, req rebalanceReq) {
+	logger := loggerFrom(ctx)
+	ctx, span := tracer.Start(ctx, "rebalance", trace.WithAttributes(attribute.Int("cm.steps", len(plan.Steps))))
+	defer span.End()
+
+	concurrency := req.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range plan.Steps {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(step *rebalanceStep) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			service, _ := getService(step.Service)
+			sopt := lastStartOptions(step.Src, step.Service)
+			if sopt.ContainerName == "" {
+				sopt.ContainerName = step.Service
+			}
+			if sopt.Image == "" {
+				sopt.Image = service.Image
+			}
+			rec, err := migrateService(ctx, step.Src, step.Dest, service, req.Copt, req.Ropt, sopt, true)
+			step.Outcome = rec.Outcome
+			if err != nil {
+				logger.Error("Rebalance step failed", zap.String("service", step.Service), zap.String("src", step.Src), zap.String("dest", step.Dest), zap.Error(err))
+				step.Status = "failed"
+				step.Error = err.Error()
+				return
+			}
+			step.Status = "success"
+			step.Duration = rec.Duration
+		}(&plan.Steps[i])
+	}
+	wg.Wait()
+}
+
+func rebalanceHandler(dryRun bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := loggerFrom(c.Request.Context())
+		logger.Debug("request", zap.String("method", "post"), zap.String("path", c.Request.URL.Path))
+		var requestBody rebalanceReq
+		if err := c.ShouldBindJSON(&requestBody); err != nil && c.Request.ContentLength != 0 {
+			logger.Error("Error decoding JSON", zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
+			return
+		}
+		for _, id := range requestBody.Evacuate {
+			if _, ok := workers[id]; !ok {
+				logger.Error("Worker not found", zap.String("workerID", id))
+				c.JSON(http.StatusNotFound, gin.H{"error": "Worker not found: " + id})
+				return
+			}
+		}
+		for id := range workers {
+			updateWorkerServices(c.Request.Context(), id, "")
+		}
+		plan := planRebalance(requestBody.Evacuate)
+		if dryRun {
+			logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+			c.JSON(http.StatusOK, plan)
+			return
+		}
+		if len(plan.Unplaced) > 0 {
+			logger.Error("Not enough capacity to evacuate", zap.Strings("unplaced", plan.Unplaced))
+			c.JSON(http.StatusConflict, gin.H{"error": "Not enough capacity to evacuate", "unplaced": plan.Unplaced})
+			return
+		}
+		names := []string{}
+		stepWorkers := make(map[string][]string)
+		for _, step := range plan.Steps {
+			names = append(names, step.Service)
+			stepWorkers[step.Service] = append(stepWorkers[step.Service], step.Src, step.Dest)
+		}
+		ctx, release, ok := lockForRequest(c, names, "rebalance", func(name string) []string { return stepWorkers[name] })
+		if !ok {
+			return
+		}
+		defer release()
+		logger.Info("Rebalancing", zap.Int("steps", len(plan.Steps)), zap.Strings("evacuate", requestBody.Evacuate))
+		executeRebalance(ctx, &plan, requestBody)
+
+		status := http.StatusOK
+		for _, step := range plan.Steps {
+			if step.Status != "success" {
+				status = http.StatusMultiStatus
+			}
+		}
+		logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Int("status", status))
+		c.JSON(status, plan)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func running(names ...string) []ServiceInWorker {
+	s := []ServiceInWorker{}
+	for _, n := range names {
+		s = append(s, ServiceInWorker{Name: n, Status: "running"})
+	}
+	return s
+}
+
+func catalog(names ...string) map[string]Service {
+	s := make(map[string]Service)
+	for _, n := range names {
+		s[n] = Service{Name: n}
+	}
+	return s
+}
+
+func TestPlanRebalance(t *testing.T) {
+	tests := []struct {
+		name     string
+		workers  map[string]Worker
+		evacuate []string
+		steps    []rebalanceStep
+		after    map[string]int
+		unplaced []string
+	}{
+		{
+			name: "balanced cluster is left alone",
+			workers: map[string]Worker{
+				"w1": {Status: "up", Services: running("a")},
+				"w2": {Status: "up", Services: running("b")},
+			},
+			steps: []rebalanceStep{},
+			after: map[string]int{"w1": 1, "w2": 1},
+		},
+		{
+			name: "evacuate spreads over the least loaded workers",
+			workers: map[string]Worker{
+				"w1": {Status: "up", Services: running("a", "b")},
+				"w2": {Status: "up"},
+				"w3": {Status: "up", Services: running("c")},
+			},
+			evacuate: []string{"w1"},
+			steps: []rebalanceStep{
+				{Service: "a", Src: "w1", Dest: "w2", Status: "planned"},
+				{Service: "b", Src: "w1", Dest: "w2", Status: "planned"},
+			},
+			after: map[string]int{"w1": 0, "w2": 2, "w3": 1},
+		},
+		{
+			name: "a worker over capacity is brought under it",
+			workers: map[string]Worker{
+				"w1": {Status: "up", Capacity: 1, Services: running("a", "b", "c")},
+				"w2": {Status: "up"},
+			},
+			steps: []rebalanceStep{
+				{Service: "a", Src: "w1", Dest: "w2", Status: "planned"},
+				{Service: "b", Src: "w1", Dest: "w2", Status: "planned"},
+			},
+			after: map[string]int{"w1": 1, "w2": 2},
+		},
+		{
+			name: "load is evened out to a difference of one",
+			workers: map[string]Worker{
+				"w1": {Status: "up", Services: running("a", "b", "c", "d", "e")},
+				"w2": {Status: "up"},
+			},
+			steps: []rebalanceStep{
+				{Service: "a", Src: "w1", Dest: "w2", Status: "planned"},
+				{Service: "b", Src: "w1", Dest: "w2", Status: "planned"},
+			},
+			after: map[string]int{"w1": 3, "w2": 2},
+		},
+		{
+			name: "workers that are not up are no destination",
+			workers: map[string]Worker{
+				"w1": {Status: "up", Services: running("a")},
+				"w2": {Status: "down"},
+				"w3": {Status: "suspect"},
+			},
+			evacuate: []string{"w1"},
+			steps:    []rebalanceStep{},
+			after:    map[string]int{"w1": 1},
+			unplaced: []string{"a"},
+		},
+		{
+			name: "full workers leave the rest unplaced",
+			workers: map[string]Worker{
+				"w1": {Status: "up", Services: running("a", "b")},
+				"w2": {Status: "up", Capacity: 2, Services: running("c")},
+			},
+			evacuate: []string{"w1"},
+			steps: []rebalanceStep{
+				{Service: "a", Src: "w1", Dest: "w2", Status: "planned"},
+			},
+			after:    map[string]int{"w1": 1, "w2": 2},
+			unplaced: []string{"b"},
+		},
+		{
+			name: "only running services are moved",
+			workers: map[string]Worker{
+				"w1": {Status: "up", Services: []ServiceInWorker{{Name: "a", Status: "running"}, {Name: "b", Status: "standby"}, {Name: "c", Status: "checkpointed"}}},
+				"w2": {Status: "up"},
+			},
+			evacuate: []string{"w1"},
+			steps: []rebalanceStep{
+				{Service: "a", Src: "w1", Dest: "w2", Status: "planned"},
+			},
+			after: map[string]int{"w1": 0, "w2": 1},
+		},
+		{
+			name: "unknown containers of an evacuated worker are unplaced",
+			workers: map[string]Worker{
+				"w1": {Status: "up", Services: running("a", "stray")},
+				"w2": {Status: "up"},
+			},
+			evacuate: []string{"w1"},
+			steps: []rebalanceStep{
+				{Service: "a", Src: "w1", Dest: "w2", Status: "planned"},
+			},
+			after:    map[string]int{"w1": 1, "w2": 1},
+			unplaced: []string{"stray"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withState(t, tt.workers, catalog("a", "b", "c", "d", "e"))
+			plan := planRebalance(tt.evacuate)
+			if !reflect.DeepEqual(plan.Steps, tt.steps) {
+				t.Errorf("steps = %+v, want %+v", plan.Steps, tt.steps)
+			}
+			if !reflect.DeepEqual(plan.After, tt.after) {
+				t.Errorf("after = %v, want %v", plan.After, tt.after)
+			}
+			if !reflect.DeepEqual(plan.Unplaced, tt.unplaced) {
+				t.Errorf("unplaced = %v, want %v", plan.Unplaced, tt.unplaced)
+			}
+		})
+	}
+}
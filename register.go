@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Auto-registration: with --auto-register a heartbeat from an unknown worker
+// carrying its controller address adds the worker, and a heartbeat with a new
+// address moves a known one. Both need the join token when one is set and a
+// source IP in the allowed CIDRs when some are set.
+var autoRegister = false
+var joinToken = ""
+var joinCIDRs []*net.IPNet
+
+func join_token_init(path string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error("Error reading join token file", zap.Error(err))
+		return
+	}
+	joinToken = strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+}
+
+// join_cidrs_init reads a comma separated list of CIDRs
+func join_cidrs_init(list string) {
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			logger.Error("Invalid join CIDR", zap.String("cidr", s), zap.Error(err))
+			continue
+		}
+		joinCIDRs = append(joinCIDRs, cidr)
+	}
+}
+
+// checkJoin tells whether the heartbeat may register or move a worker. A
+// known worker is only moved when joins are restricted, otherwise any host
+// could take over its controller traffic.
+func checkJoin(c *gin.Context, body heartbeatBody, move bool) error {
+	if move && joinToken == "" && len(joinCIDRs) == 0 {
+		return errors.New("moving a worker needs --join-token-file or --join-cidrs on the manager")
+	}
+	if joinToken != "" && subtle.ConstantTimeCompare([]byte(body.JoinToken), []byte(joinToken)) != 1 {
+		return errors.New("invalid join token")
+	}
+	if len(joinCIDRs) > 0 {
+		// The peer address, not X-Forwarded-For, which the worker could forge
+		ip := net.ParseIP(c.RemoteIP())
+		allowed := false
+		for _, cidr := range joinCIDRs {
+			if ip != nil && cidr.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("source address not allowed to join")
+		}
+	}
+	return nil
+}
+
+// heartbeatAddr completes the controller address of a heartbeat, ":8787" or
+// "https://:8787" take the host the heartbeat came from
+func heartbeatAddr(c *gin.Context, addr string) string {
+	scheme := ""
+	hostPort := addr
+	if i := strings.Index(addr, "://"); i >= 0 {
+		scheme, hostPort = addr[:i+3], addr[i+3:]
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || host != "" {
+		return addr
+	}
+	return scheme + net.JoinHostPort(c.RemoteIP(), port)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckJoin(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("192.0.2.0/24")
+	_, other, _ := net.ParseCIDR("198.51.100.0/24")
+	tests := []struct {
+		name    string
+		token   string
+		cidrs   []*net.IPNet
+		body    heartbeatBody
+		move    bool
+		wantErr bool
+	}{
+		{name: "open join registers"},
+		{name: "open join can't move a worker", move: true, wantErr: true},
+		{name: "token", token: "t0k", body: heartbeatBody{JoinToken: "t0k"}},
+		{name: "token moves a worker", token: "t0k", body: heartbeatBody{JoinToken: "t0k"}, move: true},
+		{name: "wrong token", token: "t0k", body: heartbeatBody{JoinToken: "nope"}, wantErr: true},
+		{name: "wrong token can't move", token: "t0k", body: heartbeatBody{JoinToken: "nope"}, move: true, wantErr: true},
+		{name: "allowed source moves a worker", cidrs: []*net.IPNet{allowed}, move: true},
+		{name: "source not allowed", cidrs: []*net.IPNet{other}, wantErr: true},
+		{name: "source not allowed can't move", cidrs: []*net.IPNet{other}, move: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldToken, oldCIDRs := joinToken, joinCIDRs
+			joinToken, joinCIDRs = tt.token, tt.cidrs
+			t.Cleanup(func() { joinToken, joinCIDRs = oldToken, oldCIDRs })
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("POST", "/heartbeat", nil)
+			c.Request.RemoteAddr = "192.0.2.7:40000"
+
+			err := checkJoin(c, tt.body, tt.move)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
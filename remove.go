@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,17 +10,18 @@ import (
 	"go.uber.org/zap"
 )
 
-func removeService(worker Worker, service Service) error {
-	url := "http://" + worker.IpAddrPort + "/cm_controller/v1/remove/" + service.Name
+func removeService(ctx context.Context, worker Worker, service Service) error {
+	logger := loggerFrom(ctx)
+	url := controllerURL(worker, "/remove/"+containerName(service.Name))
 	logger.Debug("Removing service", zap.String("worker", worker.Id), zap.String("service", service.Name))
 
-	req, err := http.NewRequest("DELETE", url, bytes.NewBuffer(nil))
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, bytes.NewBuffer(nil))
 	if err != nil {
 		logger.Error("Error creating request", zap.Error(err))
 		return err
 	}
 	req.Close = true
-	client := &http.Client{}
+	client := controllerClient
 	logger.Debug("Sending request to controller", zap.String("url", url))
 	resp, err := client.Do(req)
 	if err != nil {
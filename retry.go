@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// retryPolicy tells how a controller operation is retried. A response with a
+// status in RetryOn is retried, as is a failure to connect. Other transport
+// errors happen once the request may have reached the controller, they are
+// only retried for Idempotent operations.
+type retryPolicy struct {
+	Attempts   int //including the first one, 1 means no retry
+	RetryOn    []int
+	Idempotent bool
+	BaseDelay  time.Duration //doubled after each attempt, with jitter
+	MaxDelay   time.Duration
+}
+
+// retryPolicies per controller operation, see controllerOperation. Start and
+// checkpoint are not retried once they reached the controller, a second try
+// would create another container or image.
+var retryPolicies = map[string]retryPolicy{
+	"start":       {Attempts: 2, RetryOn: []int{503}, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+	"run":         {Attempts: 2, RetryOn: []int{500, 503}, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+	"checkpoint":  {Attempts: 2, RetryOn: []int{503}, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+	"stop":        {Attempts: 3, RetryOn: []int{500, 502, 503, 504}, Idempotent: true, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+	"remove":      {Attempts: 3, RetryOn: []int{500, 502, 503, 504}, Idempotent: true, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+	"service":     {Attempts: 3, RetryOn: []int{502, 503, 504}, Idempotent: true, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second},
+	"unsubscribe": {Attempts: 3, RetryOn: []int{502, 503, 504}, Idempotent: true, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second},
+	"up":          {Attempts: 1}, //liveness probe, a retry would only delay the answer
+}
+
+var retryPoliciesMu sync.RWMutex
+
+var (
+	controllerRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm_manager_controller_retries_total",
+		Help: "Retried requests to worker controllers by operation and reason (status code or error).",
+	}, []string{"operation", "reason"})
+	controllerRetriesExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm_manager_controller_retries_exhausted_total",
+		Help: "Requests to worker controllers that still failed after their last attempt.",
+	}, []string{"operation"})
+)
+
+func retryPolicyFor(op string) retryPolicy {
+	retryPoliciesMu.RLock()
+	defer retryPoliciesMu.RUnlock()
+	p, ok := retryPolicies[op]
+	if !ok || p.Attempts < 1 {
+		p.Attempts = 1
+	}
+	return p
+}
+
+// retryable returns the reason to retry a response or error, "" if it must
+// not be retried
+func (p retryPolicy) retryable(resp *http.Response, err error) string {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return ""
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return "connect"
+		}
+		if p.Idempotent {
+			return "error"
+		}
+		return ""
+	}
+	for _, code := range p.RetryOn {
+		if resp.StatusCode == code {
+			return strconv.Itoa(code)
+		}
+	}
+	return ""
+}
+
+// backoff returns the delay before the attempt following attempt, between
+// half and all of BaseDelay*2^(attempt-1) capped to MaxDelay
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if p.MaxDelay > 0 && (d > p.MaxDelay || d <= 0) {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryRecord reports a controller call that needed more than one attempt
+type retryRecord struct {
+	Operation string   `json:"operation"`
+	Worker    string   `json:"worker"` //controller address
+	Attempts  int      `json:"attempts"`
+	Reasons   []string `json:"reasons"` //why each failed attempt was retried
+	Succeeded bool     `json:"succeeded"`
+}
+
+// retryReport collects the retries of the controller calls made for a request
+type retryReport struct {
+	mu      sync.Mutex
+	records []retryRecord
+}
+
+type retryReportKey struct{}
+
+func withRetryReport(ctx context.Context) (context.Context, *retryReport) {
+	r := &retryReport{}
+	return context.WithValue(ctx, retryReportKey{}, r), r
+}
+
+func (r *retryReport) add(rec retryRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, rec)
+}
+
+func (r *retryReport) list() []retryRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]retryRecord(nil), r.records...)
+}
+
+// addTo adds the retries to a response body when there were any
+func (r *retryReport) addTo(body map[string]interface{}) map[string]interface{} {
+	if records := r.list(); len(records) > 0 {
+		body["retries"] = records
+	}
+	return body
+}
+
+// retryTransport retries controller requests according to the policy of
+// their operation
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := controllerOperation(req.URL.Path)
+	policy := retryPolicyFor(op)
+	ctx := req.Context()
+	var reasons []string
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 {
+			attemptReq = req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				attemptReq.Body = body
+			}
+		}
+		resp, err := t.base.RoundTrip(attemptReq)
+		reason := policy.retryable(resp, err)
+		if reason == "" || attempt >= policy.Attempts || (req.Body != nil && req.GetBody == nil) {
+			if len(reasons) > 0 {
+				succeeded := reason == "" && err == nil && resp.StatusCode < 400
+				if !succeeded {
+					controllerRetriesExhausted.WithLabelValues(op).Inc()
+				}
+				if report, ok := ctx.Value(retryReportKey{}).(*retryReport); ok {
+					report.add(retryRecord{Operation: op, Worker: req.URL.Host, Attempts: attempt, Reasons: reasons, Succeeded: succeeded})
+				}
+			}
+			return resp, err
+		}
+
+		reasons = append(reasons, reason)
+		controllerRetries.WithLabelValues(op, reason).Inc()
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		delay := policy.backoff(attempt)
+		loggerFrom(ctx).Warn("Retrying controller request", zap.String("operation", op), zap.String("url", req.URL.String()), zap.Int("attempt", attempt), zap.String("reason", reason), zap.Duration("delay", delay))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func retryControllerClient() {
+	base := controllerClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	controllerClient.Transport = retryTransport{base: base}
+}
+
+// retry_policy_init reads policies overriding the defaults, one operation
+// per line: "<operation> [attempts=N] [retry_on=500,503] [idempotent=true]
+// [base_delay=200ms] [max_delay=2s]". Unset keys keep the default.
+func retry_policy_init(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Error("Error opening retry policy file", zap.Error(err))
+		return
+	}
+	defer file.Close()
+
+	retryPoliciesMu.Lock()
+	defer retryPoliciesMu.Unlock()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		op := fields[0]
+		p, err := parseRetryPolicy(retryPolicies[op], fields[1:])
+		if err != nil {
+			logger.Error("Invalid retry policy, keeping the previous one", zap.String("operation", op), zap.Error(err))
+			continue
+		}
+		retryPolicies[op] = p
+		logger.Debug("Retry policy", zap.String("operation", op), zap.Any("policy", p))
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Error("Error reading retry policy file", zap.Error(err))
+	}
+}
+
+// parseRetryPolicy applies the key=value fields of a policy line to p. Any
+// invalid field fails the whole line, so a typo can't change part of a policy.
+func parseRetryPolicy(p retryPolicy, fields []string) (retryPolicy, error) {
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("field %q is not key=value", field)
+		}
+		var err error
+		switch kv[0] {
+		case "attempts":
+			p.Attempts, err = strconv.Atoi(kv[1])
+		case "retry_on":
+			codes := []int{}
+			for _, s := range strings.Split(kv[1], ",") {
+				var code int
+				if code, err = strconv.Atoi(s); err != nil {
+					break
+				}
+				codes = append(codes, code)
+			}
+			p.RetryOn = codes
+		case "idempotent":
+			p.Idempotent, err = strconv.ParseBool(kv[1])
+		case "base_delay":
+			p.BaseDelay, err = time.ParseDuration(kv[1])
+		case "max_delay":
+			p.MaxDelay, err = time.ParseDuration(kv[1])
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return p, fmt.Errorf("field %q: %w", field, err)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetryPolicy(t *testing.T) {
+	base := retryPolicy{Attempts: 2, RetryOn: []int{503}, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second}
+	tests := []struct {
+		name    string
+		fields  []string
+		want    retryPolicy
+		wantErr bool
+	}{
+		{name: "no fields keeps the policy", want: base},
+		{
+			name:   "all keys",
+			fields: []string{"attempts=4", "retry_on=500,502", "idempotent=true", "base_delay=50ms", "max_delay=1s"},
+			want:   retryPolicy{Attempts: 4, RetryOn: []int{500, 502}, Idempotent: true, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second},
+		},
+		{
+			name:   "unset keys keep the default",
+			fields: []string{"attempts=5"},
+			want:   retryPolicy{Attempts: 5, RetryOn: []int{503}, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second},
+		},
+		{name: "bad retry_on code", fields: []string{"attempts=5", "retry_on=500,5o3"}, wantErr: true},
+		{name: "bad attempts", fields: []string{"attempts=x", "retry_on=500"}, wantErr: true},
+		{name: "bad duration", fields: []string{"base_delay=200"}, wantErr: true},
+		{name: "unknown key", fields: []string{"atempts=3"}, wantErr: true},
+		{name: "not key=value", fields: []string{"idempotent"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRetryPolicy(base, tt.fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("policy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+	tests := []struct {
+		name       string
+		idempotent bool
+		status     int
+		err        error
+		want       string
+	}{
+		{name: "listed status", status: 503, want: "503"},
+		{name: "other status", status: 500, want: ""},
+		{name: "success", status: 200, want: ""},
+		{name: "connect failure", err: dialErr, want: "connect"},
+		{name: "wrapped connect failure", err: fmt.Errorf("post: %w", dialErr), want: "connect"},
+		{name: "error after sending", err: readErr, want: ""},
+		{name: "error after sending, idempotent", idempotent: true, err: readErr, want: "error"},
+		{name: "canceled", idempotent: true, err: context.Canceled, want: ""},
+		{name: "deadline", idempotent: true, err: context.DeadlineExceeded, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := retryPolicy{Attempts: 3, RetryOn: []int{502, 503}, Idempotent: tt.idempotent}
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+			if got := p.retryable(resp, tt.err); got != tt.want {
+				t.Errorf("retryable = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     time.Duration
+		max      time.Duration
+		attempt  int
+		min, top time.Duration
+	}{
+		{name: "first attempt", base: 100 * time.Millisecond, max: time.Second, attempt: 1, min: 50 * time.Millisecond, top: 100 * time.Millisecond},
+		{name: "doubled", base: 100 * time.Millisecond, max: time.Second, attempt: 3, min: 200 * time.Millisecond, top: 400 * time.Millisecond},
+		{name: "capped", base: 100 * time.Millisecond, max: time.Second, attempt: 6, min: 500 * time.Millisecond, top: time.Second},
+		{name: "overflow is capped", base: 100 * time.Millisecond, max: time.Second, attempt: 80, min: 500 * time.Millisecond, top: time.Second},
+		{name: "no delay", attempt: 2, min: 0, top: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := retryPolicy{BaseDelay: tt.base, MaxDelay: tt.max}
+			for i := 0; i < 50; i++ {
+				if d := p.backoff(tt.attempt); d < tt.min || d > tt.top {
+					t.Fatalf("backoff(%d) = %v, want in [%v, %v]", tt.attempt, d, tt.min, tt.top)
+				}
+			}
+		})
+	}
+}
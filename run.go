@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,10 +11,9 @@ import (
 	"go.uber.org/zap"
 )
 
-var runCount = 0
-
-func runService(worker Worker, service Service, option RunOptions) error {
-	url := "http://" + worker.IpAddrPort + "/cm_controller/v1/run/" + service.Name
+func runService(ctx context.Context, worker Worker, service Service, option RunOptions) error {
+	logger := loggerFrom(ctx)
+	url := controllerURL(worker, "/run/"+containerName(service.Name))
 	logger.Debug("Running service", zap.String("worker", worker.Id), zap.String("service", service.Name))
 	requestBody, err := json.Marshal(option)
 	if err != nil {
@@ -21,7 +21,7 @@ func runService(worker Worker, service Service, option RunOptions) error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(requestBody))
 	if err != nil {
 		logger.Error("Error creating request", zap.Error(err))
 		return err
@@ -29,7 +29,7 @@ func runService(worker Worker, service Service, option RunOptions) error {
 
 	req.Close = true
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client := controllerClient
 	logger.Debug("Sending request to controller", zap.String("url", url))
 	resp, err := client.Do(req)
 	if err != nil {
@@ -44,20 +44,16 @@ func runService(worker Worker, service Service, option RunOptions) error {
 		return err
 	}
 
-	updateWorkerServices(worker.Id, service.Name)	
+	updateWorkerServices(ctx, worker.Id, service.Name)	
 	if resp.StatusCode != 200 {
-		if resp.StatusCode == 500 && runCount < 1 {
-			runCount++
-			logger.Error("Run Error 500 will try again", zap.String("worker", worker.Id), zap.String("service", service.Name))
-			return runService(worker, service, option)
-
-		}
 		logger.Error("Run service fail at worker", zap.String("worker", worker.Id), zap.String("service", service.Name), zap.Int("status_code", resp.StatusCode), zap.String("body", string(body)))
 		return fmt.Errorf("run service fail at worker with response code %d", resp.StatusCode)
 	}
+	stateMu.Lock()
 	config := serviceConfigs[service.Name]
 	config.RunOpt = option
 	serviceConfigs[service.Name] = config
+	stateMu.Unlock()
 
 	logger.Info("Run service at worker succesfully", zap.String("worker", worker.Id), zap.String("service", service.Name))
 	return nil
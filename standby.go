@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+var standbyInterval = 10 * time.Second
+
+// standbyOwned holds per service the workers whose standby container was
+// started by the reconciler, only those are recreated or removed by it
+var standbyOwned = make(map[string]map[string]bool)
+
+type StandbyConfig struct {
+	Count   int      `json:"count"`   //warm containers to keep, 0 keeps one on each of Workers
+	Workers []string `json:"workers"` //workers to keep them on, empty to let the manager choose
+}
+
+type standbyStatus struct {
+	StandbyConfig
+	Warm []string `json:"warm"` //workers with a standby container matching the start options
+}
+
+// isWarm tells whether worker has a standby container of service started with sopt
+func isWarm(worker Worker, service string, sopt StartOptions) bool {
+	_, stat := isServiceInWorker(worker, service)
+	return stat == "standby" && reflect.DeepEqual(worker.lastSopt[service], sopt)
+}
+
+func warmWorkers(service string) []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	sopt := serviceConfigs[service].StartOpt
+	warm := []string{}
+	for id, w := range workers {
+		if w.Status == "up" && isWarm(w, service, sopt) {
+			warm = append(warm, id)
+		}
+	}
+	sort.Strings(warm)
+	return warm
+}
+
+// warmWorkerFor returns an up worker, other than exclude, with a standby
+// container of service and the start options to reuse it
+func warmWorkerFor(service string, exclude string) (string, StartOptions, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	ids := []string{}
+	for id := range workers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		w := workers[id]
+		if _, stat := isServiceInWorker(w, service); id != exclude && w.Status == "up" && stat == "standby" {
+			return id, w.lastSopt[service], true
+		}
+	}
+	return "", StartOptions{}, false
+}
+
+func reconcileStandbys(ctx context.Context) {
+	names := []string{}
+	stateMu.Lock()
+	for name, config := range serviceConfigs {
+		if config.Standby.Count > 0 || len(config.Standby.Workers) > 0 || len(standbyOwned[name]) > 0 {
+			names = append(names, name)
+		}
+	}
+	stateMu.Unlock()
+	for _, name := range names {
+		reconcileStandby(ctx, name)
+	}
+}
+
+// reconcileStandby keeps Count standby containers of service started with
+// its current start options. Standbys it started with older options are
+// recreated, the ones above Count removed. A service busy with another
+// operation is left for the next round.
+func reconcileStandby(ctx context.Context, name string) {
+	logger := loggerFrom(ctx)
+	release, err := acquireServiceLock(ctx, name, "standby", nil, false)
+	if err != nil {
+		logger.Debug("Skipping standby reconcile", zap.String("service", name), zap.Error(err))
+		return
+	}
+	defer release()
+	stateMu.Lock()
+	config := serviceConfigs[name]
+	sopt := config.StartOpt
+	owned := standbyOwned[name]
+	if owned == nil {
+		owned = make(map[string]bool)
+		standbyOwned[name] = owned
+	}
+	ids := []string{}
+	for id := range workers {
+		ids = append(ids, id)
+	}
+	stateMu.Unlock()
+	service, _ := getService(name)
+	for _, id := range ids {
+		if w, _ := getWorker(id); w.Status == "up" {
+			updateWorkerServices(ctx, id, name)
+		}
+	}
+	snapshot := make(map[string]Worker)
+	for _, id := range ids {
+		if w, ok := getWorker(id); ok {
+			snapshot[id] = w
+		}
+	}
+	count := config.Standby.Count
+	if count == 0 {
+		count = len(config.Standby.Workers)
+	}
+
+	// Candidates in order of preference: the chosen workers, or the least
+	// loaded up workers
+	candidates := config.Standby.Workers
+	if len(candidates) == 0 {
+		load := make(map[string]int)
+		for _, id := range ids {
+			for _, s := range snapshot[id].Services {
+				if s.Status == "running" {
+					load[id]++
+				}
+			}
+			candidates = append(candidates, id)
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			if load[candidates[i]] != load[candidates[j]] {
+				return load[candidates[i]] < load[candidates[j]]
+			}
+			return candidates[i] < candidates[j]
+		})
+	}
+
+	warm := 0
+	for _, id := range ids {
+		w := snapshot[id]
+		_, stat := isServiceInWorker(w, name)
+		if owned[id] && stat != "standby" {
+			// Used by a migration or removed, not ours anymore
+			stateMu.Lock()
+			delete(owned, id)
+			stateMu.Unlock()
+			continue
+		}
+		if w.Status != "up" || stat != "standby" {
+			continue
+		}
+		if isWarm(w, name, sopt) {
+			warm++
+		} else if owned[id] {
+			logger.Info("Recreating standby with new start options", zap.String("service", name), zap.String("worker", id))
+			if err := removeService(ctx, w, service); err != nil {
+				logger.Error("Error removing outdated standby", zap.String("service", name), zap.String("worker", id), zap.Error(err))
+				continue
+			}
+			stateMu.Lock()
+			delete(owned, id)
+			stateMu.Unlock()
+		}
+	}
+
+	for _, id := range candidates {
+		if warm >= count {
+			break
+		}
+		w, ok := getWorker(id)
+		if !ok || w.Status != "up" {
+			continue
+		}
+		isIn, stat := isServiceInWorker(w, name)
+		if isIn && !((stat == "exited" || stat == "stopped") && reflect.DeepEqual(w.lastSopt[name], sopt)) {
+			continue
+		}
+		if err := startServiceContainer(ctx, w, sopt); err != nil {
+			logger.Error("Error starting standby", zap.String("service", name), zap.String("worker", id), zap.Error(err))
+			continue
+		}
+		logger.Info("Standby started", zap.String("service", name), zap.String("worker", id))
+		stateMu.Lock()
+		owned[id] = true
+		stateMu.Unlock()
+		warm++
+	}
+
+	// Remove our own standbys above count, the least preferred first
+	for i := len(candidates) - 1; i >= 0 && warm > count; i-- {
+		id := candidates[i]
+		w, ok := getWorker(id)
+		if !owned[id] || !ok || !isWarm(w, name, sopt) {
+			continue
+		}
+		if err := removeService(ctx, w, service); err != nil {
+			logger.Error("Error removing standby", zap.String("service", name), zap.String("worker", id), zap.Error(err))
+			continue
+		}
+		logger.Info("Standby removed", zap.String("service", name), zap.String("worker", id))
+		stateMu.Lock()
+		delete(owned, id)
+		stateMu.Unlock()
+		warm--
+	}
+}
+
+func getStandbyHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	service := c.Param("name")
+	if _, ok := services[service]; !ok {
+		logger.Error("Service not found", zap.String("serviceName", service))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		return
+	}
+	resp := standbyStatus{StandbyConfig: serviceConfigs[service].Standby, Warm: warmWorkers(service)}
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, resp)
+}
+
+func setStandbyHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "put"), zap.String("path", c.Request.URL.Path))
+	service := c.Param("name")
+	if _, ok := services[service]; !ok {
+		logger.Error("Service not found", zap.String("serviceName", service))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service not found"})
+		return
+	}
+	var requestBody StandbyConfig
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		logger.Error("Error decoding JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
+		return
+	}
+	if requestBody.Count < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count must not be negative"})
+		return
+	}
+	for _, id := range requestBody.Workers {
+		if _, ok := workers[id]; !ok {
+			logger.Error("Worker not found", zap.String("workerID", id))
+			c.JSON(http.StatusNotFound, gin.H{"error": "Worker not found: " + id})
+			return
+		}
+	}
+	stateMu.Lock()
+	config := serviceConfigs[service]
+	config.Standby = requestBody
+	serviceConfigs[service] = config
+	stateMu.Unlock()
+	logger.Info("Standby configuration changed", zap.String("service", service), zap.Int("count", requestBody.Count), zap.Strings("workers", requestBody.Workers))
+
+	reconcileStandby(c.Request.Context(), service)
+	resp := standbyStatus{StandbyConfig: requestBody, Warm: warmWorkers(service)}
+	logger.Debug("response", zap.String("method", "put"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReconcileStandbys(t *testing.T) {
+	tests := []struct {
+		name    string
+		standby StandbyConfig
+		w1, w2  string //status of a afterwards
+	}{
+		{name: "nothing asked", w1: "", w2: ""},
+		{name: "one on each listed worker", standby: StandbyConfig{Workers: []string{"w2"}}, w1: "", w2: "standby"},
+		{name: "count on chosen workers", standby: StandbyConfig{Count: 1, Workers: []string{"w1", "w2"}}, w1: "standby", w2: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCluster(t, []string{"w1", "w2"}, "a")
+			old := standbyOwned
+			standbyOwned = make(map[string]map[string]bool)
+			t.Cleanup(func() { standbyOwned = old })
+			serviceConfigs["a"] = ServiceConfig{StartOpt: StartOptions{ContainerName: "a", Image: services["a"].Image}, Standby: tt.standby}
+
+			// As after a first reconcile that could not start anything
+			reconcileStandbys(context.Background())
+			if got := statusOn(t, "w1", "a"); got != tt.w1 {
+				t.Errorf("a on w1 is %q, want %q", got, tt.w1)
+			}
+			if got := statusOn(t, "w2", "a"); got != tt.w2 {
+				t.Errorf("a on w2 is %q, want %q", got, tt.w2)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,7 +15,8 @@ import (
 	"github.com/docker/docker/api/types/mount"
 )
 
-func startServiceContainer(worker Worker, startBody StartOptions) error {
+func startServiceContainer(ctx context.Context, worker Worker, startBody StartOptions) error {
+	logger := loggerFrom(ctx)
 	logger.Debug("Starting service", zap.String("service", startBody.ContainerName))
 	if _, ok := services[startBody.ContainerName]; ok {
 		isIn, stat := isServiceInWorker(worker, startBody.ContainerName)
@@ -25,8 +27,9 @@ func startServiceContainer(worker Worker, startBody StartOptions) error {
 			logger.Error("Service already existed on destination with different start options", zap.String("service", startBody.ContainerName), zap.String("worker", worker.Id))
 			return errors.New("Service already existed on destination with different start options, Pls remove first")
 		}
-		url := "http://" + worker.IpAddrPort + "/cm_controller/v1/start"
+		url := controllerURL(worker, "/start")
 		reqJson := startBody
+		reqJson.ContainerName = containerName(startBody.ContainerName)
 		reqJson.Mounts = append(reqJson.Mounts, mount.Mount{Source: "chkfs", Target: "/checkpointfs", Type: "volume"})
 		requestBody, err := json.Marshal(reqJson)
 		if err != nil {
@@ -34,14 +37,14 @@ func startServiceContainer(worker Worker, startBody StartOptions) error {
 			return err
 		}
 
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(requestBody))
 		if err != nil {
 			logger.Error("Error creating request", zap.Error(err))
 			return err
 		}
 		req.Close = true
 		req.Header.Set("Content-Type", "application/json")
-		client := &http.Client{}
+		client := controllerClient
 		logger.Debug("Sending request to controller", zap.String("url", url))
 		resp, err := client.Do(req)
 		if err != nil {
@@ -58,9 +61,11 @@ func startServiceContainer(worker Worker, startBody StartOptions) error {
 		}
 
 		if resp.StatusCode == 200 {
+			stateMu.Lock()
 			config := serviceConfigs[startBody.ContainerName]
 			config.StartOpt = startBody
 			serviceConfigs[startBody.ContainerName] = config
+			stateMu.Unlock()
 			logger.Info("Service's container started", zap.String("worker", worker.Id), zap.String("service", startBody.ContainerName))
 			worker := workers[worker.Id]
 			isIn, _ := isServiceInWorker(worker, startBody.ContainerName)
@@ -70,10 +75,10 @@ func startServiceContainer(worker Worker, startBody StartOptions) error {
 				updateRunService(worker.Id, ServiceInWorker{Name: startBody.ContainerName, Status: "standby"})
 			}
 			updateEditLastSopt(worker.Id, startBody.ContainerName, startBody)
-			updateWorkerServices(worker.Id, startBody.ContainerName)
+			updateWorkerServices(ctx, worker.Id, startBody.ContainerName)
 			return nil
 		} else {
-			updateWorkerServices(worker.Id, startBody.ContainerName)
+			updateWorkerServices(ctx, worker.Id, startBody.ContainerName)
 			logger.Error("Start service's container fail at worker", zap.String("worker", worker.Id), zap.String("service", startBody.ContainerName), zap.Int("status_code", resp.StatusCode), zap.String("body", string(body)))
 			return fmt.Errorf("start container fail at worker with response code %d: %s", resp.StatusCode, string(body))
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,17 +9,18 @@ import (
 	"go.uber.org/zap"
 )
 
-func stopService(worker Worker, service Service) error {
+func stopService(ctx context.Context, worker Worker, service Service) error {
+	logger := loggerFrom(ctx)
 	logger.Debug("Stopping service", zap.String("worker", worker.Id), zap.String("service", service.Name))
-	url := "http://" + worker.IpAddrPort + "/cm_controller/v1/stop/" + service.Name
+	url := controllerURL(worker, "/stop/"+containerName(service.Name))
 
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
 	if err != nil {
 		logger.Error("Error creating request", zap.Error(err))
 		return err
 	}
 	req.Close = true
-	client := &http.Client{}
+	client := controllerClient
 	logger.Debug("Sending request to controller", zap.String("url", url))
 	resp, err := client.Do(req)
 	if err != nil {
@@ -34,11 +36,11 @@ func stopService(worker Worker, service Service) error {
 		return err
 	}
 	if resp.StatusCode != 200 {
-		updateWorkerServices(worker.Id, service.Name)	
+		updateWorkerServices(ctx, worker.Id, service.Name)	
 		logger.Error("Stop service fail at worker", zap.String("worker", worker.Id), zap.String("service", service.Name), zap.Int("status_code", resp.StatusCode), zap.String("body", string(body)))
 		return fmt.Errorf("stop service fail at worker with response code %d", resp.StatusCode)
 	}
-  updateWorkerServices(worker.Id, service.Name)	
+  updateWorkerServices(ctx, worker.Id, service.Name)	
 	logger.Info("Stop service at worker succesfully", zap.String("worker", worker.Id), zap.String("service", service.Name))
 	return nil
 }
@@ -1,14 +1,24 @@
 package main
 
-import "github.com/docker/docker/api/types/mount"
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+)
 
 type Worker struct {
-	Id         string            `json:"id"`
-	IpAddrPort string            `json:"addr"` //ex. 192.168.1.2:8787
-	Status     string            `json:"status"`
-	Services   []ServiceInWorker `json:"services"`
-	countDown  int
-	lastSopt   map[string]StartOptions
+	Id          string               `json:"id"`
+	IpAddrPort  string               `json:"addr"` //ex. 192.168.1.2:8787
+	Status      string               `json:"status"`
+	Services    []ServiceInWorker    `json:"services"`
+	Capacity    int                  `json:"capacity,omitempty"` //max running services, 0 means unlimited
+	Breaker     string               `json:"breaker"`            //circuit breaker of its controller: closed, open or half_open
+	Since       time.Time            `json:"status_since"`       //when Status was entered
+	Transitions map[string]time.Time `json:"transitions"`        //last time each status was entered
+	lastSopt    map[string]StartOptions
+	lastBeat    time.Time
 }
 
 type ServiceInWorker struct {
@@ -17,15 +27,17 @@ type ServiceInWorker struct {
 }
 
 type Service struct {
-	Name     string   `json:"name"`
-	ChkFiles []string `json:"chk_files"`
-	Image    string   `json:"image"`
+	Name      string   `json:"name"` //service, or service/instance for an instance
+	ChkFiles  []string `json:"chk_files"`
+	Image     string   `json:"image"`
+	Instances []string `json:"instances,omitempty"` //names of the service's instances
 }
 
 type ServiceConfig struct {
 	StartOpt StartOptions      `json:"start_opt"`
 	RunOpt   RunOptions        `json:"run_opt"`
 	ChkOpt   CheckpointOptions `json:"chk_opt"`
+	Standby  StandbyConfig     `json:"standby"`
 }
 
 type StartOptions struct {
@@ -46,6 +58,10 @@ type CheckpointOptions struct {
 	Cpu_budget    string   `json:"cpu_budget"`
 	Verbose       int      `json:"verbose"`
 	Envs          []string `json:"envs"`
+	PreCopy       int      `json:"pre_copy,omitempty"`     //leave_running checkpoints taken before the final one on migrate
+	ParentImage   string   `json:"parent_image,omitempty"` //previous image of a pre-copy chain, only dirty pages are dumped
+	preCopyRound  int
+	imageOf       string //service or instance the image is named after, the checkpointed one when empty
 }
 
 type RunOptions struct {
@@ -59,15 +75,98 @@ type RunOptions struct {
 	LeaveStopped   bool     `json:"leave_stopped"`
 	Verbose        int      `json:"verbose"`
 	Envs           []string `json:"envs"`
+	ParentImages   []string `json:"parent_images,omitempty"` //pre-copy images image_url builds on, oldest first
+}
+
+// stateMu serializes the updates of the workers, services and serviceConfigs
+// maps, migrations of different services may run concurrently. It does not
+// make plain reads of the maps safe: most handlers still read them directly,
+// while code running beside other operations and the heartbeat goroutines
+// (rebalance steps, batch items, standby reconciles, the worker listings, the
+// gRPC methods) reads through workerIds, getWorker, serviceNames, getService,
+// getServiceConfig and lastStartOptions.
+var stateMu sync.Mutex
+
+// getWorker returns a copy of the worker taken under stateMu, its services
+// and start options can be used after the lock is released
+func getWorker(id string) (Worker, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	worker, ok := workers[id]
+	if !ok {
+		return worker, false
+	}
+	worker.Services = append([]ServiceInWorker(nil), worker.Services...)
+	lastSopt := make(map[string]StartOptions, len(worker.lastSopt))
+	for k, v := range worker.lastSopt {
+		lastSopt[k] = v
+	}
+	worker.lastSopt = lastSopt
+	return worker, true
+}
+
+// workerIds returns the ids of the workers, sorted, taken under stateMu
+func workerIds() []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	ids := make([]string, 0, len(workers))
+	for id := range workers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// getService returns the catalog entry of a service taken under stateMu
+func getService(name string) (Service, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	service, ok := services[name]
+	service.ChkFiles = append([]string(nil), service.ChkFiles...)
+	service.Instances = append([]string(nil), service.Instances...)
+	return service, ok
+}
+
+// serviceNames returns the names of the services, sorted, taken under stateMu
+func serviceNames() []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getServiceConfig returns the configuration of a service taken under stateMu
+func getServiceConfig(name string) (ServiceConfig, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	config, ok := serviceConfigs[name]
+	config.Standby.Workers = append([]string(nil), config.Standby.Workers...)
+	return config, ok
+}
+
+// lastStartOptions returns the options service was last started with on the
+// worker
+func lastStartOptions(workerId string, service string) StartOptions {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return workers[workerId].lastSopt[service]
 }
 
 func addRunService(workerId string, service ServiceInWorker) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	worker := workers[workerId]
 	worker.Services = append(worker.Services, service)
 	workers[workerId] = worker
 }
 
 func deleteRunService(workerId string, service string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	worker := workers[workerId]
 	for i, v := range worker.Services {
 		if v.Name == service {
@@ -78,6 +177,8 @@ func deleteRunService(workerId string, service string) {
 }
 
 func updateRunService(workerId string, service ServiceInWorker) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	worker := workers[workerId]
 	for i, v := range worker.Services {
 		if v.Name == service.Name {
@@ -87,14 +188,63 @@ func updateRunService(workerId string, service ServiceInWorker) {
 	workers[workerId] = worker
 }
 
-func setWorkerCountdown(workerId string, countDown int) {
+func setWorkerLastBeat(workerId string, lastBeat time.Time) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	worker := workers[workerId]
-	worker.countDown = countDown
+	worker.lastBeat = lastBeat
 	workers[workerId] = worker
 }
 
 func setWorkerStatus(workerId string, status string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	worker := workers[workerId]
+	if worker.Status == status {
+		return
+	}
+	now := time.Now().UTC()
+	previous := worker.Status
 	worker.Status = status
+	worker.Since = now
+	// Copied on write, handlers encode the map of a copy without the lock
+	transitions := make(map[string]time.Time, len(worker.Transitions)+1)
+	for s, t := range worker.Transitions {
+		transitions[s] = t
+	}
+	transitions[status] = now
+	worker.Transitions = transitions
+	workers[workerId] = worker
+	if status != workerNew {
+		publishEvent("worker."+status, workerEvent{Worker: workerId, Addr: worker.IpAddrPort, Status: status, Previous: previous})
+	}
+}
+
+func setWorkerBreaker(workerId string, state string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	worker, ok := workers[workerId]
+	if !ok {
+		return
+	}
+	worker.Breaker = state
+	workers[workerId] = worker
+}
+
+func setWorkerAddr(workerId string, addr string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	worker := workers[workerId]
+	worker.IpAddrPort = addr
+	worker.Breaker = breakerClosed
+	worker.Services = []ServiceInWorker{} //rescanned from the controller at the new address
+	workers[workerId] = worker
+}
+
+func setWorkerCapacity(workerId string, capacity int) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	worker := workers[workerId]
+	worker.Capacity = capacity
 	workers[workerId] = worker
 }
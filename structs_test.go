@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Run with -race, the handlers encode workers while the detector flips them
+func TestSetWorkerStatusWhileReading(t *testing.T) {
+	withCluster(t, []string{"w1", "w2"}, "a")
+	runOn(t, "w1", "a")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/worker/:worker_id", getWorkerHandler)
+	router.GET("/worker", getAllWorkersHandler)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			setWorkerStatus("w1", []string{workerSuspect, workerUp}[i%2])
+			runtime.Gosched()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		for _, path := range []string{"/worker/w1", "/worker"} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s = %d: %s", path, w.Code, w.Body.String())
+			}
+		}
+	}
+	wg.Wait()
+
+	w, _ := getWorker("w1")
+	if _, ok := w.Transitions[workerSuspect]; !ok {
+		t.Errorf("transitions = %v, want suspect recorded", w.Transitions)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Listener TLS. Clients with a certificate from --tls-client-ca get their
+// role from --auth-certs, see auth_certs_init.
+var tlsCertFile string
+var tlsKeyFile string
+var tlsClientCAFile string
+
+// Manager to controller TLS, used for workers whose addr starts with https://
+var controllerCAFile string
+var controllerCertFile string
+var controllerKeyFile string
+
+var controllerClient = &http.Client{}
+
+// listenerTLSConfig returns nil when the TCP listener should serve plain HTTP
+func listenerTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		if tlsClientCAFile != "" {
+			return nil, errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if tlsClientCAFile != "" {
+		pool, err := loadCertPool(tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		// Clients without a certificate can still use a bearer token
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func controller_tls_init() error {
+	if controllerCAFile == "" && controllerCertFile == "" && controllerKeyFile == "" {
+		return nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if controllerCAFile != "" {
+		// Only the given CA is trusted, the system roots are not used
+		pool, err := loadCertPool(controllerCAFile)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = pool
+	}
+	if controllerCertFile != "" || controllerKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(controllerCertFile, controllerKeyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	controllerClient = &http.Client{Transport: transport}
+	logger.Info("Controller TLS configured", zap.Bool("pinned_ca", controllerCAFile != ""), zap.Bool("client_cert", controllerCertFile != ""))
+	return nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// controllerURL builds the URL of a controller API path. A worker's addr may
+// carry a scheme (https://host:port), plain host:port means http.
+func controllerURL(worker Worker, path string) string {
+	addr := worker.IpAddrPort
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + "/cm_controller/v1" + path
+}
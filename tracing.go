@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+var tracer = otel.Tracer("github.com/cm_manager")
+
+var traceOTLPEndpoint string //ex. localhost:4318
+var traceFile string
+var traceSampleRatio = 1.0
+
+var tracerProvider *sdktrace.TracerProvider
+
+func tracing_init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if traceOTLPEndpoint == "" && traceFile == "" {
+		return
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "cm_manager"))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(traceSampleRatio))),
+	}
+	if traceOTLPEndpoint != "" {
+		exporter, err := otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpoint(traceOTLPEndpoint),
+			otlptracehttp.WithInsecure(),
+		)
+		if err != nil {
+			logger.Error("Error creating OTLP trace exporter", zap.Error(err))
+			return
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	if traceFile != "" {
+		file, err := os.OpenFile(traceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Error("Error opening trace file", zap.Error(err))
+			return
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			logger.Error("Error creating file trace exporter", zap.Error(err))
+			return
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	tracerProvider = sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tracerProvider)
+	logger.Info("Tracing enabled", zap.String("otlp", traceOTLPEndpoint), zap.String("file", traceFile), zap.Float64("sample_ratio", traceSampleRatio))
+}
+
+func tracing_shutdown() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logger.Error("Error flushing traces", zap.Error(err))
+	}
+}
+
+// detachedContext keeps the values (span, request id) of its parent but not
+// its cancellation, a client going away must not abort an operation halfway
+type detachedContext struct {
+	context.Context
+	parent context.Context
+}
+
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{Context: context.Background(), parent: ctx}
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+func tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if heartbeatPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracer.Start(detachContext(ctx), c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", c.Request.Method),
+				attribute.String("http.route", route),
+				attribute.String("cm.listener", listenerOf(c)),
+			),
+		)
+		defer span.End()
+		for _, p := range c.Params {
+			span.SetAttributes(attribute.String("cm."+p.Key, p.Value))
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= 400 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// tracingTransport creates a client span for every controller call and
+// propagates the trace context to the controller in the request headers
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := controllerOperation(req.URL.Path)
+	ctx, span := tracer.Start(req.Context(), "controller "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("cm.operation", op),
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.String()),
+			attribute.String("net.peer.name", req.URL.Host),
+		),
+	)
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, "controller returned "+strconv.Itoa(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func traceControllerClient() {
+	base := controllerClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	controllerClient.Transport = tracingTransport{base: base}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Webhooks notify subscribers of cluster events. Each event is posted as a
+// WebhookEvent to every subscription whose filter matches its type:
+//
+//	worker.up, worker.suspect, worker.down, worker.left
+//	migration.success, migration.failure, migration.rolled_back, migration.rollback_failed
+//	checkpoint.success, checkpoint.failure
+//	ping (sent by the test action only)
+//
+// With a secret, the body is signed: X-CM-Signature is "sha256=" and the hex
+// HMAC-SHA256 of X-CM-Timestamp, a dot and the body.
+var webhooksPath = "cm_manager_webhooks.json"
+var webhookTimeout = 10 * time.Second
+var webhookLogSize = 1000 //deliveries kept, oldest dropped first
+var webhookConcurrency = 8
+var webhookQueueSize = 1000 //deliveries waiting for a worker, new ones are dropped when full
+
+const webhookDefaultAttempts = 5
+
+type WebhookSubscription struct {
+	Id          string    `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"` //types or prefixes like "worker.*", empty for all
+	Secret      string    `json:"secret,omitempty"`
+	MaxAttempts int       `json:"max_attempts"`
+	Created     time.Time `json:"created"`
+}
+
+type webhookReq struct {
+	URL         string   `json:"url" binding:"required"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret"`
+	MaxAttempts int      `json:"max_attempts"`
+}
+
+type WebhookEvent struct {
+	Id   string      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type WebhookDelivery struct {
+	Id           string    `json:"id"`
+	Subscription string    `json:"subscription"`
+	Event        string    `json:"event"`
+	EventId      string    `json:"event_id"`
+	Time         time.Time `json:"time"`
+	Attempts     int       `json:"attempts"`
+	Status       string    `json:"status"` //pending, delivered, failed or dropped
+	StatusCode   int       `json:"status_code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Duration     float64   `json:"duration"` //seconds, all attempts included
+}
+
+type workerEvent struct {
+	Worker   string `json:"worker"`
+	Addr     string `json:"addr"`
+	Status   string `json:"status"`
+	Previous string `json:"previous"`
+}
+
+type checkpointEvent struct {
+	Worker  string `json:"worker"`
+	Service string `json:"service"`
+	Image   string `json:"image,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+var webhooksMu sync.Mutex
+var webhooks = make(map[string]WebhookSubscription)
+var webhookLog []*WebhookDelivery
+var webhookQueue = make(chan webhookJob, webhookQueueSize)
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Watchers get the same events in process, webhooksMu is not needed
+var watcherBuffer = 64
+var watchersMu sync.Mutex
+var watchers = make(map[chan WebhookEvent]struct{})
+
+var webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cm_manager_webhook_deliveries_total",
+	Help: "Webhook deliveries by event type and result (delivered, failed or dropped when the queue is full).",
+}, []string{"event", "result"})
+
+// webhookJob is a delivery waiting in webhookQueue
+type webhookJob struct {
+	sub   WebhookSubscription
+	event WebhookEvent
+	body  []byte
+	d     *WebhookDelivery
+}
+
+// startWebhookWorkers delivers the jobs of queue with n workers, a slow
+// receiver holds one worker and the queue absorbs bursts of events
+func startWebhookWorkers(queue <-chan webhookJob, n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range queue {
+				deliverWebhook(context.Background(), job.sub, job.event, job.body, job.d, job.sub.MaxAttempts)
+			}
+		}()
+	}
+}
+
+func webhooks_init() {
+	startWebhookWorkers(webhookQueue, webhookConcurrency)
+	content, err := os.ReadFile(webhooksPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("Error reading webhooks", zap.Error(err))
+		}
+		return
+	}
+	var subs []WebhookSubscription
+	if err := json.Unmarshal(content, &subs); err != nil {
+		logger.Error("Error decoding webhooks", zap.Error(err))
+		return
+	}
+	for _, sub := range subs {
+		webhooks[sub.Id] = sub
+	}
+	logger.Debug("Loaded webhooks", zap.Int("count", len(subs)))
+}
+
+// saveWebhooks writes the subscriptions, webhooksMu must be held
+func saveWebhooks() error {
+	subs := make([]WebhookSubscription, 0, len(webhooks))
+	for _, id := range webhookIds() {
+		subs = append(subs, webhooks[id])
+	}
+	content, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Secrets are in there
+	tmp := webhooksPath + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, webhooksPath)
+}
+
+// webhookIds returns the subscription ids sorted, webhooksMu must be held
+func webhookIds() []string {
+	ids := make([]string, 0, len(webhooks))
+	for id := range webhooks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// matches tells whether the subscription wants events of type t
+func (s WebhookSubscription) matches(t string) bool {
+	return eventMatches(s.Events, t)
+}
+
+// eventMatches tells whether t is one of the patterns, exact types, "*" or
+// prefixes like "worker.*". No patterns match every event.
+func eventMatches(patterns []string, t string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == t || (strings.HasSuffix(pattern, ".*") && strings.HasPrefix(t, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns the subscription as shown by the API
+func (s WebhookSubscription) redacted() WebhookSubscription {
+	if s.Secret != "" {
+		s.Secret = "[REDACTED]"
+	}
+	return s
+}
+
+// watchEvents registers a watcher receiving every published event, as the
+// gRPC Watch does. Events are dropped for watchers not keeping up.
+func watchEvents() (<-chan WebhookEvent, func()) {
+	ch := make(chan WebhookEvent, watcherBuffer)
+	watchersMu.Lock()
+	watchers[ch] = struct{}{}
+	watchersMu.Unlock()
+	return ch, func() {
+		watchersMu.Lock()
+		delete(watchers, ch)
+		watchersMu.Unlock()
+	}
+}
+
+// publishEvent queues the event for the matching subscriptions and the
+// watchers. It does not block, it is called with the state locks held.
+func publishEvent(eventType string, data interface{}) {
+	event := WebhookEvent{Id: newRequestID(), Type: eventType, Time: time.Now().UTC(), Data: data}
+	watchersMu.Lock()
+	for ch := range watchers {
+		select {
+		case ch <- event:
+		default:
+			logger.Warn("Event watcher is not keeping up, event dropped", zap.String("event", eventType))
+		}
+	}
+	watchersMu.Unlock()
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	var body []byte
+	for _, id := range webhookIds() {
+		sub := webhooks[id]
+		if !sub.matches(eventType) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(event); err != nil {
+				logger.Error("Error marshalling webhook event", zap.String("event", eventType), zap.Error(err))
+				return
+			}
+		}
+		d := newWebhookDelivery(sub, event)
+		select {
+		case webhookQueue <- webhookJob{sub: sub, event: event, body: body, d: d}:
+		default:
+			d.Status = "dropped"
+			d.Error = "delivery queue full"
+			webhookDeliveries.WithLabelValues(eventType, "dropped").Inc()
+			logger.Warn("Webhook delivery queue full, event dropped", zap.String("subscription", sub.Id), zap.String("event", eventType))
+		}
+	}
+}
+
+// newWebhookDelivery adds a pending delivery to the log, webhooksMu must be held
+func newWebhookDelivery(sub WebhookSubscription, event WebhookEvent) *WebhookDelivery {
+	d := &WebhookDelivery{Id: newRequestID(), Subscription: sub.Id, Event: event.Type, EventId: event.Id, Time: time.Now().UTC(), Status: "pending"}
+	webhookLog = append(webhookLog, d)
+	if len(webhookLog) > webhookLogSize {
+		webhookLog = webhookLog[len(webhookLog)-webhookLogSize:]
+	}
+	return d
+}
+
+// webhookSignature signs the timestamp and the body with the secret
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts the event until the receiver answers 2xx, retrying
+// errors, 429 and 5xx with backoff up to attempts times
+func deliverWebhook(ctx context.Context, sub WebhookSubscription, event WebhookEvent, body []byte, d *WebhookDelivery, attempts int) {
+	if attempts < 1 {
+		attempts = webhookDefaultAttempts
+	}
+	backoff := retryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}
+	start := time.Now()
+	var status int
+	var err error
+	for attempt := 1; ; attempt++ {
+		status, err = postWebhook(ctx, sub, event, body, d.Id)
+		retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+		webhooksMu.Lock()
+		d.Attempts = attempt
+		d.StatusCode = status
+		d.Error = ""
+		if err != nil {
+			d.Error = err.Error()
+		}
+		webhooksMu.Unlock()
+		if (err == nil && status < 300) || !retry || attempt >= attempts {
+			break
+		}
+		delay := backoff.backoff(attempt)
+		logger.Warn("Retrying webhook", zap.String("subscription", sub.Id), zap.String("event", event.Type), zap.Int("attempt", attempt), zap.Int("status", status), zap.Error(err), zap.Duration("delay", delay))
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	result := "delivered"
+	if err != nil || status >= 300 {
+		result = "failed"
+		if err == nil {
+			err = fmt.Errorf("receiver answered %d", status)
+		}
+		logger.Error("Webhook delivery failed", zap.String("subscription", sub.Id), zap.String("event", event.Type), zap.Int("attempts", d.Attempts), zap.Error(err))
+	}
+	webhookDeliveries.WithLabelValues(event.Type, result).Inc()
+	webhooksMu.Lock()
+	d.Status = result
+	if result == "failed" {
+		d.Error = err.Error()
+	}
+	d.Duration = time.Since(start).Seconds()
+	webhooksMu.Unlock()
+}
+
+func postWebhook(ctx context.Context, sub WebhookSubscription, event WebhookEvent, body []byte, deliveryId string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cm_manager-webhook")
+	req.Header.Set("X-CM-Event", event.Type)
+	req.Header.Set("X-CM-Delivery", deliveryId)
+	req.Header.Set("X-CM-Timestamp", timestamp)
+	if sub.Secret != "" {
+		req.Header.Set("X-CM-Signature", webhookSignature(sub.Secret, timestamp, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, nil
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be http or https with a host")
+	}
+	return nil
+}
+
+func getWebhooksHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	webhooksMu.Lock()
+	subs := []WebhookSubscription{}
+	for _, id := range webhookIds() {
+		subs = append(subs, webhooks[id].redacted())
+	}
+	webhooksMu.Unlock()
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, subs)
+}
+
+func addWebhookHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "post"), zap.String("path", c.Request.URL.Path))
+	var requestBody webhookReq
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		logger.Error("Error decoding JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error decoding JSON"})
+		return
+	}
+	if err := validateWebhookURL(requestBody.URL); err != nil {
+		logger.Error("Invalid webhook url", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid url: " + err.Error()})
+		return
+	}
+	if requestBody.MaxAttempts < 1 {
+		requestBody.MaxAttempts = webhookDefaultAttempts
+	}
+	sub := WebhookSubscription{
+		Id:          newRequestID(),
+		URL:         requestBody.URL,
+		Events:      requestBody.Events,
+		Secret:      requestBody.Secret,
+		MaxAttempts: requestBody.MaxAttempts,
+		Created:     time.Now().UTC(),
+	}
+	if sub.Events == nil {
+		sub.Events = []string{}
+	}
+	webhooksMu.Lock()
+	webhooks[sub.Id] = sub
+	err := saveWebhooks()
+	webhooksMu.Unlock()
+	if err != nil {
+		logger.Error("Error saving webhooks", zap.Error(err))
+	}
+	logger.Info("Webhook added", zap.String("id", sub.Id), zap.Strings("events", sub.Events))
+	logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusCreated))
+	c.JSON(http.StatusCreated, sub.redacted())
+}
+
+func getWebhookHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	webhooksMu.Lock()
+	sub, ok := webhooks[c.Param("id")]
+	webhooksMu.Unlock()
+	if !ok {
+		logger.Error("Webhook not found", zap.String("id", c.Param("id")))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, sub.redacted())
+}
+
+func deleteWebhookHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "delete"), zap.String("path", c.Request.URL.Path))
+	id := c.Param("id")
+	webhooksMu.Lock()
+	_, ok := webhooks[id]
+	var err error
+	if ok {
+		delete(webhooks, id)
+		err = saveWebhooks()
+	}
+	webhooksMu.Unlock()
+	if !ok {
+		logger.Error("Webhook not found", zap.String("id", id))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("Error saving webhooks", zap.Error(err))
+	}
+	response := fmt.Sprintf("Webhook %s deleted", id)
+	logger.Debug("response", zap.String("method", "delete"), zap.String("path", c.Request.URL.Path), zap.String("response", response), zap.Int("status", http.StatusNoContent))
+	c.JSON(http.StatusNoContent, gin.H{"msg": response})
+}
+
+// getWebhookDeliveriesHandler lists the most recent deliveries of a
+// subscription, newest first
+func getWebhookDeliveriesHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "get"), zap.String("path", c.Request.URL.Path))
+	id := c.Param("id")
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	status := c.Query("status")
+	webhooksMu.Lock()
+	_, ok := webhooks[id]
+	deliveries := []WebhookDelivery{}
+	for i := len(webhookLog) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		d := webhookLog[i]
+		if d.Subscription == id && (status == "" || d.Status == status) {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	webhooksMu.Unlock()
+	if !ok {
+		logger.Error("Webhook not found", zap.String("id", id))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool { return deliveries[i].Time.After(deliveries[j].Time) })
+	logger.Debug("response", zap.String("method", "get"), zap.String("path", c.Request.URL.Path), zap.Int("status", http.StatusOK))
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// testWebhookHandler sends a ping event to the subscription once and answers
+// with the delivery, 502 when the receiver did not accept it
+func testWebhookHandler(c *gin.Context) {
+	logger := loggerFrom(c.Request.Context())
+	logger.Debug("request", zap.String("method", "post"), zap.String("path", c.Request.URL.Path))
+	id := c.Param("id")
+	webhooksMu.Lock()
+	sub, ok := webhooks[id]
+	if !ok {
+		webhooksMu.Unlock()
+		logger.Error("Webhook not found", zap.String("id", id))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	event := WebhookEvent{Id: newRequestID(), Type: "ping", Time: time.Now().UTC(), Data: gin.H{"subscription": id}}
+	d := newWebhookDelivery(sub, event)
+	webhooksMu.Unlock()
+
+	body, _ := json.Marshal(event)
+	deliverWebhook(c.Request.Context(), sub, event, body, d, 1)
+	webhooksMu.Lock()
+	result := *d
+	webhooksMu.Unlock()
+	status := http.StatusOK
+	if result.Status != "delivered" {
+		status = http.StatusBadGateway
+	}
+	logger.Debug("response", zap.String("method", "post"), zap.String("path", c.Request.URL.Path), zap.Int("status", status))
+	c.JSON(status, result)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		event    string
+		want     bool
+	}{
+		{name: "no patterns", event: "worker.down", want: true},
+		{name: "star", patterns: []string{"*"}, event: "migration.success", want: true},
+		{name: "exact", patterns: []string{"worker.down"}, event: "worker.down", want: true},
+		{name: "other type", patterns: []string{"worker.down"}, event: "worker.up", want: false},
+		{name: "prefix", patterns: []string{"worker.*"}, event: "worker.suspect", want: true},
+		{name: "prefix of another kind", patterns: []string{"worker.*"}, event: "workers.up", want: false},
+		{name: "prefix is not the kind alone", patterns: []string{"worker.*"}, event: "worker", want: false},
+		{name: "nested prefix", patterns: []string{"migration.*"}, event: "migration.rolled_back", want: true},
+		{name: "prefix without the dot", patterns: []string{"worker*"}, event: "worker.up", want: false},
+		{name: "any of several", patterns: []string{"checkpoint.failure", "migration.*"}, event: "migration.failure", want: true},
+		{name: "none of several", patterns: []string{"checkpoint.failure", "migration.*"}, event: "checkpoint.success", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventMatches(tt.patterns, tt.event); got != tt.want {
+				t.Errorf("eventMatches(%v, %q) = %v, want %v", tt.patterns, tt.event, got, tt.want)
+			}
+			if got := (WebhookSubscription{Events: tt.patterns}).matches(tt.event); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// withWebhooks replaces the subscriptions, delivery log and queue for the test
+func withWebhooks(t *testing.T, queueSize int, subs ...WebhookSubscription) {
+	t.Helper()
+	webhooksMu.Lock()
+	oldSubs, oldLog, oldQueue := webhooks, webhookLog, webhookQueue
+	webhooks, webhookLog, webhookQueue = make(map[string]WebhookSubscription), nil, make(chan webhookJob, queueSize)
+	for _, sub := range subs {
+		webhooks[sub.Id] = sub
+	}
+	webhooksMu.Unlock()
+	t.Cleanup(func() {
+		webhooksMu.Lock()
+		webhooks, webhookLog, webhookQueue = oldSubs, oldLog, oldQueue
+		webhooksMu.Unlock()
+	})
+}
+
+func deliveryStatuses() map[string]int {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	statuses := make(map[string]int)
+	for _, d := range webhookLog {
+		statuses[d.Status]++
+	}
+	return statuses
+}
+
+func TestPublishEventDropsWhenTheQueueIsFull(t *testing.T) {
+	withWebhooks(t, 2, WebhookSubscription{Id: "s1", URL: "http://127.0.0.1:1/hook"})
+	// No workers, the queue only fills
+	for i := 0; i < 5; i++ {
+		publishEvent("worker.down", workerEvent{Worker: "w1"})
+	}
+	want := map[string]int{"pending": 2, "dropped": 3}
+	if got := deliveryStatuses(); !reflect.DeepEqual(got, want) {
+		t.Errorf("deliveries = %v, want %v", got, want)
+	}
+	if len(webhookQueue) != 2 {
+		t.Errorf("%d jobs queued, want 2", len(webhookQueue))
+	}
+}
+
+func TestWebhookWorkersDeliver(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	withWebhooks(t, 10, WebhookSubscription{Id: "s1", URL: srv.URL, Events: []string{"worker.*"}})
+	queue := webhookQueue
+	startWebhookWorkers(queue, 2)
+	defer close(queue)
+
+	for i := 0; i < 4; i++ {
+		publishEvent("worker.down", workerEvent{Worker: "w1"})
+	}
+	publishEvent("migration.success", nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for deliveryStatuses()["delivered"] < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := deliveryStatuses(); !reflect.DeepEqual(got, map[string]int{"delivered": 4}) {
+		t.Errorf("deliveries = %v, want 4 delivered", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if received != 4 {
+		t.Errorf("receiver got %d events, want 4", received)
+	}
+}